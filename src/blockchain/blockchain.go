@@ -2,24 +2,21 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"encoding/base64"
 )
 
-// TARGET - A valid block hash has its first TARGET bits be zero.
-const TARGET = 20
-
 // PostBody - Part of Post used to generate a signature.
 type PostBody struct {
+	ChainID   string // the network this post is written for, so that it cannot be replayed on another network
 	Content   string
 	Timestamp int64
 }
 
 // Post - A user's message to be sent to the blockchain.
 type Post struct {
-	User      *rsa.PublicKey // user's public key
-	Signature []byte         // generated by signing Body with User
-	Body      PostBody       // the content of the post
+	User      PublicKey // user's public key
+	Signature []byte    // generated by signing Body with User
+	Body      PostBody  // the content of the post
 }
 
 // Verify - verifies the Post's signature matches its public key and body.
@@ -27,11 +24,31 @@ func (p *Post) Verify() bool {
 	return Verify(p.User, p.Body, p.Signature)
 }
 
+// ID - the identity of the Post, which is the hash of its canonical encoding (including the user and the signature).
+// Two posts are the same post if and only if they have the same ID.
+func (p *Post) ID() []byte {
+	return Hash(p)
+}
+
+// ComparePosts - the order of posts shared by miners and users.
+// Posts are ordered by timestamp, and posts with the same timestamp by ID. Returns 0 only for the same post.
+func ComparePosts(a, b *Post) int {
+	if a.Body.Timestamp != b.Body.Timestamp {
+		if a.Body.Timestamp < b.Body.Timestamp {
+			return -1
+		} else {
+			return 1
+		}
+	}
+	return bytes.Compare(a.ID(), b.ID())
+}
+
 // BlockHeader - Part of Block used to generate the block identity hash (the target of mining).
 type BlockHeader struct {
 	PrevHash  []byte // the identity hash of the previous block in a blockchain
-	Summary   []byte // hash of Posts
-	Timestamp int64
+	Summary   []byte // Merkle root of Posts, see MerkleRoot
+	Timestamp int64  // later than the median of previous blocks, and not too far in the future
+	Bits      uint32 // difficulty, a valid block hash has its first Bits bits be zero
 	Nonce     uint32 // miners find the correct Nonce when mining
 }
 
@@ -41,42 +58,17 @@ type Block struct {
 	Posts  []Post // all posts contained in this block
 }
 
-// Verify - verifies if this block is valid on its own. This does not consider other blocks in the same blockchain.
-func (b *Block) Verify() bool {
-	hash := Hash(b.Header)
-	zeroBytes := TARGET / 8
-	zeroBits := TARGET % 8
-	// the first zeroBytes bytes of hash must be zero
-	for i := 0; i < zeroBytes; i++ {
-		if hash[i] != 0 {
-			return false
-		}
-	}
-	// and then zeroBits bits of hash must be zero
-	if zeroBits > 0 {
-		nextByte := hash[zeroBytes]
-		nextByte = nextByte >> (8 - zeroBits)
-		if nextByte != 0 {
-			return false
-		}
-	}
-	// verify the summary
-	if !bytes.Equal(b.Header.Summary, Hash(b.Posts)) {
-		return false
-	}
-	// verify all posts
-	for _, post := range b.Posts {
-		if !post.Verify() {
-			return false
-		}
-	}
-	return true
+// Verify - verifies if this block is valid on its own for the network of params, see Validate for the reason when it
+// is not. This does not consider other blocks in the same blockchain, see Chain.Validate.
+func (b *Block) Verify(params *ChainParams) bool {
+	return b.Validate(params) == nil
 }
 
 // PostBase64 - base64-encoded Post to support marshalling to json.
 // It is the same as Post except all []byte are encoded as base64 strings.
 type PostBase64 struct {
 	User      string `json:"user"`
+	ChainID   string `json:"chain-id"`
 	Content   string `json:"content"`
 	Timestamp int64  `json:"timestamp"`
 	Signature string `json:"signature"`
@@ -86,6 +78,7 @@ type PostBase64 struct {
 func (p *Post) EncodeBase64() PostBase64 {
 	encoded := PostBase64{
 		User:      base64.StdEncoding.EncodeToString(PublicKeyToBytes(p.User)),
+		ChainID:   p.Body.ChainID,
 		Content:   p.Body.Content,
 		Timestamp: p.Body.Timestamp,
 		Signature: base64.StdEncoding.EncodeToString(p.Signature),
@@ -97,6 +90,7 @@ func (p *Post) EncodeBase64() PostBase64 {
 func (p *PostBase64) DecodeBase64() (Post, error) {
 	decoded := Post{
 		Body: PostBody{
+			ChainID:   p.ChainID,
 			Content:   p.Content,
 			Timestamp: p.Timestamp,
 		},
@@ -120,12 +114,56 @@ func (p *PostBase64) DecodeBase64() (Post, error) {
 	return decoded, nil
 }
 
+// BlockHeaderBase64 - base64-encoded BlockHeader to support marshalling to json.
+// It is the same as BlockHeader except all []byte are encoded as base64 strings.
+type BlockHeaderBase64 struct {
+	PrevHash  string `json:"prev-hash"`
+	Summary   string `json:"summary"`
+	Timestamp int64  `json:"timestamp"`
+	Bits      uint32 `json:"bits"`
+	Nonce     uint32 `json:"nonce"`
+}
+
+// EncodeBase64 - encode a BlockHeader to a BlockHeaderBase64.
+func (h *BlockHeader) EncodeBase64() BlockHeaderBase64 {
+	return BlockHeaderBase64{
+		PrevHash:  base64.StdEncoding.EncodeToString(h.PrevHash),
+		Summary:   base64.StdEncoding.EncodeToString(h.Summary),
+		Timestamp: h.Timestamp,
+		Bits:      h.Bits,
+		Nonce:     h.Nonce,
+	}
+}
+
+// DecodeBase64 - decode a BlockHeaderBase64 to a BlockHeader.
+func (h *BlockHeaderBase64) DecodeBase64() (BlockHeader, error) {
+	decoded := BlockHeader{
+		Timestamp: h.Timestamp,
+		Bits:      h.Bits,
+		Nonce:     h.Nonce,
+	}
+
+	bytes, err := base64.StdEncoding.DecodeString(h.PrevHash)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	decoded.PrevHash = bytes
+
+	bytes, err = base64.StdEncoding.DecodeString(h.Summary)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	decoded.Summary = bytes
+	return decoded, nil
+}
+
 // BlockBase64 - base64-encoded Block to support marshalling to json
 // It is the same as Block except all []byte are encoded as base64 strings.
 type BlockBase64 struct {
 	PrevHash  string       `json:"prev-hash"`
 	Summary   string       `json:"summary"`
 	Timestamp int64        `json:"timestamp"`
+	Bits      uint32       `json:"bits"`
 	NPosts    int          `json:"n-posts"`
 	Nonce     uint32       `json:"nonce"`
 	Posts     []PostBase64 `json:"posts"`
@@ -137,6 +175,7 @@ func (b *Block) EncodeBase64() BlockBase64 {
 		PrevHash:  base64.StdEncoding.EncodeToString(b.Header.PrevHash),
 		Summary:   base64.StdEncoding.EncodeToString(b.Header.Summary),
 		Timestamp: b.Header.Timestamp,
+		Bits:      b.Header.Bits,
 		Nonce:     b.Header.Nonce,
 	}
 	for _, post := range b.Posts {
@@ -150,6 +189,7 @@ func (b *BlockBase64) DecodeBase64() (Block, error) {
 	decoded := Block{
 		Header: BlockHeader{
 			Timestamp: b.Timestamp,
+			Bits:      b.Bits,
 			Nonce:     b.Nonce,
 		},
 	}
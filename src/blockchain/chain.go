@@ -0,0 +1,186 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons for a block or a blockchain to be invalid.
+var (
+	ErrBadPoW         = errors.New("block hash does not meet its difficulty")
+	ErrBadDifficulty  = errors.New("block difficulty does not match the blockchain")
+	ErrBadGenesis     = errors.New("first block is not the genesis block of this network")
+	ErrBrokenLink     = errors.New("block does not link to the previous block")
+	ErrDuplicatePost  = errors.New("post is duplicated on the blockchain")
+	ErrBadSummary     = errors.New("block summary does not match its posts")
+	ErrBadSignature   = errors.New("post signature is invalid")
+	ErrTimeTooOld     = errors.New("block timestamp is not later than the median of the previous blocks")
+	ErrTimeTooNew     = errors.New("block timestamp is too far in the future")
+	ErrTooManyPosts   = errors.New("block contains too many posts")
+	ErrBlockTooLarge  = errors.New("block posts are too large")
+	ErrContentTooLong = errors.New("post content is too long")
+	ErrPostTooLarge   = errors.New("post is too large for any block")
+	ErrWrongChain     = errors.New("post is signed for another network")
+)
+
+// ValidationError - The reason a blockchain is invalid, and the height of the first offending block.
+type ValidationError struct {
+	Height int   // index of the offending block in the blockchain
+	Err    error // one of the Err* reasons
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("block %d: %s", e.Height, e.Err.Error())
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate - validates this header on its own, and returns the reason if it is invalid.
+// Only the declared difficulty, the proof-of-work and the future drift are checked, which needs neither the posts of
+// the block nor the blocks before it.
+func (h *BlockHeader) Validate() error {
+	if h.Bits < MinBits || h.Bits > MaxBits {
+		return ErrBadDifficulty
+	}
+	if !CheckPoW(Hash(h), h.Bits) {
+		return ErrBadPoW
+	}
+	// the block must not be dated too far past the local time
+	if h.Timestamp > time.Now().UnixNano()+MaxFutureDrift {
+		return ErrTimeTooNew
+	}
+	return nil
+}
+
+// Validate - validates this block on its own for the network of params, and returns the reason if it is invalid.
+// This does not consider other blocks in the same blockchain, see Chain.Validate.
+func (b *Block) Validate(params *ChainParams) error {
+	// check the limits first, before hashing a large block
+	if err := b.checkLimits(params); err != nil {
+		return err
+	}
+	if err := b.Header.Validate(); err != nil {
+		return err
+	}
+	// verify the summary
+	if !bytes.Equal(b.Header.Summary, MerkleRoot(b.Posts)) {
+		return ErrBadSummary
+	}
+	// verify all posts
+	for _, post := range b.Posts {
+		if !post.Verify() {
+			return ErrBadSignature
+		}
+	}
+	return nil
+}
+
+// Chain - A blockchain, starting from the genesis block.
+type Chain []Block
+
+// Validate - validates the whole blockchain for the network of params. Returns nil if it is valid, or a
+// *ValidationError otherwise.
+// The first block must be the genesis block of params. Every other block must be valid on its own, link to the hash of
+// its previous block, be later than MedianTime of the blocks before it, and have the difficulty required by NextBits.
+// No post, identified by Post.ID, may appear twice.
+func (c Chain) Validate(params *ChainParams) error {
+	return c.ValidateFrom(params, 0)
+}
+
+// ValidateFrom - validates the blocks from height start on, like Validate, assuming that the blocks before start have
+// already been validated. This is much cheaper than Validate when only a few blocks are new.
+func (c Chain) ValidateFrom(params *ChainParams, start int) error {
+	postHeights := make(map[string]int)
+	for i := 0; i < min(start, len(c)); i++ {
+		for _, post := range c[i].Posts {
+			postHeights[string(post.ID())] = i
+		}
+	}
+	return c.ValidateIndexed(params, start, postHeights)
+}
+
+// ValidateIndexed - validates the blocks from height start on, like ValidateFrom, but looks the posts of the blocks
+// before start up in postHeights instead of hashing them again. postHeights maps the ID of every post on a blockchain
+// that c[:start] is a prefix of to the height of its block.
+func (c Chain) ValidateIndexed(params *ChainParams, start int, postHeights map[string]int) error {
+	if err := c.validateGenesis(params, start); err != nil {
+		return err
+	}
+	posts := make(map[string]struct{})
+	for i := max(start, 0); i < len(c); i++ {
+		block := &c[i]
+		if i >= 1 {
+			// each block must be valid
+			if err := block.Validate(params); err != nil {
+				return &ValidationError{Height: i, Err: err}
+			}
+			if err := c.validateLink(params, i); err != nil {
+				return err
+			}
+		}
+		// no duplicated posts
+		for _, post := range block.Posts {
+			key := string(post.ID())
+			if height, ok := postHeights[key]; ok && height < start {
+				return &ValidationError{Height: i, Err: ErrDuplicatePost}
+			}
+			if _, ok := posts[key]; ok {
+				return &ValidationError{Height: i, Err: ErrDuplicatePost}
+			}
+			posts[key] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// ValidateHeaders - validates only the headers of the blocks from height start on, assuming that the blocks before
+// start have already been validated. The posts of these blocks are not needed, so a node can check that a fork is
+// valid and has more work (see CompareChains) before it downloads the fork's posts. Blocks that pass must still be
+// checked with ValidateFrom once their posts are known.
+func (c Chain) ValidateHeaders(params *ChainParams, start int) error {
+	if err := c.validateGenesis(params, start); err != nil {
+		return err
+	}
+	for i := max(start, 1); i < len(c); i++ {
+		if err := c[i].Header.Validate(); err != nil {
+			return &ValidationError{Height: i, Err: err}
+		}
+		if err := c.validateLink(params, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateGenesis - checks that the blockchain starts with the genesis block of params, unless start is past it.
+func (c Chain) validateGenesis(params *ChainParams, start int) error {
+	if len(c) == 0 || start > 0 {
+		return nil
+	}
+	if !bytes.Equal(Hash(c[0].Header), Hash(params.Genesis.Header)) || len(c[0].Posts) != 0 {
+		return &ValidationError{Height: 0, Err: ErrBadGenesis}
+	}
+	return nil
+}
+
+// validateLink - checks the header of the block at height i against the blocks before it.
+func (c Chain) validateLink(params *ChainParams, i int) error {
+	header := &c[i].Header
+	// their hash value must form a chain
+	if !bytes.Equal(header.PrevHash, Hash(c[i-1].Header)) {
+		return &ValidationError{Height: i, Err: ErrBrokenLink}
+	}
+	// each block must be later than the median of the blocks before it
+	if header.Timestamp <= MedianTime(c[:i]) {
+		return &ValidationError{Height: i, Err: ErrTimeTooOld}
+	}
+	// each block must have the difficulty required by the blocks before it
+	if header.Bits != params.NextBits(c[:i]) {
+		return &ValidationError{Height: i, Err: ErrBadDifficulty}
+	}
+	return nil
+}
@@ -1,73 +1,79 @@
 package blockchain
 
 import (
-	"bytes"
-	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/binary"
-	"encoding/gob"
 	"errors"
-	"math/big"
+	"fmt"
 )
 
-// Hash - Hash any object to []byte with sha256 (256 bits).
+// Hash - Hash an object to []byte with sha256 (256 bits).
+// The object is serialized with the canonical encoding, see Encode for the supported types.
 func Hash(object any) []byte {
 	// first serialize object to bytes
-	gob.Register(object)
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(object)
-	if err != nil {
-		panic(err)
-	}
+	buffer := Encode(object)
 	// next use SHA256 to hash the bytes
-	hash := sha256.Sum256(buffer.Bytes())
+	hash := sha256.Sum256(buffer)
 	return hash[:]
 }
 
-// GenerateKey - Generate a new rsa key pair.
-func GenerateKey() *rsa.PrivateKey {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
+// GenerateKey - Generate a new key pair for the given signature scheme.
+func GenerateKey(algorithm Algorithm) Signer {
+	switch algorithm {
+	case RSA:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		return RSASigner{Key: privateKey}
+	case Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		return Ed25519Signer{Key: privateKey}
+	default:
+		panic(fmt.Sprintf("blockchain: unknown signature algorithm %#x", byte(algorithm)))
 	}
-	return privateKey
 }
 
-// PublicKeyToBytes - Serialize a public key to []byte.
-func PublicKeyToBytes(publicKey *rsa.PublicKey) []byte {
-	buffer := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buffer, uint32(publicKey.E))
-	buffer = append(buffer, publicKey.N.Bytes()...)
-	return buffer
+// PublicKeyToBytes - Serialize a public key to []byte, as its algorithm tag followed by the key.
+func PublicKeyToBytes(publicKey PublicKey) []byte {
+	buffer := []byte{byte(publicKey.Algorithm())}
+	return append(buffer, publicKey.Bytes()...)
 }
 
 // PublicKeyFromBytes - De-serialize []byte to a public key.
-func PublicKeyFromBytes(buffer []byte) (*rsa.PublicKey, error) {
-	if len(buffer) <= 4 {
+// Untagged RSA keys, which start with an odd byte, are still accepted.
+func PublicKeyFromBytes(buffer []byte) (PublicKey, error) {
+	if len(buffer) == 0 {
 		return nil, errors.New("input bytes are not long enough")
 	}
-	E := int(binary.LittleEndian.Uint32(buffer[:4]))
-	N := new(big.Int)
-	N.SetBytes(buffer[4:])
-	return &rsa.PublicKey{N: N, E: E}, nil
+	if buffer[0]%2 == 1 {
+		// untagged RSA key
+		return rsaPublicKeyFromBytes(buffer)
+	}
+	switch Algorithm(buffer[0]) {
+	case RSA:
+		return rsaPublicKeyFromBytes(buffer[1:])
+	case Ed25519:
+		return ed25519PublicKeyFromBytes(buffer[1:])
+	default:
+		return nil, fmt.Errorf("unknown signature algorithm %#x", buffer[0])
+	}
 }
 
-// Sign - Sign an arbitrary object with a private key.
-func Sign(privateKey *rsa.PrivateKey, object any) []byte {
-	hash := Hash(object)
-	signature, err := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA256, hash)
-	if err != nil {
-		panic(err)
-	}
-	return signature
+// Sign - Sign an object with a private key. The signature covers the hash of the object's canonical encoding.
+func Sign(signer Signer, object any) []byte {
+	return signer.SignHash(Hash(object))
 }
 
 // Verify - Checks whether the signature is produced by signing object with the public key's private key.
-func Verify(publicKey *rsa.PublicKey, object any, signature []byte) bool {
-	hash := Hash(object)
-	err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash, signature)
-	return err == nil
+func Verify(publicKey PublicKey, object any, signature []byte) bool {
+	if publicKey == nil {
+		return false
+	}
+	return publicKey.VerifyHash(Hash(object), signature)
 }
@@ -0,0 +1,66 @@
+package blockchain
+
+// MinBits - The lowest difficulty a block may declare.
+const MinBits = 1
+
+// MaxBits - The highest difficulty a block may declare (the length of a hash in bits).
+const MaxBits = 256
+
+// CheckPoW - checks whether the first bits bits of hash are zero.
+func CheckPoW(hash []byte, bits uint32) bool {
+	if bits > uint32(len(hash))*8 {
+		return false
+	}
+	zeroBytes := bits / 8
+	zeroBits := bits % 8
+	// the first zeroBytes bytes of hash must be zero
+	for i := uint32(0); i < zeroBytes; i++ {
+		if hash[i] != 0 {
+			return false
+		}
+	}
+	// and then zeroBits bits of hash must be zero
+	if zeroBits > 0 {
+		nextByte := hash[zeroBytes]
+		nextByte = nextByte >> (8 - zeroBits)
+		if nextByte != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NextBits - computes the difficulty required for the block appended after chain, which starts with the genesis block.
+// Heights are counted from the first block after the genesis block. The first RetargetInterval blocks use
+// InitialBits. After that, every block inherits its parent's difficulty, except at heights that are multiples of
+// RetargetInterval. There the time span of the previous RetargetInterval blocks is compared to the span expected from
+// TargetBlockInterval: the difficulty goes up one bit for every halving of the expected span, and down one bit for
+// every doubling, by at most MaxRetargetStep bits.
+func (p *ChainParams) NextBits(chain []Block) uint32 {
+	height := len(chain) - 1
+	if height < p.RetargetInterval {
+		return p.InitialBits
+	}
+	bits := chain[len(chain)-1].Header.Bits
+	if height%p.RetargetInterval != 0 {
+		return bits
+	}
+	first := chain[len(chain)-p.RetargetInterval].Header.Timestamp
+	last := chain[len(chain)-1].Header.Timestamp
+	span := last - first
+	expected := int64(p.RetargetInterval-1) * p.TargetBlockInterval
+	for step := 0; step < p.MaxRetargetStep; step++ {
+		if span*2 <= expected && bits < MaxBits {
+			// blocks come in too fast
+			bits++
+			span *= 2
+		} else if span >= expected*2 && bits > MinBits {
+			// blocks come in too slow
+			bits--
+			span /= 2
+		} else {
+			break
+		}
+	}
+	return bits
+}
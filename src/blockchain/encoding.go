@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EncodingVersion - Version of the canonical encoding. It is the first byte of every encoded object.
+//
+// The canonical encoding is a language-independent byte representation of the objects that are hashed or signed.
+// All integers are big-endian and fixed-width. A byte string (or a string) is written as its length in a uint32,
+// followed by the raw bytes. Every top-level object starts with EncodingVersion and a one-byte type tag, and nested
+// objects are written without these two bytes. The layout of each type is:
+//
+//	PostBody:    TagPostBody    | ChainID (bytes) | Content (bytes) | Timestamp (int64)
+//	Post:        TagPost        | User (bytes) | Signature (bytes) | PostBody
+//	BlockHeader: TagBlockHeader | PrevHash (bytes) | Summary (bytes) | Timestamp (int64) | Bits (uint32) |
+//	             Nonce (uint32)
+//	[]Post:      TagPosts       | count (uint32) | Post ... Post
+//
+// where User is the output of PublicKeyToBytes.
+const EncodingVersion byte = 1
+
+// Type tags of the canonical encoding.
+const (
+	TagPostBody    byte = 1
+	TagPost        byte = 2
+	TagBlockHeader byte = 3
+	TagPosts       byte = 4
+)
+
+// Encode - Encode an object with the canonical encoding.
+// object must be one of PostBody, Post, BlockHeader or []Post (or a pointer to one of them); any other type panics.
+func Encode(object any) []byte {
+	switch o := object.(type) {
+	case PostBody:
+		return appendPostBody(header(TagPostBody), &o)
+	case *PostBody:
+		return appendPostBody(header(TagPostBody), o)
+	case Post:
+		return appendPost(header(TagPost), &o)
+	case *Post:
+		return appendPost(header(TagPost), o)
+	case BlockHeader:
+		return appendBlockHeader(header(TagBlockHeader), &o)
+	case *BlockHeader:
+		return appendBlockHeader(header(TagBlockHeader), o)
+	case []Post:
+		return appendPosts(header(TagPosts), o)
+	case *[]Post:
+		return appendPosts(header(TagPosts), *o)
+	default:
+		panic(fmt.Sprintf("blockchain: cannot encode object of type %T", object))
+	}
+}
+
+// header - Start a top-level encoding with the version and the type tag.
+func header(tag byte) []byte {
+	return []byte{EncodingVersion, tag}
+}
+
+// appendBytes - Append a length-prefixed byte string.
+func appendBytes(buffer []byte, bytes []byte) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(bytes)))
+	return append(buffer, bytes...)
+}
+
+// appendPostBody - Append the fields of a PostBody.
+func appendPostBody(buffer []byte, body *PostBody) []byte {
+	buffer = appendBytes(buffer, []byte(body.ChainID))
+	buffer = appendBytes(buffer, []byte(body.Content))
+	return binary.BigEndian.AppendUint64(buffer, uint64(body.Timestamp))
+}
+
+// appendPost - Append the fields of a Post.
+func appendPost(buffer []byte, post *Post) []byte {
+	var user []byte
+	if post.User != nil {
+		user = PublicKeyToBytes(post.User)
+	}
+	buffer = appendBytes(buffer, user)
+	buffer = appendBytes(buffer, post.Signature)
+	return appendPostBody(buffer, &post.Body)
+}
+
+// appendBlockHeader - Append the fields of a BlockHeader.
+func appendBlockHeader(buffer []byte, header *BlockHeader) []byte {
+	buffer = appendBytes(buffer, header.PrevHash)
+	buffer = appendBytes(buffer, header.Summary)
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(header.Timestamp))
+	buffer = binary.BigEndian.AppendUint32(buffer, header.Bits)
+	return binary.BigEndian.AppendUint32(buffer, header.Nonce)
+}
+
+// appendPosts - Append a list of posts.
+func appendPosts(buffer []byte, posts []Post) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(posts)))
+	for i := range posts {
+		buffer = appendPost(buffer, &posts[i])
+	}
+	return buffer
+}
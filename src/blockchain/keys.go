@@ -0,0 +1,200 @@
+package blockchain
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Algorithm - A signature scheme. Its value is the tag byte that starts an encoded public key.
+// All tags are even: untagged RSA keys written before tags existed start with the lowest byte of their public
+// exponent, which is always odd, so the two formats never collide.
+type Algorithm byte
+
+const (
+	RSA     Algorithm = 0x10 // RSA-2048, PKCS#1 v1.5 signatures over the sha256 hash
+	Ed25519 Algorithm = 0x20 // Ed25519 signatures over the sha256 hash
+)
+
+// PublicKey - A user's public key under some signature scheme.
+type PublicKey interface {
+	Algorithm() Algorithm                          // the signature scheme of this key
+	Bytes() []byte                                 // the key encoded without its algorithm tag
+	VerifyHash(hash []byte, signature []byte) bool // checks a signature over hash
+}
+
+// Signer - A user's private key under some signature scheme.
+type Signer interface {
+	Public() PublicKey           // the matching public key
+	SignHash(hash []byte) []byte // signs hash
+}
+
+// RSAPublicKey - PublicKey for the RSA scheme.
+// It is encoded as the public exponent in a little-endian uint32, followed by the big-endian modulus.
+type RSAPublicKey struct {
+	Key *rsa.PublicKey
+}
+
+func (k RSAPublicKey) Algorithm() Algorithm {
+	return RSA
+}
+
+func (k RSAPublicKey) Bytes() []byte {
+	buffer := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buffer, uint32(k.Key.E))
+	buffer = append(buffer, k.Key.N.Bytes()...)
+	return buffer
+}
+
+func (k RSAPublicKey) VerifyHash(hash []byte, signature []byte) bool {
+	err := rsa.VerifyPKCS1v15(k.Key, crypto.SHA256, hash, signature)
+	return err == nil
+}
+
+// checkRSAKey - Only 2048-bit moduli and odd exponents 3 <= e < 2^31 are accepted, however the key is encoded, so that
+// a peer cannot make others verify signatures under huge or degenerate keys.
+func checkRSAKey(key *rsa.PublicKey) error {
+	if key.E < 3 || key.E >= 1<<31 || key.E%2 == 0 {
+		return fmt.Errorf("rsa public exponent %d is not an odd number between 3 and 2^31", key.E)
+	}
+	if key.N.BitLen() != 2048 {
+		return fmt.Errorf("rsa keys must have 2048 bits, not %d", key.N.BitLen())
+	}
+	return nil
+}
+
+// rsaPublicKeyFromBytes - De-serialize the output of RSAPublicKey.Bytes, see checkRSAKey.
+func rsaPublicKeyFromBytes(buffer []byte) (RSAPublicKey, error) {
+	if len(buffer) <= 4 {
+		return RSAPublicKey{}, errors.New("input bytes are not long enough")
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(buffer[4:]), E: int(binary.LittleEndian.Uint32(buffer[:4]))}
+	if err := checkRSAKey(key); err != nil {
+		return RSAPublicKey{}, err
+	}
+	return RSAPublicKey{Key: key}, nil
+}
+
+// RSASigner - Signer for the RSA scheme.
+type RSASigner struct {
+	Key *rsa.PrivateKey
+}
+
+func (s RSASigner) Public() PublicKey {
+	return RSAPublicKey{Key: &s.Key.PublicKey}
+}
+
+func (s RSASigner) SignHash(hash []byte) []byte {
+	signature, err := rsa.SignPKCS1v15(nil, s.Key, crypto.SHA256, hash)
+	if err != nil {
+		panic(err)
+	}
+	return signature
+}
+
+// Ed25519PublicKey - PublicKey for the Ed25519 scheme. It is encoded as the standard 32-byte public key.
+type Ed25519PublicKey struct {
+	Key ed25519.PublicKey
+}
+
+func (k Ed25519PublicKey) Algorithm() Algorithm {
+	return Ed25519
+}
+
+func (k Ed25519PublicKey) Bytes() []byte {
+	return append([]byte{}, k.Key...)
+}
+
+func (k Ed25519PublicKey) VerifyHash(hash []byte, signature []byte) bool {
+	return ed25519.Verify(k.Key, hash, signature)
+}
+
+// ed25519PublicKeyFromBytes - De-serialize the output of Ed25519PublicKey.Bytes.
+func ed25519PublicKeyFromBytes(buffer []byte) (Ed25519PublicKey, error) {
+	if len(buffer) != ed25519.PublicKeySize {
+		return Ed25519PublicKey{}, errors.New("input bytes have wrong length for an ed25519 key")
+	}
+	return Ed25519PublicKey{Key: append(ed25519.PublicKey{}, buffer...)}, nil
+}
+
+// Ed25519Signer - Signer for the Ed25519 scheme.
+type Ed25519Signer struct {
+	Key ed25519.PrivateKey
+}
+
+func (s Ed25519Signer) Public() PublicKey {
+	return Ed25519PublicKey{Key: s.Key.Public().(ed25519.PublicKey)}
+}
+
+func (s Ed25519Signer) SignHash(hash []byte) []byte {
+	return ed25519.Sign(s.Key, hash)
+}
+
+// MarshalPrivateKey - Serialize a private key to PKCS#8 DER, the standard encoding of private keys of any scheme.
+func MarshalPrivateKey(signer Signer) ([]byte, error) {
+	switch s := signer.(type) {
+	case RSASigner:
+		return x509.MarshalPKCS8PrivateKey(s.Key)
+	case Ed25519Signer:
+		return x509.MarshalPKCS8PrivateKey(s.Key)
+	default:
+		return nil, fmt.Errorf("unknown signature algorithm %#x", byte(signer.Public().Algorithm()))
+	}
+}
+
+// ParsePrivateKey - De-serialize the output of MarshalPrivateKey. Keys of other schemes are rejected, and so are RSA
+// keys that checkRSAKey rejects.
+func ParsePrivateKey(der []byte) (Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if err := checkRSAKey(&k.PublicKey); err != nil {
+			return nil, err
+		}
+		return RSASigner{Key: k}, nil
+	case ed25519.PrivateKey:
+		return Ed25519Signer{Key: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// MarshalPublicKey - Serialize a public key to PKIX DER, the standard encoding of public keys of any scheme.
+func MarshalPublicKey(publicKey PublicKey) ([]byte, error) {
+	switch k := publicKey.(type) {
+	case RSAPublicKey:
+		return x509.MarshalPKIXPublicKey(k.Key)
+	case Ed25519PublicKey:
+		return x509.MarshalPKIXPublicKey(k.Key)
+	default:
+		return nil, fmt.Errorf("unknown signature algorithm %#x", byte(publicKey.Algorithm()))
+	}
+}
+
+// ParsePublicKey - De-serialize the output of MarshalPublicKey. Keys of other schemes are rejected, and so are RSA keys
+// that checkRSAKey rejects.
+func ParsePublicKey(der []byte) (PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if err := checkRSAKey(k); err != nil {
+			return nil, err
+		}
+		return RSAPublicKey{Key: k}, nil
+	case ed25519.PublicKey:
+		return Ed25519PublicKey{Key: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
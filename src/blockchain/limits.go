@@ -0,0 +1,52 @@
+package blockchain
+
+import "fmt"
+
+// BlockSize - the size of a block with posts, measured as the length of the canonical encoding of posts.
+func BlockSize(posts []Post) int {
+	return len(Encode(posts))
+}
+
+// Validate - validates this post for the network of params, and returns the reason if it is invalid.
+// The post must be signed for the network's chain ID, respect MaxContentLength, fit in a block of MaxBlockBytes on its
+// own, and its signature must match its public key and body.
+func (p *Post) Validate(params *ChainParams) error {
+	if err := p.checkLimits(params); err != nil {
+		return err
+	}
+	if !p.Verify() {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// checkLimits - checks that a block respects MaxPostsPerBlock, MaxBlockBytes and the limits of its posts.
+func (b *Block) checkLimits(params *ChainParams) error {
+	if len(b.Posts) > params.MaxPostsPerBlock {
+		return fmt.Errorf("%w: %d posts, at most %d", ErrTooManyPosts, len(b.Posts), params.MaxPostsPerBlock)
+	}
+	if size := BlockSize(b.Posts); size > params.MaxBlockBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrBlockTooLarge, size, params.MaxBlockBytes)
+	}
+	for i := range b.Posts {
+		if err := b.Posts[i].checkLimits(params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLimits - checks that a post is signed for the network's chain ID, respects MaxContentLength and fits in a block
+// of MaxBlockBytes on its own.
+func (p *Post) checkLimits(params *ChainParams) error {
+	if p.Body.ChainID != params.ChainID {
+		return fmt.Errorf("%w: %q, expected %q", ErrWrongChain, p.Body.ChainID, params.ChainID)
+	}
+	if len(p.Body.Content) > params.MaxContentLength {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrContentTooLong, len(p.Body.Content), params.MaxContentLength)
+	}
+	if size := BlockSize([]Post{*p}); size > params.MaxBlockBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrPostTooLarge, size, params.MaxBlockBytes)
+	}
+	return nil
+}
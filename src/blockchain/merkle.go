@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// MerkleProof - Proof that a post is included in a block, checked against the block's Summary only.
+// The leaves of the Merkle tree are the IDs of the posts in a block, in order. Each internal node is the sha256
+// of the byte 0x01 followed by its left and right children. A node without a sibling is promoted to the next level
+// unchanged. The root of a tree without leaves is the sha256 of no bytes.
+type MerkleProof struct {
+	Index    int      // index of the post in the block
+	NLeaves  int      // number of posts in the block
+	Siblings [][]byte // hashes of the siblings on the path from the leaf to the root, from bottom to top
+}
+
+// merkleNode - Hash two children to their parent node.
+func merkleNode(left []byte, right []byte) []byte {
+	buffer := make([]byte, 0, 1+len(left)+len(right))
+	buffer = append(buffer, 1)
+	buffer = append(buffer, left...)
+	buffer = append(buffer, right...)
+	hash := sha256.Sum256(buffer)
+	return hash[:]
+}
+
+// merkleLeaves - Hash all posts to the leaves of a Merkle tree.
+func merkleLeaves(posts []Post) [][]byte {
+	leaves := make([][]byte, 0, len(posts))
+	for i := range posts {
+		leaves = append(leaves, posts[i].ID())
+	}
+	return leaves
+}
+
+// merkleLevel - Compute the next level of a Merkle tree.
+func merkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		} else {
+			next = append(next, level[i])
+		}
+	}
+	return next
+}
+
+// MerkleRoot - Compute the Merkle root of posts, used as the Summary of a block.
+func MerkleRoot(posts []Post) []byte {
+	if len(posts) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+	level := merkleLeaves(posts)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+// NewMerkleProof - Build the proof that posts[index] is included in a block with posts.
+func NewMerkleProof(posts []Post, index int) (MerkleProof, error) {
+	if index < 0 || index >= len(posts) {
+		return MerkleProof{}, errors.New("post index out of range")
+	}
+	proof := MerkleProof{Index: index, NLeaves: len(posts)}
+	level := merkleLeaves(posts)
+	for i := index; len(level) > 1; i /= 2 {
+		if i%2 == 1 {
+			proof.Siblings = append(proof.Siblings, level[i-1])
+		} else if i+1 < len(level) {
+			proof.Siblings = append(proof.Siblings, level[i+1])
+		}
+		level = merkleLevel(level)
+	}
+	return proof, nil
+}
+
+// Verify - Checks whether the proof shows that post is included in a block whose Summary is root.
+func (p *MerkleProof) Verify(post Post, root []byte) bool {
+	if p.Index < 0 || p.Index >= p.NLeaves {
+		return false
+	}
+	hash := post.ID()
+	used := 0
+	for i, n := p.Index, p.NLeaves; n > 1; i, n = i/2, (n+1)/2 {
+		if i%2 == 0 && i+1 >= n {
+			// no sibling, promoted unchanged
+			continue
+		}
+		if used >= len(p.Siblings) {
+			return false
+		}
+		if i%2 == 1 {
+			hash = merkleNode(p.Siblings[used], hash)
+		} else {
+			hash = merkleNode(hash, p.Siblings[used])
+		}
+		used++
+	}
+	return used == len(p.Siblings) && bytes.Equal(hash, root)
+}
+
+// MerkleProofBase64 - base64-encoded MerkleProof to support marshalling to json.
+// It is the same as MerkleProof except all []byte are encoded as base64 strings.
+type MerkleProofBase64 struct {
+	Index    int      `json:"index"`
+	NLeaves  int      `json:"n-leaves"`
+	Siblings []string `json:"siblings"`
+}
+
+// EncodeBase64 - encode a MerkleProof to a MerkleProofBase64.
+func (p *MerkleProof) EncodeBase64() MerkleProofBase64 {
+	encoded := MerkleProofBase64{
+		Index:    p.Index,
+		NLeaves:  p.NLeaves,
+		Siblings: make([]string, 0, len(p.Siblings)),
+	}
+	for _, sibling := range p.Siblings {
+		encoded.Siblings = append(encoded.Siblings, base64.StdEncoding.EncodeToString(sibling))
+	}
+	return encoded
+}
+
+// DecodeBase64 - decode a MerkleProofBase64 to a MerkleProof.
+func (p *MerkleProofBase64) DecodeBase64() (MerkleProof, error) {
+	decoded := MerkleProof{
+		Index:   p.Index,
+		NLeaves: p.NLeaves,
+	}
+	for _, sibling := range p.Siblings {
+		bytes, err := base64.StdEncoding.DecodeString(sibling)
+		if err != nil {
+			return MerkleProof{}, err
+		}
+		decoded.Siblings = append(decoded.Siblings, bytes)
+	}
+	return decoded, nil
+}
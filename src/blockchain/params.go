@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// DefaultChainID - Chain ID of the main network.
+const DefaultChainID = "main"
+
+// ChainParams - Consensus parameters of one network. Nodes with different ChainParams do not accept each other's
+// posts or blocks, so several networks can run side by side.
+type ChainParams struct {
+	ChainID string // signed into every post, see PostBody
+	Genesis Block  // the first block of every blockchain on this network, see NewGenesis
+
+	InitialBits         uint32 // difficulty of the first blocks, before any retargeting
+	RetargetInterval    int    // difficulty is recomputed every RetargetInterval blocks
+	TargetBlockInterval int64  // retargeting aims to produce one block every TargetBlockInterval nanoseconds
+	MaxRetargetStep     int    // a single retarget changes the difficulty by at most MaxRetargetStep bits
+
+	MaxPostsPerBlock int // a valid block contains at most MaxPostsPerBlock posts
+	MaxBlockBytes    int // the canonical encoding of a valid block's posts is at most MaxBlockBytes bytes
+	MaxContentLength int // the content of a valid post is at most MaxContentLength bytes
+}
+
+// NewChainParams - creates the default consensus parameters for the network identified by chainID.
+func NewChainParams(chainID string) *ChainParams {
+	params := &ChainParams{
+		ChainID:             chainID,
+		InitialBits:         20,
+		RetargetInterval:    10,
+		TargetBlockInterval: 1e9,
+		MaxRetargetStep:     2,
+		MaxPostsPerBlock:    64,
+		MaxBlockBytes:       128 * 1024,
+		MaxContentLength:    4096,
+	}
+	params.Genesis = NewGenesis(chainID, params.InitialBits)
+	return params
+}
+
+// Validate - checks that the parameters can run a network: that the limits and the retargeting settings are positive,
+// and that InitialBits is a difficulty that a block may declare.
+func (p *ChainParams) Validate() error {
+	if p.RetargetInterval <= 0 || p.TargetBlockInterval <= 0 || p.MaxRetargetStep <= 0 {
+		return errors.New("RetargetInterval, TargetBlockInterval and MaxRetargetStep must be positive")
+	}
+	if p.MaxPostsPerBlock <= 0 || p.MaxBlockBytes <= 0 || p.MaxContentLength <= 0 {
+		return errors.New("MaxPostsPerBlock, MaxBlockBytes and MaxContentLength must be positive")
+	}
+	if p.InitialBits < MinBits || p.InitialBits > MaxBits {
+		return fmt.Errorf("InitialBits must be from %d to %d", MinBits, MaxBits)
+	}
+	return nil
+}
+
+// DefaultChainParams - creates the consensus parameters of the main network.
+func DefaultChainParams() *ChainParams {
+	return NewChainParams(DefaultChainID)
+}
+
+// NewGenesis - creates the genesis block of the network identified by chainID.
+// The genesis block has no posts and no proof-of-work. Its PrevHash is the sha256 of the chain ID, so every network
+// has a different genesis block.
+func NewGenesis(chainID string, bits uint32) Block {
+	prevHash := sha256.Sum256([]byte(chainID))
+	return Block{
+		Header: BlockHeader{
+			PrevHash: prevHash[:],
+			Summary:  MerkleRoot(nil),
+			Bits:     bits,
+		},
+	}
+}
@@ -0,0 +1,29 @@
+package blockchain
+
+import (
+	"math"
+	"slices"
+)
+
+// MedianTimeBlocks - A block's timestamp must be later than the median timestamp of the previous MedianTimeBlocks
+// blocks.
+const MedianTimeBlocks = 11
+
+// MaxFutureDrift - A block's timestamp must be at most MaxFutureDrift nanoseconds past the local time.
+const MaxFutureDrift int64 = 10e9
+
+// MedianTime - the median timestamp of the last MedianTimeBlocks blocks of chain (or all of them, if the chain is
+// shorter). A block appended after chain must have a timestamp later than this. Returns math.MinInt64 for an empty
+// chain, so that the first block can have any timestamp.
+func MedianTime(chain []Block) int64 {
+	if len(chain) == 0 {
+		return math.MinInt64
+	}
+	start := max(len(chain)-MedianTimeBlocks, 0)
+	timestamps := make([]int64, 0, len(chain)-start)
+	for i := start; i < len(chain); i++ {
+		timestamps = append(timestamps, chain[i].Header.Timestamp)
+	}
+	slices.Sort(timestamps)
+	return timestamps[len(timestamps)/2]
+}
@@ -0,0 +1,42 @@
+package blockchain
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// Work - the expected number of hashes needed to mine this header.
+// A header with difficulty Bits has a hash target of 2^(256-Bits), so its work is 2^256 / 2^(256-Bits) = 2^Bits.
+// A header declaring an invalid difficulty has no work.
+func (h *BlockHeader) Work() *big.Int {
+	if h.Bits < MinBits || h.Bits > MaxBits {
+		return new(big.Int)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(h.Bits))
+}
+
+// ChainWork - the total proof-of-work accumulated by a chain.
+func ChainWork(chain []Block) *big.Int {
+	work := new(big.Int)
+	for i := range chain {
+		work.Add(work, chain[i].Header.Work())
+	}
+	return work
+}
+
+// CompareChains - the fork choice rule shared by miners and users.
+// Returns 1 if chain a is preferred over chain b, -1 if b is preferred over a, and 0 if they have the same tip.
+// The chain with more accumulated work is preferred. Between chains of equal work, the one whose tip has the smaller
+// hash is preferred, so that every node picks the same chain regardless of the order it receives them.
+func CompareChains(a, b []Block) int {
+	if cmp := ChainWork(a).Cmp(ChainWork(b)); cmp != 0 {
+		return cmp
+	}
+	if len(a) == 0 || len(b) == 0 {
+		// equal work and one of them is empty, so both are empty
+		return 0
+	}
+	tipA := Hash(a[len(a)-1].Header)
+	tipB := Hash(b[len(b)-1].Header)
+	return bytes.Compare(tipB, tipA)
+}
@@ -0,0 +1,179 @@
+// Command devnet runs a local network of a tracker and several miners in one process, on free ports of localhost, and
+// takes commands to change the network from stdin until it receives quit, SIGINT or SIGTERM.
+//
+// Usage:
+//
+//	devnet [-miners 3] [-chain devnet] [-bits 12] [-log quiet]
+//
+// The network starts at a low difficulty, so that blocks come quickly on any laptop until the difficulty is retargeted
+// to one block per second. Type help for the commands.
+package main
+
+import (
+	"blockchain/blockchain"
+	"blockchain/cmd/internal/cli"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// help - Commands of the devnet.
+const help = `commands:
+  nodes                  print the endpoints of the tracker and all miners
+  add [n]                start n more miners, 1 by default
+  kill <port>            shut down a miner
+  partition <port>...    split the listed miners from all others
+  heal                   undo the partition
+  post <content>         write a post
+  tips                   print the tip of every miner's blockchain
+  quit                   shut down the network and exit`
+
+func main() {
+	miners := flag.Int("miners", 3, "number of miners to start with")
+	chainID := flag.String("chain", "devnet", "chain ID of the network")
+	bits := flag.Uint("bits", 12, "difficulty of the first blocks")
+	logLevel := flag.String("log", "quiet", fmt.Sprintf("log level, one of %v", cli.LogLevels))
+	flag.Parse()
+	if err := cli.SetLogLevel(*logLevel); err != nil {
+		cli.Fatal(err)
+	}
+	if *bits > blockchain.MaxBits {
+		cli.Fatal(fmt.Errorf("bits must be from %d to %d", blockchain.MinBits, blockchain.MaxBits))
+	}
+	params := blockchain.NewChainParams(*chainID)
+	params.InitialBits = uint32(*bits)
+	params.Genesis = blockchain.NewGenesis(*chainID, params.InitialBits)
+	if err := params.Validate(); err != nil {
+		cli.Fatal(err)
+	}
+
+	network, err := StartNetwork(params)
+	if err != nil {
+		cli.Fatal(err)
+	}
+	defer network.Shutdown()
+	for i := 0; i < *miners; i++ {
+		if _, err := network.AddMiner(); err != nil {
+			cli.Fatal(err)
+		}
+	}
+	printNodes(network)
+	fmt.Println(help)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	signals := cli.NotifySignals()
+	for {
+		fmt.Print("> ")
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if fields[0] == "quit" || fields[0] == "exit" {
+				return
+			}
+			if err := run(network, fields[0], fields[1:]); err != nil {
+				fmt.Println("error:", err.Error())
+			}
+		case sig := <-signals:
+			fmt.Printf("\nreceived %s, shutting down\n", sig)
+			return
+		}
+	}
+}
+
+// run - runs one command.
+func run(network *Network, command string, args []string) error {
+	switch command {
+	case "help":
+		fmt.Println(help)
+	case "nodes":
+		printNodes(network)
+	case "add":
+		count := 1
+		if len(args) > 0 {
+			var err error
+			if count, err = strconv.Atoi(args[0]); err != nil || count <= 0 {
+				return errors.New("add needs a positive number of miners")
+			}
+		}
+		for i := 0; i < count; i++ {
+			port, err := network.AddMiner()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("miner    http://localhost:%d\n", port)
+		}
+	case "kill":
+		ports, err := parsePorts(args)
+		if err != nil || len(ports) != 1 {
+			return errors.New("kill needs the port of a miner")
+		}
+		return network.KillMiner(ports[0])
+	case "partition":
+		ports, err := parsePorts(args)
+		if err != nil || len(ports) == 0 {
+			return errors.New("partition needs the ports of some miners")
+		}
+		return network.Partition(ports)
+	case "heal":
+		network.Heal()
+	case "post":
+		if len(args) == 0 {
+			return errors.New("post needs the content of the post")
+		}
+		id, err := network.Post(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		fmt.Println("posted", id)
+	case "tips":
+		for _, port := range network.Ports() {
+			tip, err := network.Tip(port)
+			if err != nil {
+				fmt.Printf("%d  error: %s\n", port, err.Error())
+				continue
+			}
+			fmt.Printf("%d  height %d  tip %s\n", port, tip.Height, tip.Hash)
+		}
+	default:
+		return fmt.Errorf("unknown command %q, type help for the commands", command)
+	}
+	return nil
+}
+
+// parsePorts - parses each argument as a port.
+func parsePorts(args []string) ([]int, error) {
+	ports := make([]int, 0, len(args))
+	for _, arg := range args {
+		port, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// printNodes - prints the endpoints of the tracker and all miners.
+func printNodes(network *Network) {
+	fmt.Printf("tracker  http://localhost:%d\n", network.trackerPort)
+	for _, port := range network.Ports() {
+		fmt.Printf("miner    http://localhost:%d\n", port)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"blockchain/blockchain"
+	"blockchain/miner"
+	"blockchain/peer"
+	"blockchain/tracker"
+	"blockchain/user"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// StartupDelay - Time for a new node's http server to come up.
+const StartupDelay = 200 * time.Millisecond
+
+// Network - A tracker and its miners, all running in this process on free ports of localhost.
+type Network struct {
+	params      *blockchain.ChainParams // consensus parameters of every node
+	tracker     *tracker.Tracker
+	trackerPort int
+	miners      map[int]*miner.Miner // maps each running miner's port to the miner
+	user        *user.User           // posts and reads on behalf of the devnet
+}
+
+// freePort - asks the system for a port of localhost that is not in use right now.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// StartNetwork - starts a tracker on a free port, with no miners yet.
+func StartNetwork(params *blockchain.ChainParams) (*Network, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	u, err := user.NewUserWithParams(params, port)
+	if err != nil {
+		return nil, err
+	}
+	config := tracker.DefaultConfig()
+	config.Port = port
+	t, err := tracker.NewTrackerWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	t.Start()
+	time.Sleep(StartupDelay)
+	return &Network{
+		params:      params,
+		tracker:     t,
+		trackerPort: port,
+		miners:      make(map[int]*miner.Miner),
+		user:        u,
+	}, nil
+}
+
+// AddMiner - starts a new miner on a free port, and returns the port.
+func (n *Network) AddMiner() (int, error) {
+	port, err := freePort()
+	if err != nil {
+		return 0, err
+	}
+	m, err := miner.NewMinerWithParams(port, n.params, n.trackerPort)
+	if err != nil {
+		return 0, err
+	}
+	m.Start()
+	n.miners[port] = m
+	time.Sleep(StartupDelay)
+	return port, nil
+}
+
+// KillMiner - shuts down the miner on port. The tracker forgets it once its entry expires.
+func (n *Network) KillMiner(port int) error {
+	m, ok := n.miners[port]
+	if !ok {
+		return fmt.Errorf("no miner on port %d", port)
+	}
+	m.Shutdown()
+	delete(n.miners, port)
+	return nil
+}
+
+// Partition - splits the miners into the ones on ports and all others, which stop talking to each other.
+func (n *Network) Partition(ports []int) error {
+	group := make(map[int]bool)
+	for _, port := range ports {
+		if _, ok := n.miners[port]; !ok {
+			return fmt.Errorf("no miner on port %d", port)
+		}
+		group[port] = true
+	}
+	n.tracker.Partition(func(address string) int {
+		if group[peer.PortOf(address)] {
+			return 1
+		}
+		return 0
+	})
+	return nil
+}
+
+// Heal - lets all miners talk to each other again.
+func (n *Network) Heal() {
+	n.tracker.Partition(nil)
+}
+
+// Post - writes a post signed by the devnet's user, and returns its ID.
+func (n *Network) Post(content string) (string, error) {
+	return n.user.WritePost(content)
+}
+
+// Ports - the ports of all running miners, in increasing order.
+func (n *Network) Ports() []int {
+	ports := make([]int, 0, len(n.miners))
+	for port := range n.miners {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// Tip - the tip of the blockchain of the miner on port.
+func (n *Network) Tip(port int) (miner.BlockJson, error) {
+	return n.user.GetTip(net.JoinHostPort("localhost", strconv.Itoa(port)))
+}
+
+// Shutdown - shuts down all miners and then the tracker.
+func (n *Network) Shutdown() {
+	for _, port := range n.Ports() {
+		n.KillMiner(port)
+	}
+	n.tracker.Shutdown()
+}
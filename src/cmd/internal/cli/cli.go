@@ -0,0 +1,76 @@
+// Package cli holds what the command line binaries of the blockchain have in common.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// LogLevels - Accepted values of the -log flag.
+// "debug" also logs the routes of the http servers, "info" logs what the nodes do, and "quiet" logs nothing.
+var LogLevels = []string{"debug", "info", "quiet"}
+
+// SetLogLevel - sets up logging for one of LogLevels. Must be called before any node is created.
+func SetLogLevel(level string) error {
+	switch level {
+	case "debug":
+		gin.SetMode(gin.DebugMode)
+	case "info":
+		gin.SetMode(gin.ReleaseMode)
+	case "quiet":
+		gin.SetMode(gin.ReleaseMode)
+		log.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("unknown log level %q, expected one of %v", level, LogLevels)
+	}
+	return nil
+}
+
+// IsSet - whether the flag with the given name is set on the command line, so that it overrides the config file.
+func IsSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// SplitList - splits the value of a flag that takes a comma-separated list, skipping empty items.
+func SplitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// NotifySignals - returns a channel that receives SIGINT and SIGTERM, instead of letting them kill the process.
+func NotifySignals() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return signals
+}
+
+// WaitForSignal - blocks until the process receives SIGINT or SIGTERM, and returns the signal.
+func WaitForSignal() os.Signal {
+	signals := NotifySignals()
+	defer signal.Stop(signals)
+	return <-signals
+}
+
+// Fatal - prints err to stderr and exits, even if logging is quiet.
+func Fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err.Error())
+	os.Exit(1)
+}
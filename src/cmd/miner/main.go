@@ -0,0 +1,82 @@
+// Command miner runs a miner until it receives SIGINT or SIGTERM.
+//
+// Usage:
+//
+//	miner [-config miner.yaml] [-host localhost] [-port 3000] [-advertise host:port] [-tracker host:port,...]
+//	      [-chain main] [-store dir] [-node-key node.pem] [-workers 1] [-log info]
+//
+// Flags override the settings in the config file, see miner.Config.
+package main
+
+import (
+	"blockchain/cmd/internal/cli"
+	"blockchain/miner"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+)
+
+func main() {
+	configPath := flag.String("config", "", "YAML or JSON file with the miner's settings")
+	host := flag.String("host", "", "host that the http server binds to, empty for all interfaces")
+	port := flag.Int("port", 0, "http port")
+	advertise := flag.String("advertise", "", "address that peers reach the miner at, as host:port or URL")
+	trackerAddress := flag.String("tracker", "", "comma-separated addresses of the trackers, as host:port or URL")
+	chainID := flag.String("chain", "", "chain ID of the network to join")
+	storeDir := flag.String("store", "", "directory to keep the blockchain and pool in, instead of memory")
+	nodeKey := flag.String("node-key", "", "PEM file of the node key, by default node.pem in the -store directory")
+	workers := flag.Int("workers", 0, "number of mining goroutines")
+	logLevel := flag.String("log", "info", fmt.Sprintf("log level, one of %v", cli.LogLevels))
+	flag.Parse()
+	if err := cli.SetLogLevel(*logLevel); err != nil {
+		cli.Fatal(err)
+	}
+
+	config := miner.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if config, err = miner.LoadConfig(*configPath); err != nil {
+			cli.Fatal(err)
+		}
+	}
+	if cli.IsSet("host") {
+		config.Host = *host
+	}
+	if cli.IsSet("port") {
+		config.Port = *port
+	}
+	if cli.IsSet("advertise") {
+		config.Advertise = *advertise
+	}
+	if cli.IsSet("tracker") {
+		trackers := cli.SplitList(*trackerAddress)
+		if len(trackers) == 0 {
+			cli.Fatal(errors.New("-tracker needs at least one address"))
+		}
+		config.Tracker, config.Trackers = trackers[0], trackers[1:]
+	}
+	if cli.IsSet("chain") {
+		config.ChainID = *chainID
+	}
+	if cli.IsSet("store") {
+		config.StoreDir = *storeDir
+	}
+	if cli.IsSet("node-key") {
+		config.NodeKey = *nodeKey
+	}
+	if cli.IsSet("workers") {
+		config.Workers = *workers
+	}
+
+	m, err := miner.NewMinerWithConfig(config)
+	if err != nil {
+		cli.Fatal(err)
+	}
+	m.Start()
+	log.Printf("miner listening on %s:%d as %s, trackers %v, chain %q\n", config.Host, config.Port, config.Address(),
+		config.TrackerAddresses(), config.ChainID)
+	sig := cli.WaitForSignal()
+	log.Printf("received %s, shutting down\n", sig)
+	m.Shutdown()
+}
@@ -0,0 +1,253 @@
+// Command post reads and writes posts on the blockchain as a user.
+//
+// Usage:
+//
+//	post [-tracker host:port,...] [-chain main] [-keyring keys] [-id default] [-log info] <command> [arguments]
+//
+// The commands are:
+//
+//	keygen [-algorithm ed25519]  create a new identity in the keyring
+//	import <file>                import a PEM private key as a new identity in the keyring
+//	ids                          list the identities in the keyring with their public keys
+//	write <content>              sign a post as the identity and send it to miners
+//	read                         print all posts on the blockchain
+//	status                       print every miner and the tip of its blockchain
+//
+// Private keys in the keyring are encrypted with a passphrase, see user.Keyring. The passphrase is read from the
+// PassphraseEnv environment variable if it is set, and from stdin otherwise.
+package main
+
+import (
+	"blockchain/blockchain"
+	"blockchain/cmd/internal/cli"
+	"blockchain/peer"
+	"blockchain/user"
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// PassphraseEnv - Environment variable that holds the passphrase of the keyring, for scripts.
+const PassphraseEnv = "BLOCKCHAIN_PASSPHRASE"
+
+func main() {
+	trackerList := flag.String("tracker", "localhost:8080", "comma-separated tracker addresses, as host:port or URL")
+	chainID := flag.String("chain", blockchain.DefaultChainID, "chain ID of the network")
+	keyringDir := flag.String("keyring", "keys", "directory of the keyring")
+	id := flag.String("id", "default", "name of the identity in the keyring")
+	logLevel := flag.String("log", "info", fmt.Sprintf("log level, one of %v", cli.LogLevels))
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] keygen|import|ids|write|read|status [arguments]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := cli.SetLogLevel(*logLevel); err != nil {
+		cli.Fatal(err)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	trackers := cli.SplitList(*trackerList)
+	if len(trackers) == 0 {
+		cli.Fatal(errors.New("-tracker needs at least one address"))
+	}
+	for _, tracker := range trackers {
+		if err := peer.CheckAddress(tracker); err != nil {
+			cli.Fatal(err)
+		}
+	}
+	params := blockchain.NewChainParams(*chainID)
+
+	var err error
+	switch command, args := flag.Arg(0), flag.Args()[1:]; command {
+	case "keygen":
+		err = keygen(*keyringDir, *id, args)
+	case "import":
+		err = importKey(*keyringDir, *id, args)
+	case "ids":
+		err = ids(*keyringDir)
+	case "write":
+		var u *user.User
+		if u, err = loadUser(trackers, params, *keyringDir, *id); err == nil {
+			err = write(u, args)
+		}
+	case "read":
+		var u *user.User
+		if u, err = newUser(trackers, params); err == nil {
+			err = read(u)
+		}
+	case "status":
+		var u *user.User
+		if u, err = newUser(trackers, params); err == nil {
+			err = status(u)
+		}
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	if err != nil {
+		cli.Fatal(err)
+	}
+}
+
+// readPassphrase - reads the passphrase from PassphraseEnv, or prompts for it on stdin.
+func readPassphrase() ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, errors.New("no passphrase given")
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// keygen - creates a new identity in the keyring, and prints its public key.
+func keygen(dir string, id string, args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	algorithmName := flags.String("algorithm", "ed25519", "signature scheme, ed25519 or rsa")
+	flags.Parse(args)
+	var algorithm blockchain.Algorithm
+	switch *algorithmName {
+	case "ed25519":
+		algorithm = blockchain.Ed25519
+	case "rsa":
+		algorithm = blockchain.RSA
+	default:
+		return fmt.Errorf("unknown algorithm %q", *algorithmName)
+	}
+	keyring, err := user.OpenKeyring(dir)
+	if err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return err
+	}
+	publicKey, err := keyring.Create(id, algorithm, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id, hex.EncodeToString(blockchain.PublicKeyToBytes(publicKey)))
+	return nil
+}
+
+// importKey - imports the private key in a PEM file as a new identity, and prints its public key.
+func importKey(dir string, id string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("import needs the PEM file of a private key")
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	keyring, err := user.OpenKeyring(dir)
+	if err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return err
+	}
+	publicKey, err := keyring.Import(id, data, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id, hex.EncodeToString(blockchain.PublicKeyToBytes(publicKey)))
+	return nil
+}
+
+// ids - prints the name and public key of every identity in the keyring.
+func ids(dir string) error {
+	keyring, err := user.OpenKeyring(dir)
+	if err != nil {
+		return err
+	}
+	names, err := keyring.Names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		publicKey, err := keyring.PublicKey(name)
+		if err != nil {
+			fmt.Printf("%s  error: %s\n", name, err.Error())
+			continue
+		}
+		fmt.Println(name, hex.EncodeToString(blockchain.PublicKeyToBytes(publicKey)))
+	}
+	return nil
+}
+
+// newUser - creates a user with a throwaway key, for commands that do not sign anything.
+func newUser(trackers []string, params *blockchain.ChainParams) (*user.User, error) {
+	return user.NewUserWithTrackers(trackers, params, blockchain.GenerateKey(blockchain.Ed25519))
+}
+
+// loadUser - creates a user that signs as the identity in the keyring.
+func loadUser(trackers []string, params *blockchain.ChainParams, dir string, id string) (*user.User, error) {
+	keyring, err := user.OpenKeyring(dir)
+	if err != nil {
+		return nil, err
+	}
+	path, err := keyring.Path(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no identity %q in %s, create one with keygen", id, dir)
+	}
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return user.LoadUser(trackers, params, path, passphrase)
+}
+
+// write - posts the arguments, joined by spaces, and prints the post ID.
+func write(u *user.User, args []string) error {
+	if len(args) == 0 {
+		return errors.New("write needs the content of the post")
+	}
+	id, err := u.WritePost(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+// read - prints the ID, time and content of every post, in order.
+func read(u *user.User) error {
+	posts, err := u.ReadPosts()
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		timestamp := time.Unix(0, posts[i].Body.Timestamp).Format(time.RFC3339)
+		fmt.Printf("%s  %s  %s\n", hex.EncodeToString(posts[i].ID())[:16], timestamp, posts[i].Body.Content)
+	}
+	return nil
+}
+
+// status - prints the address, tip height and tip hash of every miner.
+func status(u *user.User) error {
+	miners, err := u.GetMiners()
+	if err != nil {
+		return err
+	}
+	for _, address := range miners {
+		tip, err := u.GetTip(address)
+		if err != nil {
+			fmt.Printf("%s  error: %s\n", address, err.Error())
+			continue
+		}
+		fmt.Printf("%s  height %d  tip %s\n", address, tip.Height, tip.Hash)
+	}
+	return nil
+}
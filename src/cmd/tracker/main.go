@@ -0,0 +1,55 @@
+// Command tracker runs a tracker until it receives SIGINT or SIGTERM.
+//
+// Usage:
+//
+//	tracker [-config tracker.yaml] [-host localhost] [-port 8080] [-peers host:port,...] [-log info]
+//
+// Flags override the settings in the config file, see tracker.Config.
+package main
+
+import (
+	"blockchain/cmd/internal/cli"
+	"blockchain/tracker"
+	"flag"
+	"fmt"
+	"log"
+)
+
+func main() {
+	configPath := flag.String("config", "", "YAML or JSON file with the tracker's settings")
+	host := flag.String("host", "", "host that the http server binds to, empty for all interfaces")
+	port := flag.Int("port", 0, "http port")
+	peers := flag.String("peers", "", "comma-separated addresses of other trackers to replicate registrations to")
+	logLevel := flag.String("log", "info", fmt.Sprintf("log level, one of %v", cli.LogLevels))
+	flag.Parse()
+	if err := cli.SetLogLevel(*logLevel); err != nil {
+		cli.Fatal(err)
+	}
+
+	config := tracker.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if config, err = tracker.LoadConfig(*configPath); err != nil {
+			cli.Fatal(err)
+		}
+	}
+	if cli.IsSet("host") {
+		config.Host = *host
+	}
+	if cli.IsSet("port") {
+		config.Port = *port
+	}
+	if cli.IsSet("peers") {
+		config.Peers = cli.SplitList(*peers)
+	}
+
+	t, err := tracker.NewTrackerWithConfig(config)
+	if err != nil {
+		cli.Fatal(err)
+	}
+	t.Start()
+	log.Printf("tracker listening on %s:%d, peers %v\n", config.Host, config.Port, config.Peers)
+	sig := cli.WaitForSignal()
+	log.Printf("received %s, shutting down\n", sig)
+	t.Shutdown()
+}
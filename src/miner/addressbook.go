@@ -0,0 +1,316 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"blockchain/peer"
+	"blockchain/store"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxKnownPeers - An address book holds at most MaxKnownPeers peers, besides the ones that the tracker records, and a
+// peer exchange carries at most as many.
+const MaxKnownPeers = 1000
+
+// MaxPeersPerSource - An address book holds at most MaxPeersPerSource peers that it only learned from the same peer.
+const MaxPeersPerSource = 100
+
+// ErrTooManyPeers - A peer exchange carries more than MaxKnownPeers peers.
+var ErrTooManyPeers = errors.New("peer exchange is too large")
+
+// KnownPeerJson - One peer in a peer exchange, see AddressBook. LastSeen is in nanoseconds since the Unix epoch.
+// Verified tells whether the miner verified PublicKey itself, rather than only heard it from other peers.
+type KnownPeerJson struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"public-key,omitempty"`
+	Verified  bool   `json:"verified,omitempty"`
+	LastSeen  int64  `json:"last-seen"`
+}
+
+// KnownPeersJson - Request and response of the POST /peers API, which exchanges the peers that two miners know about.
+type KnownPeersJson struct {
+	Peers []KnownPeerJson `json:"peers"`
+}
+
+// AddressBook - The peers that a miner knows about, with their node keys and when they were last seen alive, so that
+// miners keep finding and authenticating each other while the tracker is unreachable.
+//
+// A miner records the peers that the tracker lists, sees a peer when it sends a signed request or answers a peer
+// exchange, and learns about other peers from the peer exchanges of its peers. Only the node keys that the tracker
+// reports, or that a peer proves to hold for its own address in a handshake (see Verify), authenticate requests. A
+// node key that is learned from another peer is only kept as a hint, which is passed on in peer exchanges but never
+// trusted. Peers that are not seen for expiry are forgotten.
+//
+// So that peers cannot fill the book with made-up peers and crowd out the real ones, each peer adds at most
+// MaxPeersPerSource peers, the peers that the tracker records are always admitted, and a full book makes room for them
+// by forgetting the peers that it only learned from peer exchanges first. AddressBook is safe for concurrent use.
+type AddressBook struct {
+	lock    sync.Mutex
+	expiry  time.Duration          // peers that are not seen for expiry are forgotten
+	entries map[string]*store.Peer // maps the address of each known peer to its entry
+	sources map[string]int         // maps the address of each peer to the number of entries only learned from it
+}
+
+// NewAddressBook - creates an empty AddressBook that forgets peers that are not seen for expiry.
+func NewAddressBook(expiry time.Duration) *AddressBook {
+	return &AddressBook{
+		expiry:  expiry,
+		entries: make(map[string]*store.Peer),
+		sources: make(map[string]int),
+	}
+}
+
+// Record - records that the tracker lists the peer at address at now. A non-empty key is the peer's node key as the
+// tracker reports it, which replaces the recorded one. The peer is always admitted, and is no longer counted against
+// the peer that it was learned from.
+func (b *AddressBook) Record(address string, key string, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, ok := b.entries[address]
+	if !ok {
+		b.makeRoom(now)
+		entry = &store.Peer{Address: address}
+		b.entries[address] = entry
+	}
+	b.forgetSource(entry)
+	if key != "" {
+		entry.PublicKey = key
+		entry.KeyHint = ""
+	}
+	if now.After(entry.LastSeen) {
+		entry.LastSeen = now
+	}
+}
+
+// Seen - records that the known peer at address is alive at now. Unknown peers are not added.
+func (b *AddressBook) Seen(address string, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if entry, ok := b.entries[address]; ok && now.After(entry.LastSeen) {
+		entry.LastSeen = now
+	}
+}
+
+// Learn - records the peers that the peer at source knows about at now, except the one at self, and returns the ones
+// that were not known before. Peers that are expired, or claim to be seen after now, count as seen at most at now. New
+// peers are only added while the book has room, and source has added fewer than MaxPeersPerSource of the known ones.
+func (b *AddressBook) Learn(peers []KnownPeerJson, self string, source string, now time.Time) []KnownPeerJson {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	learned := make([]KnownPeerJson, 0)
+	for _, known := range peers {
+		lastSeen := time.Unix(0, known.LastSeen)
+		if known.Address == self || now.Sub(lastSeen) >= b.expiry {
+			continue
+		}
+		if lastSeen.After(now) {
+			lastSeen = now
+		}
+		entry, ok := b.entries[known.Address]
+		if !ok {
+			if b.sources[source] >= MaxPeersPerSource || !b.hasRoom(now) {
+				continue
+			}
+			entry = &store.Peer{Address: known.Address, Source: source}
+			b.entries[known.Address] = entry
+			b.sources[source]++
+			learned = append(learned, known)
+		}
+		if entry.KeyHint == "" {
+			entry.KeyHint = known.PublicKey
+		}
+		if lastSeen.After(entry.LastSeen) {
+			entry.LastSeen = lastSeen
+		}
+	}
+	return learned
+}
+
+// Verify - records that the known peer at address proved at now that it holds the node key key, see
+// Miner.handshake. Unknown peers are not added.
+func (b *AddressBook) Verify(address string, key string, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, ok := b.entries[address]
+	if !ok {
+		return
+	}
+	entry.PublicKey = key
+	entry.KeyHint = ""
+	if now.After(entry.LastSeen) {
+		entry.LastSeen = now
+	}
+}
+
+// Contains - whether the peer at address is in the book.
+func (b *AddressBook) Contains(address string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.entries[address]
+	return ok
+}
+
+// Key - the verified node key of the peer at address, or nil if it is unknown or only a hint.
+func (b *AddressBook) Key(address string) blockchain.PublicKey {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entry, ok := b.entries[address]
+	if !ok || entry.PublicKey == "" {
+		return nil
+	}
+	key, err := peer.DecodeKey(entry.PublicKey)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// hasRoom - whether there is room for another peer at now, after forgetting the expired ones if needed. The caller
+// must hold the lock.
+func (b *AddressBook) hasRoom(now time.Time) bool {
+	if len(b.entries) < MaxKnownPeers {
+		return true
+	}
+	for address, entry := range b.entries {
+		if now.Sub(entry.LastSeen) >= b.expiry {
+			b.remove(address)
+		}
+	}
+	return len(b.entries) < MaxKnownPeers
+}
+
+// makeRoom - makes room for a peer that the tracker records at now, by forgetting the expired peers, or else the peer
+// that was seen the longest ago of the ones that were only learned from peer exchanges. When the tracker recorded all
+// the known peers, the book grows past MaxKnownPeers. The caller must hold the lock.
+func (b *AddressBook) makeRoom(now time.Time) {
+	if b.hasRoom(now) {
+		return
+	}
+	var oldest *store.Peer
+	for _, entry := range b.entries {
+		if entry.Source != "" && (oldest == nil || entry.LastSeen.Before(oldest.LastSeen)) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		b.remove(oldest.Address)
+	}
+}
+
+// remove - forgets the peer at address. The caller must hold the lock.
+func (b *AddressBook) remove(address string) {
+	if entry, ok := b.entries[address]; ok {
+		b.forgetSource(entry)
+		delete(b.entries, address)
+	}
+}
+
+// forgetSource - stops counting entry against the peer that it was learned from, if any. The caller must hold the
+// lock.
+func (b *AddressBook) forgetSource(entry *store.Peer) {
+	if entry.Source == "" {
+		return
+	}
+	if b.sources[entry.Source]--; b.sources[entry.Source] <= 0 {
+		delete(b.sources, entry.Source)
+	}
+	entry.Source = ""
+}
+
+// Known - the peers that are not expired at now, sorted by address, with their verified node keys, or else their hints.
+func (b *AddressBook) Known(now time.Time) []KnownPeerJson {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	known := make([]KnownPeerJson, 0, len(b.entries))
+	for _, entry := range b.entries {
+		if now.Sub(entry.LastSeen) >= b.expiry {
+			continue
+		}
+		key := entry.PublicKey
+		if key == "" {
+			key = entry.KeyHint
+		}
+		known = append(known, KnownPeerJson{
+			Address:   entry.Address,
+			PublicKey: key,
+			Verified:  entry.PublicKey != "",
+			LastSeen:  entry.LastSeen.UnixNano(),
+		})
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].Address < known[j].Address
+	})
+	return known
+}
+
+// Addresses - the addresses of the peers that are not expired at now, sorted.
+func (b *AddressBook) Addresses(now time.Time) []string {
+	known := b.Known(now)
+	addresses := make([]string, 0, len(known))
+	for _, entry := range known {
+		addresses = append(addresses, entry.Address)
+	}
+	return addresses
+}
+
+// Entries - the peers that are not expired at now, for the store.
+func (b *AddressBook) Entries(now time.Time) []store.Peer {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	entries := make([]store.Peer, 0, len(b.entries))
+	for _, entry := range b.entries {
+		if now.Sub(entry.LastSeen) < b.expiry {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// Restore - adds the peers read from the store, with the node keys, last-seen times and sources they were stored with.
+// Peers with an invalid address, or beyond MaxPeersPerSource of the same source, are skipped.
+func (b *AddressBook) Restore(entries []store.Peer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i := range entries {
+		if len(b.entries) >= MaxKnownPeers {
+			return
+		}
+		if peer.CheckAddress(entries[i].Address) != nil {
+			continue
+		}
+		entry := entries[i]
+		if _, ok := b.entries[entry.Address]; ok {
+			continue
+		}
+		if entry.Source != "" {
+			if b.sources[entry.Source] >= MaxPeersPerSource {
+				continue
+			}
+			b.sources[entry.Source]++
+		}
+		b.entries[entry.Address] = &entry
+	}
+}
+
+// CheckKnownPeers - checks that a peer exchange is within MaxKnownPeers, and that every peer in it has a valid address
+// and node key, if any.
+func CheckKnownPeers(peers []KnownPeerJson) error {
+	if len(peers) > MaxKnownPeers {
+		return fmt.Errorf("%w: more than %d peers", ErrTooManyPeers, MaxKnownPeers)
+	}
+	for _, known := range peers {
+		if err := peer.CheckAddress(known.Address); err != nil {
+			return fmt.Errorf("%w: %s", ErrBadResponse, err.Error())
+		}
+		if known.PublicKey == "" {
+			continue
+		}
+		if _, err := peer.DecodeKey(known.PublicKey); err != nil {
+			return fmt.Errorf("%w: node key of %s is invalid", ErrBadResponse, known.Address)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"blockchain/peer"
+	"blockchain/tracker"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// peerContextKey - authenticate stores the address of the peer that signs a request under this key of the gin context.
+const peerContextKey = "peer"
+
+// HandshakeNonceSize - The size in bytes of the nonce that a miner sends in a handshake, see Miner.handshake.
+const HandshakeNonceSize = 32
+
+// HandshakeJson - Response of the GET /handshake API, in which a miner proves that it holds the node key it reports for
+// its address by signing the nonce of the asking miner, see peer.SignHandshake.
+type HandshakeJson struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"public-key"`
+	Signature string `json:"signature"`
+}
+
+// authenticate - gin middleware for the APIs that only peers may call. It lets a request through only if it is signed
+// by the verified node key in the address book for the peer's address (see peer.Verify and AddressBook), and stores the
+// address of the peer in the context. Otherwise, it responds 401, or 403 if the peer is banned (see PeerManager).
+// A peer that is unknown, or whose signature does not match, may have registered since the last heartbeat, so the keys
+// are fetched from the tracker once more before the request is rejected, or the peer is asked for a handshake, unless
+// that is rate-limited (see refreshPeerKeys).
+func (m *Miner) authenticate(ctx *gin.Context) {
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "request has invalid body"})
+		return
+	}
+	// the handler reads the body again
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	address, err := peer.Verify(ctx.Request, body, m.peerKey)
+	if errors.Is(err, peer.ErrUnknownPeer) || errors.Is(err, peer.ErrBadSignature) {
+		if m.refreshPeerKeys(ctx.Request.Header.Get(peer.AddressHeader)) {
+			address, err = peer.Verify(ctx.Request, body, m.peerKey)
+		}
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	if m.peers.Banned(address, now) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "peer is banned"})
+		return
+	}
+	m.book.Seen(address, now)
+	ctx.Set(peerContextKey, address)
+	ctx.Next()
+}
+
+// peerKey - the node key of the peer at address, or nil if it is unknown.
+func (m *Miner) peerKey(address string) blockchain.PublicKey {
+	return m.book.Key(address)
+}
+
+// recordMiners - records the miners that the tracker lists, and their node keys, in the address book. Keys that fail to
+// decode are skipped.
+func (m *Miner) recordMiners(response tracker.PortsJson) {
+	now := time.Now()
+	for _, address := range response.MinerAddresses() {
+		if address == m.config.Address() {
+			continue
+		}
+		key := response.Keys[address]
+		if _, err := peer.DecodeKey(key); key != "" && err != nil {
+			log.Printf("%d: Tracker reports an invalid node key for peer %s\n", m.config.Port, address)
+			key = ""
+		}
+		m.book.Record(address, key, now)
+	}
+}
+
+// refreshPeerKeys - fetches the node keys of all miners from the first tracker that answers, and then, if there is still
+// no verified node key for the peer at address in the address book, asks that peer for a handshake (see handshake), and
+// returns whether either worked. Only peers in the address book are asked, so that a request cannot make the miner
+// contact any address. So that requests from made-up peers cannot flood the trackers or other peers, it does not fetch
+// while another fetch is in flight, nor within KeyRefresh of the last fetch.
+func (m *Miner) refreshPeerKeys(address string) bool {
+	if !m.refreshLock.TryLock() {
+		return false
+	}
+	defer m.refreshLock.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastRefresh) < m.config.KeyRefresh {
+		return false
+	}
+	m.lastRefresh = now
+	refreshed := false
+	for _, trackerAddress := range m.config.TrackerAddresses() {
+		if err := m.fetchPeerKeys(trackerAddress); err != nil {
+			log.Printf("%d: Failed to fetch node keys from tracker %s: %s\n", m.config.Port, trackerAddress, err.Error())
+			continue
+		}
+		refreshed = true
+		break
+	}
+	if m.book.Key(address) != nil || !m.book.Contains(address) {
+		return refreshed
+	}
+	if err := m.handshake(address); err != nil {
+		log.Printf("%d: Failed to verify the node key of peer %s: %s\n", m.config.Port, address, err.Error())
+		return refreshed
+	}
+	return true
+}
+
+// handshake - asks the peer at address to sign a random nonce with its node key, and records the key in the address
+// book as verified if the signature matches (see peer.VerifyHandshake). Whoever answers at the peer's address holds
+// the key, so a key that only other peers report for the address is not trusted until then.
+func (m *Miner) handshake(address string) error {
+	nonce := make([]byte, HandshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	resp, err := m.client.Get(apiURL(address, "/handshake?nonce="+hex.EncodeToString(nonce)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer rejected handshake: status code %d", resp.StatusCode)
+	}
+	var response HandshakeJson
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%w: %s", ErrBadResponse, err.Error())
+	}
+	if response.Address != address {
+		return fmt.Errorf("%w: handshake for another address %s", ErrBadResponse, response.Address)
+	}
+	key, err := peer.DecodeKey(response.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: node key is invalid", ErrBadResponse)
+	}
+	signature, err := base64.StdEncoding.DecodeString(response.Signature)
+	if err != nil || !peer.VerifyHandshake(nonce, address, key, signature) {
+		return fmt.Errorf("%w: handshake signature is invalid", ErrBadResponse)
+	}
+	m.book.Verify(address, response.PublicKey, time.Now())
+	return nil
+}
+
+// fetchPeerKeys - fetches the node keys of all miners from the tracker at address.
+func (m *Miner) fetchPeerKeys(address string) error {
+	resp, err := m.client.Get(apiURL(address, "/get_miners"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// no miners yet
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	var response tracker.PortsJson
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+	m.recordMiners(response)
+	return nil
+}
+
+// apiURL - the URL of the API at path of the miner or tracker at address.
+func apiURL(address string, path string) string {
+	return peer.URL(address) + path
+}
+
+// post - sends a json body to url in a POST request signed with the node key, see peer.Sign.
+func (m *Miner) post(url string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	peer.Sign(request, body, m.config.Address(), m.key)
+	return m.client.Do(request)
+}
+
+// punish - records the offense of the peer at address that err stands for, if any (see OffenseOf), and logs a ban.
+func (m *Miner) punish(address string, err error) {
+	offense, ok := OffenseOf(err)
+	if !ok {
+		return
+	}
+	if m.peers.Punish(address, offense, time.Now()) {
+		log.Printf("%d: Banned peer %s for %s after %s\n", m.config.Port, address, m.config.BanDuration, offense)
+	}
+}
@@ -0,0 +1,170 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"blockchain/peer"
+	"blockchain/settings"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// NodeKeyFile - Name of the node key in the store's directory, unless Config.NodeKey says otherwise.
+const NodeKeyFile = "node.pem"
+
+// Config - Settings of a Miner, see DefaultConfig for the defaults.
+type Config struct {
+	Host      string   `yaml:"host"`      // host that the http server binds to, or empty for all interfaces
+	Port      int      `yaml:"port"`      // http port
+	Advertise string   `yaml:"advertise"` // address that peers reach the miner at, as host:port or URL, see Address
+	Tracker   string   `yaml:"tracker"`   // address of the tracker, as host:port or URL
+	Trackers  []string `yaml:"trackers"`  // addresses of more trackers, which the miner registers to as well
+	ChainID   string   `yaml:"chain-id"`  // the network to join, see blockchain.NewChainParams
+	StoreDir  string   `yaml:"store-dir"` // directory of the store, or empty to keep everything in memory
+	NodeKey   string   `yaml:"node-key"`  // PEM file of the node key, by default NodeKeyFile in StoreDir, see nodeKey
+
+	Workers          int `yaml:"workers"`           // number of goroutines that search for a nonce in parallel
+	MiningIterations int `yaml:"mining-iterations"` // each mining worker tries at most MiningIterations nonces at a time
+	PostsPerBlock    int `yaml:"posts-per-block"`   // a mined block holds at most PostsPerBlock posts
+
+	PoolMaxPosts int           `yaml:"pool-max-posts"` // the pool holds at most PoolMaxPosts posts, see Pool
+	PoolMaxBytes int           `yaml:"pool-max-bytes"` // the pool holds at most PoolMaxBytes bytes of posts
+	PoolTTL      time.Duration `yaml:"pool-ttl"`       // posts older than PoolTTL are dropped from the pool
+
+	HeartbeatMin time.Duration `yaml:"heartbeat-min"` // heartbeat interval is randomly chosen from HeartbeatMin to HeartbeatMax
+	HeartbeatMax time.Duration `yaml:"heartbeat-max"`
+	SyncMin      time.Duration `yaml:"sync-min"` // pool sync interval is randomly chosen from SyncMin to SyncMax
+	SyncMax      time.Duration `yaml:"sync-max"`
+
+	PeerTimeout  time.Duration `yaml:"peer-timeout"`  // requests to peers and the tracker give up after PeerTimeout
+	BanThreshold int           `yaml:"ban-threshold"` // a peer whose score reaches BanThreshold is banned, see PeerManager
+	BanDuration  time.Duration `yaml:"ban-duration"`  // how long a ban lasts
+	PeerExchange time.Duration `yaml:"peer-exchange"` // the miner exchanges known peers with a random peer every PeerExchange
+	PeerExpiry   time.Duration `yaml:"peer-expiry"`   // peers that are not seen for PeerExpiry are forgotten, see AddressBook
+	KeyRefresh   time.Duration `yaml:"key-refresh"`   // unknown peers make the miner fetch node keys at most every KeyRefresh
+}
+
+// DefaultConfig - the default settings of a Miner on port 3000 of the main network, with a tracker on port 8080.
+func DefaultConfig() Config {
+	return Config{
+		Host:             "localhost",
+		Port:             3000,
+		Tracker:          "localhost:8080",
+		ChainID:          blockchain.DefaultChainID,
+		Workers:          1,
+		MiningIterations: 10000,
+		PostsPerBlock:    2,
+		PoolMaxPosts:     10000,
+		PoolMaxBytes:     16 * 1024 * 1024,
+		PoolTTL:          time.Hour,
+		HeartbeatMin:     200 * time.Millisecond,
+		HeartbeatMax:     400 * time.Millisecond,
+		SyncMin:          300 * time.Millisecond,
+		SyncMax:          600 * time.Millisecond,
+		PeerTimeout:      5 * time.Second,
+		BanThreshold:     100,
+		BanDuration:      10 * time.Minute,
+		PeerExchange:     2 * time.Second,
+		PeerExpiry:       time.Hour,
+		KeyRefresh:       time.Second,
+	}
+}
+
+// LoadConfig - reads the settings in the YAML or JSON file at path. Settings missing from the file keep their
+// defaults.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if err := settings.Load(path, &config); err != nil {
+		return Config{}, err
+	}
+	return config, config.Validate()
+}
+
+// Validate - checks that every setting is in range.
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return errors.New("port must be from 1 to 65535")
+	}
+	if err := peer.CheckAddress(c.Tracker); err != nil {
+		return fmt.Errorf("tracker: %w", err)
+	}
+	for _, address := range c.Trackers {
+		if err := peer.CheckAddress(address); err != nil {
+			return fmt.Errorf("trackers: %w", err)
+		}
+	}
+	if c.Advertise != "" {
+		if err := peer.CheckAddress(c.Advertise); err != nil {
+			return fmt.Errorf("advertise: %w", err)
+		}
+	}
+	if c.ChainID == "" {
+		return errors.New("chain-id must not be empty")
+	}
+	if c.Workers <= 0 || c.MiningIterations <= 0 || c.PostsPerBlock <= 0 {
+		return errors.New("workers, mining-iterations and posts-per-block must be positive")
+	}
+	if c.PoolMaxPosts <= 0 || c.PoolMaxBytes <= 0 || c.PoolTTL <= 0 {
+		return errors.New("pool-max-posts, pool-max-bytes and pool-ttl must be positive")
+	}
+	if c.HeartbeatMin <= 0 || c.HeartbeatMax < c.HeartbeatMin {
+		return errors.New("heartbeat-min must be positive and at most heartbeat-max")
+	}
+	if c.SyncMin <= 0 || c.SyncMax < c.SyncMin {
+		return errors.New("sync-min must be positive and at most sync-max")
+	}
+	if c.PeerTimeout <= 0 || c.BanThreshold <= 0 || c.BanDuration <= 0 {
+		return errors.New("peer-timeout, ban-threshold and ban-duration must be positive")
+	}
+	if c.PeerExchange <= 0 || c.PeerExpiry <= 0 || c.KeyRefresh <= 0 {
+		return errors.New("peer-exchange, peer-expiry and key-refresh must be positive")
+	}
+	return nil
+}
+
+// TrackerAddresses - the addresses of all trackers that the miner registers to, Tracker first, without duplicates.
+func (c *Config) TrackerAddresses() []string {
+	addresses := make([]string, 0, 1+len(c.Trackers))
+	for _, address := range append([]string{c.Tracker}, c.Trackers...) {
+		if address != "" && !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Address - the address that the miner advertises to the tracker and to peers, which identifies it: Advertise, or else
+// host:port of the http server, with localhost for a server that binds to all interfaces.
+func (c *Config) Address() string {
+	if c.Advertise != "" {
+		return c.Advertise
+	}
+	host := c.Host
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Port))
+}
+
+// nodeKey - the node key that identifies the miner to the tracker and to peers. It is read from Config.NodeKey, or from
+// NodeKeyFile in Config.StoreDir, and generated there on the first run. A miner with neither gets a new key every time.
+func nodeKey(config Config) (blockchain.Signer, error) {
+	path := config.NodeKey
+	if path == "" && config.StoreDir != "" {
+		path = filepath.Join(config.StoreDir, NodeKeyFile)
+	}
+	if path == "" {
+		return blockchain.GenerateKey(blockchain.Ed25519), nil
+	}
+	return peer.LoadOrCreateKey(path)
+}
+
+// randomDuration - a random duration from low to high.
+func randomDuration(low time.Duration, high time.Duration) time.Duration {
+	return low + time.Duration(rand.Int63n(int64(high-low)+1))
+}
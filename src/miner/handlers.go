@@ -2,12 +2,20 @@ package miner
 
 import (
 	"blockchain/blockchain"
+	"blockchain/peer"
 	"bytes"
-	"github.com/emirpasic/gods/sets/treeset"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
+// MaxBlocksPerPage - A page of /read contains at most MaxBlocksPerPage blocks.
+const MaxBlocksPerPage = 100
+
 // readHandler - handles /read request from a user
 // encodes and returns the miner's complete blockchain
 func (m *Miner) readHandler() (int, any) {
@@ -21,116 +29,378 @@ func (m *Miner) readHandler() (int, any) {
 	return http.StatusOK, resp
 }
 
+// readPageHandler - handles /read request with a page from a user
+// encodes and returns at most count blocks of the miner's blockchain from height start on, at most MaxBlocksPerPage
+func (m *Miner) readPageHandler(start int, count int) (int, any) {
+	if start < 0 || count < 0 || count > MaxBlocksPerPage {
+		return http.StatusBadRequest, map[string]string{"error": "page has invalid start or count"}
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	resp := BlockChainJson{Blockchain: make([]blockchain.BlockBase64, 0), Start: start, Length: len(m.blockChain)}
+	for i := start; i < min(len(m.blockChain), start+count); i++ {
+		resp.Blockchain = append(resp.Blockchain, m.blockChain[i].EncodeBase64())
+	}
+	return http.StatusOK, resp
+}
+
+// tipHandler - handles /tip request from a user
+// returns the last block of the miner's blockchain
+func (m *Miner) tipHandler() (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.blockResponse(len(m.blockChain) - 1)
+}
+
+// blockByHeightHandler - handles /block/height request from a user
+// returns the block at the given height
+func (m *Miner) blockByHeightHandler(height int) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.blockResponse(height)
+}
+
+// blockByHashHandler - handles /block/hash request from a user
+// returns the block with the given header hash
+func (m *Miner) blockByHashHandler(hash []byte) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	height, ok := m.heights[string(hash)]
+	if !ok {
+		return http.StatusNotFound, map[string]string{"error": "block is not on the blockchain"}
+	}
+	return m.blockResponse(height)
+}
+
+// blockPostsByHeightHandler - handles /block/height/posts request from a user
+// returns the posts in the block at the given height
+func (m *Miner) blockPostsByHeightHandler(height int) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.blockPostsResponse(height)
+}
+
+// blockPostsByHashHandler - handles /block/hash/posts request from a user
+// returns the posts in the block with the given header hash
+func (m *Miner) blockPostsByHashHandler(hash []byte) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	height, ok := m.heights[string(hash)]
+	if !ok {
+		return http.StatusNotFound, map[string]string{"error": "block is not on the blockchain"}
+	}
+	return m.blockPostsResponse(height)
+}
+
+// headerRangeHandler - handles /headers/range request from a user
+// returns the headers of the blocks from height start to height end (exclusive), at most MaxHeadersPerRequest
+func (m *Miner) headerRangeHandler(start int, end int) (int, any) {
+	if start < 0 || end < start || end-start > MaxHeadersPerRequest {
+		return http.StatusBadRequest, map[string]string{"error": "range has invalid start or end"}
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if start >= len(m.blockChain) {
+		return http.StatusNotFound, map[string]string{"error": "block is not on the blockchain"}
+	}
+	resp := HeaderRangeJson{Headers: make([]HeaderJson, 0)}
+	for i := start; i < min(len(m.blockChain), end); i++ {
+		header := &m.blockChain[i].Header
+		resp.Headers = append(resp.Headers, HeaderJson{
+			Hash:   hex.EncodeToString(blockchain.Hash(header)),
+			Height: i,
+			Header: header.EncodeBase64(),
+		})
+	}
+	return http.StatusOK, resp
+}
+
+// blockResponse - the response with the block at height, or 404 if there is none. The caller must hold the lock.
+func (m *Miner) blockResponse(height int) (int, any) {
+	if height < 0 || height >= len(m.blockChain) {
+		return http.StatusNotFound, map[string]string{"error": "block is not on the blockchain"}
+	}
+	block := &m.blockChain[height]
+	resp := BlockJson{
+		Hash:   hex.EncodeToString(blockchain.Hash(block.Header)),
+		Height: height,
+		Block:  block.EncodeBase64(),
+	}
+	return http.StatusOK, resp
+}
+
+// blockPostsResponse - the response with the posts in the block at height, or 404 if there is none. The caller must
+// hold the lock.
+func (m *Miner) blockPostsResponse(height int) (int, any) {
+	if height < 0 || height >= len(m.blockChain) {
+		return http.StatusNotFound, map[string]string{"error": "block is not on the blockchain"}
+	}
+	block := &m.blockChain[height]
+	resp := BlockPostsJson{
+		Hash:   hex.EncodeToString(blockchain.Hash(block.Header)),
+		Height: height,
+		Posts:  make([]blockchain.PostBase64, 0),
+	}
+	for _, post := range block.Posts {
+		resp.Posts = append(resp.Posts, post.EncodeBase64())
+	}
+	return http.StatusOK, resp
+}
+
 // writeHandler - handles /write request from a user
 // decodes, verifies and adds a user's post to miner's pool
 func (m *Miner) writeHandler(post blockchain.Post) (int, any) {
-	if !post.Verify() {
-		return http.StatusBadRequest, map[string]string{"error": "invalid post"}
+	if err := post.Validate(m.params); err != nil {
+		return http.StatusBadRequest, map[string]string{"error": "invalid post: " + err.Error()}
 	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	// the new post must not be on the blockchain already
-	if m.posts.Contains(post) {
+	if m.onChain(post) {
 		return http.StatusBadRequest, map[string]string{"error": "duplicated post on the blockchain"}
 	}
 	// the new post must not be in the pool already
 	if m.pool.Contains(post) {
 		return http.StatusBadRequest, map[string]string{"error": "duplicated post in the post"}
 	}
-	m.pool.Add(post)
-	log.Printf("%d: Received post \"%s\" from user", m.port, post.Body.Content)
-	return http.StatusOK, nil
+	if err := m.pool.Add(post, time.Now()); errors.Is(err, ErrPoolFull) {
+		return http.StatusServiceUnavailable, map[string]string{"error": err.Error()}
+	} else if err != nil {
+		return http.StatusBadRequest, map[string]string{"error": "invalid post: " + err.Error()}
+	}
+	log.Printf("%d: Received post \"%s\" from user", m.config.Port, post.Body.Content)
+	return http.StatusOK, PostIDJson{ID: hex.EncodeToString(post.ID())}
+}
+
+// findPost - finds the post with the given ID on the blockchain, and returns the height of its block and its index in
+// the block. The caller must hold the lock.
+func (m *Miner) findPost(id []byte) (int, int, bool) {
+	height, ok := m.posts[string(id)]
+	if !ok {
+		return 0, 0, false
+	}
+	for i := range m.blockChain[height].Posts {
+		if bytes.Equal(m.blockChain[height].Posts[i].ID(), id) {
+			return height, i, true
+		}
+	}
+	return 0, 0, false
+}
+
+// postHandler - handles /post request from a user
+// finds the post with the given ID, and returns it with the height of its block and its number of confirmations
+// a post still in the pool has height -1 and no confirmations
+func (m *Miner) postHandler(id []byte) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if height, i, ok := m.findPost(id); ok {
+		resp := PostJson{
+			Post:          m.blockChain[height].Posts[i].EncodeBase64(),
+			Height:        height,
+			Confirmations: len(m.blockChain) - height,
+		}
+		return http.StatusOK, resp
+	}
+	iter := m.pool.Iterator()
+	for iter.Next() {
+		post := iter.Value().(blockchain.Post)
+		if bytes.Equal(post.ID(), id) {
+			resp := PostJson{
+				Post:          post.EncodeBase64(),
+				Height:        -1,
+				Confirmations: 0,
+			}
+			return http.StatusOK, resp
+		}
+	}
+	return http.StatusNotFound, map[string]string{"error": "post is not found"}
+}
+
+// proofHandler - handles /proof request from a user
+// finds the post with the given hash (its ID) on the blockchain, and returns its block header and Merkle inclusion proof
+func (m *Miner) proofHandler(hash []byte) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	height, i, ok := m.findPost(hash)
+	if ok {
+		block := &m.blockChain[height]
+		proof, err := blockchain.NewMerkleProof(block.Posts, i)
+		if err != nil {
+			return http.StatusInternalServerError, map[string]string{"error": err.Error()}
+		}
+		resp := ProofJson{
+			Height: height,
+			Header: block.Header.EncodeBase64(),
+			Proof:  proof.EncodeBase64(),
+		}
+		return http.StatusOK, resp
+	}
+	return http.StatusNotFound, map[string]string{"error": "post is not on the blockchain"}
 }
 
 // syncHandler - handles /sync request from a peer miner
-// unions this miner's post pool and the posts sent to the API
-func (m *Miner) syncHandler(posts []blockchain.Post) (int, any) {
+// unions this miner's post pool and the posts sent to the API by the peer at address peer
+func (m *Miner) syncHandler(peer string, posts []blockchain.Post) (int, any) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	// all posts must be valid
 	for _, post := range posts {
-		if !post.Verify() {
-			return http.StatusBadRequest, map[string]string{"error": "posts are invalid"}
+		if err := post.Validate(m.params); err != nil {
+			log.Printf("%d: Rejected posts from peer %s: %s\n", m.config.Port, peer, err.Error())
+			m.punish(peer, err)
+			return http.StatusBadRequest, map[string]string{"error": "posts are invalid: " + err.Error()}
 		}
 	}
 	// add all posts that are not duplicated
+	now := time.Now()
 	for _, post := range posts {
 		// the new post must not be in the blockchain or pool already
-		if m.posts.Contains(post) || m.pool.Contains(post) {
+		if m.onChain(post) || m.pool.Contains(post) {
+			continue
+		}
+		// accept the post, unless it is expired or there is no room
+		if m.pool.Add(post, now) != nil {
 			continue
 		}
-		// accept the post
-		m.pool.Add(post)
-		log.Printf("%d: Synced post \"%s\" to pool", m.port, post.Body.Content)
+		log.Printf("%d: Synced post \"%s\" from peer %s to pool", m.config.Port, post.Body.Content, peer)
 	}
 	return http.StatusOK, nil
 }
 
-// broadcastHandler - handles /broadcast request from a peer miner
-// if the incoming blockchain is valid and longer than this miner's blockchain, switch to the new blockchain
-func (m *Miner) broadcastHandler(newChain []blockchain.Block) (int, any) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// poolHandler - handles /pool request
+// returns the size and limits of the pool, the age of its oldest post, and how many posts it has turned away
+func (m *Miner) poolHandler() (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-	if len(newChain) <= len(m.blockChain) {
-		// shorter or equal than mine, just ignore it
-		return http.StatusOK, nil
+	return http.StatusOK, m.pool.Stats(time.Now())
+}
+
+// peersHandler - handles GET /peers request from an operator
+// returns the score, offenses and bans of every peer that ever misbehaved, and the peers in the address book
+func (m *Miner) peersHandler() (int, any) {
+	now := time.Now()
+	response := m.peers.Stats(now)
+	response.Known = m.book.Known(now)
+	return http.StatusOK, response
+}
+
+// handshakeHandler - handles /handshake request from a miner that checks this miner's node key
+// signs the nonce of the asking miner together with this miner's address, see Miner.handshake
+func (m *Miner) handshakeHandler(nonce []byte) (int, any) {
+	if len(nonce) != HandshakeNonceSize {
+		return http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("nonce must have %d bytes", HandshakeNonceSize)}
 	}
-	// each block must be valid
-	for _, block := range newChain {
-		if !block.Verify() {
-			return http.StatusOK, nil
-		}
+	address := m.config.Address()
+	return http.StatusOK, HandshakeJson{
+		Address:   address,
+		PublicKey: peer.EncodeKey(m.key.Public()),
+		Signature: base64.StdEncoding.EncodeToString(peer.SignHandshake(nonce, address, m.key)),
 	}
-	// their hash value must form a chain
-	if !bytes.Equal(newChain[0].Header.PrevHash, make([]byte, 32)) {
-		return http.StatusOK, nil
+}
+
+// exchangeHandler - handles POST /peers request from the peer at address peer, which tells the peers it knows about
+// records them in the address book, gossips the ones that are new to the other peers, and returns the known peers
+func (m *Miner) exchangeHandler(peer string, known []KnownPeerJson) (int, any) {
+	if err := CheckKnownPeers(known); err != nil {
+		m.punish(peer, err)
+		return http.StatusBadRequest, map[string]string{"error": err.Error()}
 	}
-	for i := 1; i < len(newChain); i++ {
-		if !bytes.Equal(newChain[i].Header.PrevHash, blockchain.Hash(newChain[i-1].Header)) {
-			return http.StatusOK, nil
-		}
+	now := time.Now()
+	if learned := m.book.Learn(known, m.config.Address(), peer, now); len(learned) > 0 {
+		log.Printf("%d: Learned about %d new peers from peer %s\n", m.config.Port, len(learned), peer)
+		m.gossip(learned, peer)
 	}
-	// no duplicated posts
-	posts := treeset.NewWith(m.cmp)
-	for _, block := range newChain {
-		for _, post := range block.Posts {
-			if posts.Contains(post) {
-				return http.StatusOK, nil
-			}
-			posts.Add(post)
+	return http.StatusOK, KnownPeersJson{Peers: m.knownPeers(now)}
+}
+
+// headersHandler - handles /headers request from a peer miner
+// finds the first block in the locator that is on this miner's blockchain, and returns the headers of at most
+// MaxHeadersPerRequest blocks after it
+func (m *Miner) headersHandler(locator [][]byte) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, hash := range locator {
+		height, ok := m.heights[string(hash)]
+		if !ok {
+			continue
 		}
-	}
-	// all checks passed, compute the new pool
-	pool := treeset.NewWith(m.cmp)
-	iter := m.pool.Iterator()
-	for iter.Next() {
-		post := iter.Value().(blockchain.Post)
-		if !posts.Contains(post) {
-			pool.Add(post)
+		resp := HeadersJson{Start: height + 1, Headers: make([]blockchain.BlockHeaderBase64, 0)}
+		end := min(len(m.blockChain), resp.Start+MaxHeadersPerRequest)
+		for i := resp.Start; i < end; i++ {
+			resp.Headers = append(resp.Headers, m.blockChain[i].Header.EncodeBase64())
 		}
+		return http.StatusOK, resp
 	}
-	// any blocks that are discarded will return to the pool
-	i := 0
-	for ; i < len(m.blockChain); i++ {
-		if !bytes.Equal(blockchain.Hash(m.blockChain[i].Header), blockchain.Hash(newChain[i].Header)) {
-			break
-		}
+	return http.StatusNotFound, map[string]string{"error": "no block in the locator is on the blockchain"}
+}
+
+// blocksHandler - handles /blocks request from a peer miner
+// returns the blocks with the given header hashes, in the same order
+func (m *Miner) blocksHandler(hashes [][]byte) (int, any) {
+	if len(hashes) > MaxBlocksPerRequest {
+		return http.StatusBadRequest, map[string]string{"error": "too many blocks requested"}
 	}
-	// blocks from i to the end are discarded
-	for ; i < len(m.blockChain); i++ {
-		for _, post := range m.blockChain[i].Posts {
-			if !posts.Contains(post) {
-				pool.Add(post)
-			}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	resp := BlocksJson{Blocks: make([]blockchain.BlockBase64, 0, len(hashes))}
+	for _, hash := range hashes {
+		height, ok := m.heights[string(hash)]
+		if !ok {
+			return http.StatusNotFound, map[string]string{"error": "block is not on the blockchain"}
 		}
+		resp.Blocks = append(resp.Blocks, m.blockChain[height].EncodeBase64())
+	}
+	return http.StatusOK, resp
+}
+
+// announceHandler - handles /announce request from a peer miner
+// if the announced block at height is not on this miner's blockchain, fetches the missing headers up to height and the
+// blocks from the peer, and switches to its blockchain if it is valid and preferred (see syncFrom)
+func (m *Miner) announceHandler(peer string, height int, header blockchain.BlockHeader) (int, any) {
+	// reject bogus announcements before asking the peer for anything
+	if err := header.Validate(); err != nil {
+		m.punish(peer, err)
+		return http.StatusBadRequest, map[string]string{"error": err.Error()}
+	}
+	hash := blockchain.Hash(header)
+	m.lock.RLock()
+	_, known := m.heights[string(hash)]
+	m.lock.RUnlock()
+	if known {
+		return http.StatusOK, nil
+	}
+	if err := m.syncFrom(peer, height); err != nil {
+		log.Printf("%d: Failed to sync with peer %s: %s\n", m.config.Port, peer, err.Error())
+		m.punish(peer, err)
+		return http.StatusBadRequest, map[string]string{"error": err.Error()}
+	}
+	return http.StatusOK, nil
+}
+
+// broadcastHandler - handles /broadcast request from the peer at address peer that pushes its whole blockchain
+// if the incoming blockchain is valid (see blockchain.Chain.Validate) and preferred over this miner's blockchain by blockchain.CompareChains,
+// switch to the new blockchain
+// miners themselves only announce new headers (see announceHandler), but a peer may still push a whole blockchain
+func (m *Miner) broadcastHandler(peer string, newChain []blockchain.Block) (int, any) {
+	// the blocks shared with my blockchain are already validated
+	if err := m.adoptChain(newChain); err != nil {
+		log.Printf("%d: Rejected a broadcast from peer %s: %s\n", m.config.Port, peer, err.Error())
+		m.punish(peer, err)
+		return http.StatusBadRequest, map[string]string{"error": err.Error()}
 	}
-	// update everything
-	m.blockChain = newChain
-	m.posts = posts
-	m.pool = pool
-	log.Printf("%d: Accepted a broadcast, chain length %d\n", m.port, len(m.blockChain))
 	return http.StatusOK, nil
 }
@@ -2,15 +2,17 @@ package miner
 
 import (
 	"blockchain/blockchain"
-	"bytes"
+	"blockchain/store"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/emirpasic/gods/sets/treeset"
 	"github.com/emirpasic/gods/utils"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -21,55 +23,299 @@ type PostsJson struct {
 
 type BlockChainJson struct {
 	Blockchain []blockchain.BlockBase64 `json:"blockchain"`
+	Start      int                      `json:"start,omitempty"`  // height of the first block, for a page of /read
+	Length     int                      `json:"length,omitempty"` // length of the whole blockchain, for a page of /read
+}
+
+type BlockJson struct {
+	Hash   string                 `json:"hash"`
+	Height int                    `json:"height"`
+	Block  blockchain.BlockBase64 `json:"block"`
+}
+
+type HeaderJson struct {
+	Hash   string                       `json:"hash"`
+	Height int                          `json:"height"`
+	Header blockchain.BlockHeaderBase64 `json:"header"`
+}
+
+type HeaderRangeJson struct {
+	Headers []HeaderJson `json:"headers"`
+}
+
+type BlockPostsJson struct {
+	Hash   string                  `json:"hash"`
+	Height int                     `json:"height"`
+	Posts  []blockchain.PostBase64 `json:"posts"`
+}
+
+type BlocksJson struct {
+	Blocks []blockchain.BlockBase64 `json:"blocks"`
+}
+
+type HeadersJson struct {
+	Start   int                            `json:"start"`
+	Headers []blockchain.BlockHeaderBase64 `json:"headers"`
+}
+
+type AnnounceJson struct {
+	Port    int                          `json:"port"`    // port of the announcing miner, for peers that only know ports
+	Address string                       `json:"address"` // address of the announcing miner, see Config.Address
+	Height  int                          `json:"height"`
+	Header  blockchain.BlockHeaderBase64 `json:"header"`
+}
+
+type PostIDJson struct {
+	ID string `json:"id"`
+}
+
+type PostJson struct {
+	Post          blockchain.PostBase64 `json:"post"`
+	Height        int                   `json:"height"`
+	Confirmations int                   `json:"confirmations"`
+}
+
+type ProofJson struct {
+	Height int                          `json:"height"`
+	Header blockchain.BlockHeaderBase64 `json:"header"`
+	Proof  blockchain.MerkleProofBase64 `json:"proof"`
 }
 
 // Miner - a Miner in the blockchain system.
 type Miner struct {
-	blockChain  []blockchain.Block // current blockchain
-	cmp         utils.Comparator   // comparator for posts and pool
-	posts       *treeset.Set       // all posts on the current blockchain, sorted by timestamp
-	pool        *treeset.Set       // posts to be posted to the blockchain
-	port        int                // http port
-	trackerPort int                // tracker's http port
-	router      *gin.Engine        // http router
-	server      *http.Server       // http server
-	lock        sync.RWMutex       // protects all writable fields
-	quit        chan struct{}      // notify the background routine to quit
-}
-
-// NewMiner - creates a new Miner, but does not start its http server and background routine yet.
-func NewMiner(port int, trackerPort int) *Miner {
+	config     Config                  // settings, see Config
+	params     *blockchain.ChainParams // consensus parameters of the network
+	blockChain []blockchain.Block      // current blockchain, starting from the genesis block
+	heights    map[string]int          // maps the header hash of every block on blockChain to its height, see indexBlocks
+	posts      map[string]int          // maps the ID of every post on blockChain to the height of its block
+	cmp        utils.Comparator        // comparator for posts and pool, see blockchain.ComparePosts
+	pool       *Pool                   // posts to be posted to the blockchain
+	router     *gin.Engine             // http router
+	server     *http.Server            // http server
+	lock       sync.RWMutex            // protects all writable fields
+	quit       chan struct{}           // notify the background routine to quit
+	store      *store.Store            // persistent storage of blockChain, pool and book, or nil to keep them in memory only
+	tipChange  chan struct{}           // closed when the tip of blockChain changes, then replaced, see newTip
+	key        blockchain.Signer       // node key, which signs the requests to the tracker and to peers
+	book       *AddressBook            // known peers with their node keys, see authenticate
+	neighbors  []string                // addresses of the peers that the miner syncs with, see discover
+	peers      *PeerManager            // scores and bans of misbehaving peers
+	client     *http.Client            // http client for requests to peers and the tracker
+
+	refreshLock sync.Mutex // held while node keys are fetched for an unknown peer, see refreshPeerKeys
+	lastRefresh time.Time  // when node keys were last fetched for an unknown peer, protected by refreshLock
+}
+
+// NewMiner - creates a new Miner on the main network that registers to the trackers on trackerPorts, but does not start
+// its http server and background routine yet.
+func NewMiner(port int, trackerPorts ...int) *Miner {
+	config := localConfig(port, trackerPorts...)
+	return newMiner(config, blockchain.DefaultChainParams(), blockchain.GenerateKey(blockchain.Ed25519))
+}
+
+// NewMinerWithParams - creates a new Miner on the network of params that registers to the trackers on trackerPorts, but
+// does not start its http server and background routine yet. Returns an error if params are invalid, see
+// blockchain.ChainParams.Validate.
+func NewMinerWithParams(port int, params *blockchain.ChainParams, trackerPorts ...int) (*Miner, error) {
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain params: %w", err)
+	}
+	return newMiner(localConfig(port, trackerPorts...), params, blockchain.GenerateKey(blockchain.Ed25519)), nil
+}
+
+// NewMinerWithStore - creates a new Miner on the network of params that keeps its blockchain, pool and node key in the
+// store in dir, but does not start its http server and background routine yet.
+// The stored blockchain and pool are reloaded and validated again. A stored block that is no longer valid is discarded
+// together with all blocks after it, and so is a stored post that is invalid or already on the blockchain.
+// Returns an error if params are invalid, or the store or the node key cannot be opened.
+func NewMinerWithStore(port int, trackerPort int, params *blockchain.ChainParams, dir string) (*Miner, error) {
+	config := localConfig(port, trackerPort)
+	config.StoreDir = dir
+	return newMinerWithStore(config, params)
+}
+
+// NewMinerWithConfig - creates a new Miner with the given settings, but does not start its http server and background
+// routine yet. Returns an error if the settings are invalid, or the store or the node key cannot be opened (see
+// NewMinerWithStore and nodeKey).
+func NewMinerWithConfig(config Config) (*Miner, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	params := blockchain.NewChainParams(config.ChainID)
+	if config.StoreDir == "" {
+		key, err := nodeKey(config)
+		if err != nil {
+			return nil, err
+		}
+		return newMiner(config, params, key), nil
+	}
+	return newMinerWithStore(config, params)
+}
+
+// localConfig - the default settings, with the miner and the trackers on the given ports of localhost.
+func localConfig(port int, trackerPorts ...int) Config {
+	config := DefaultConfig()
+	config.Port = port
+	config.Tracker = ""
+	for _, trackerPort := range trackerPorts {
+		address := net.JoinHostPort("localhost", strconv.Itoa(trackerPort))
+		if config.Tracker == "" {
+			config.Tracker = address
+		} else {
+			config.Trackers = append(config.Trackers, address)
+		}
+	}
+	return config
+}
+
+// newMiner - creates a new Miner with the node key key that keeps everything in memory.
+func newMiner(config Config, params *blockchain.ChainParams, key blockchain.Signer) *Miner {
 	miner := &Miner{
-		router:      gin.New(),
-		port:        port,
-		trackerPort: trackerPort,
-		quit:        make(chan struct{}),
+		config:     config,
+		params:     params,
+		blockChain: []blockchain.Block{params.Genesis},
+		router:     gin.New(),
+		quit:       make(chan struct{}),
+		tipChange:  make(chan struct{}),
+		key:        key,
+		book:       NewAddressBook(config.PeerExpiry),
+		peers:      NewPeerManager(config.BanThreshold, config.BanDuration),
+		client:     &http.Client{Timeout: config.PeerTimeout},
 	}
 	miner.cmp = func(a, b any) int {
 		post1 := a.(blockchain.Post)
 		post2 := b.(blockchain.Post)
-		if post1.Body.Timestamp != post2.Body.Timestamp {
-			if post1.Body.Timestamp < post2.Body.Timestamp {
-				return -1
-			} else {
-				return 1
-			}
-		}
-		key1 := blockchain.PublicKeyToBytes(post1.User)
-		key2 := blockchain.PublicKeyToBytes(post2.User)
-		return bytes.Compare(key1, key2)
+		return blockchain.ComparePosts(&post1, &post2)
 	}
-	miner.posts = treeset.NewWith(miner.cmp)
-	miner.pool = treeset.NewWith(miner.cmp)
+	miner.heights = make(map[string]int)
+	miner.posts = make(map[string]int)
+	miner.indexBlocks(0)
+	miner.pool = NewPool(miner.cmp, config.PoolMaxPosts, config.PoolMaxBytes, config.PoolTTL)
 
 	miner.registerAPIs()
 	miner.server = &http.Server{
-		Addr:    fmt.Sprintf("localhost:%d", port),
+		Addr:    net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
 		Handler: miner.router,
 	}
 	return miner
 }
 
+// newMinerWithStore - creates a new Miner that keeps its blockchain and pool in the store in config.StoreDir, and its
+// node key there too unless config.NodeKey says otherwise.
+func newMinerWithStore(config Config, params *blockchain.ChainParams) (*Miner, error) {
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain params: %w", err)
+	}
+	s, blocks, err := store.Open(config.StoreDir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := nodeKey(config)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	miner := newMiner(config, params, key)
+	if err := miner.restore(s, blocks); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return miner, nil
+}
+
+// restore - validates the blocks and the pool read from s, and makes them the Miner's state.
+func (m *Miner) restore(s *store.Store, blocks []blockchain.Block) error {
+	if err := blockchain.Chain(blocks).Validate(m.params); err != nil {
+		var validationError *blockchain.ValidationError
+		if !errors.As(err, &validationError) || validationError.Height == 0 {
+			return fmt.Errorf("store does not hold a blockchain of this network: %w", err)
+		}
+		log.Printf("%d: Discarded stored blocks: %s\n", m.config.Port, err.Error())
+		blocks = blocks[:validationError.Height]
+		if err := s.Truncate(validationError.Height); err != nil {
+			return err
+		}
+	}
+	if len(blocks) == 0 {
+		// a new store
+		blocks = []blockchain.Block{m.params.Genesis}
+		if err := s.Append(m.params.Genesis); err != nil {
+			return err
+		}
+	}
+	m.unindexBlocks(0)
+	m.blockChain = blocks
+	m.indexBlocks(0)
+	posts, err := s.LoadPool()
+	if err != nil {
+		return err
+	}
+	peers, err := s.LoadPeers()
+	if err != nil {
+		return err
+	}
+	m.book.Restore(peers)
+	now := time.Now()
+	for _, post := range posts {
+		if post.Validate(m.params) != nil || m.onChain(post) {
+			continue
+		}
+		// expired posts and posts beyond the limits are dropped
+		_ = m.pool.Add(post, now)
+	}
+	m.store = s
+	log.Printf("%d: Restored a blockchain of length %d, %d pending posts and %d known peers\n", m.config.Port,
+		len(m.blockChain), m.pool.Size(), len(peers))
+	return nil
+}
+
+// persist - writes the blocks from height on and the pool to the store, replacing the stored blocks from height on.
+// Does nothing if the Miner has no store. The caller must hold the lock.
+func (m *Miner) persist(height int) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.Truncate(height); err != nil {
+		log.Printf("%d: Failed to store blocks: %s\n", m.config.Port, err.Error())
+		return
+	}
+	if err := m.store.Append(m.blockChain[height:]...); err != nil {
+		log.Printf("%d: Failed to store blocks: %s\n", m.config.Port, err.Error())
+		return
+	}
+	m.persistPool()
+}
+
+// persistPool - writes the pool to the store. Does nothing if the Miner has no store. The caller must hold the lock.
+func (m *Miner) persistPool() {
+	if m.store == nil {
+		return
+	}
+	posts := make([]blockchain.Post, 0, m.pool.Size())
+	iter := m.pool.Iterator()
+	for iter.Next() {
+		posts = append(posts, iter.Value().(blockchain.Post))
+	}
+	if err := m.store.SavePool(posts); err != nil {
+		log.Printf("%d: Failed to store the pool: %s\n", m.config.Port, err.Error())
+	}
+}
+
+// persistPeers - writes the address book to the store. Does nothing if the Miner has no store.
+func (m *Miner) persistPeers() {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.SavePeers(m.book.Entries(time.Now())); err != nil {
+		log.Printf("%d: Failed to store the address book: %s\n", m.config.Port, err.Error())
+	}
+}
+
+// NodeKey - the public node key of the Miner, which it registers to the tracker.
+func (m *Miner) NodeKey() blockchain.PublicKey {
+	return m.key.Public()
+}
+
 // Start - starts the Miner's background routine and http server.
 func (m *Miner) Start() {
 	go func() {
@@ -97,13 +343,84 @@ func (m *Miner) Shutdown() {
 	default:
 		break
 	}
+	// finally flush the pool and close the store
+	if m.store != nil {
+		m.lock.Lock()
+		m.persistPool()
+		m.lock.Unlock()
+		m.persistPeers()
+		if err := m.store.Close(); err != nil {
+			log.Println("error when closing store: ", err)
+		}
+	}
 }
 
 // registerAPIs - register APIs to the Miner's http router.
 func (m *Miner) registerAPIs() {
 	// register APIs
 	m.router.GET("/read", func(ctx *gin.Context) {
-		statusCode, response := m.readHandler()
+		if ctx.Query("start") == "" && ctx.Query("count") == "" {
+			statusCode, response := m.readHandler()
+			ctx.JSON(statusCode, response)
+			return
+		}
+		start, err1 := strconv.Atoi(ctx.DefaultQuery("start", "0"))
+		count, err2 := strconv.Atoi(ctx.DefaultQuery("count", strconv.Itoa(MaxBlocksPerPage)))
+		if err1 != nil || err2 != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "page has invalid start or count"})
+			return
+		}
+		statusCode, response := m.readPageHandler(start, count)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/tip", func(ctx *gin.Context) {
+		statusCode, response := m.tipHandler()
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/block/height/:height", func(ctx *gin.Context) {
+		height, err := strconv.Atoi(ctx.Param("height"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "block height is not a number"})
+			return
+		}
+		statusCode, response := m.blockByHeightHandler(height)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/block/height/:height/posts", func(ctx *gin.Context) {
+		height, err := strconv.Atoi(ctx.Param("height"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "block height is not a number"})
+			return
+		}
+		statusCode, response := m.blockPostsByHeightHandler(height)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/block/hash/:hash", func(ctx *gin.Context) {
+		hash, err := hex.DecodeString(ctx.Param("hash"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "block hash has invalid hex string"})
+			return
+		}
+		statusCode, response := m.blockByHashHandler(hash)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/block/hash/:hash/posts", func(ctx *gin.Context) {
+		hash, err := hex.DecodeString(ctx.Param("hash"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "block hash has invalid hex string"})
+			return
+		}
+		statusCode, response := m.blockPostsByHashHandler(hash)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/headers/range", func(ctx *gin.Context) {
+		start, err1 := strconv.Atoi(ctx.Query("start"))
+		end, err2 := strconv.Atoi(ctx.Query("end"))
+		if err1 != nil || err2 != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "range has invalid start or end"})
+			return
+		}
+		statusCode, response := m.headerRangeHandler(start, end)
 		ctx.JSON(statusCode, response)
 	})
 	m.router.POST("/write", func(ctx *gin.Context) {
@@ -120,7 +437,25 @@ func (m *Miner) registerAPIs() {
 		statusCode, response := m.writeHandler(post)
 		ctx.JSON(statusCode, response)
 	})
-	m.router.POST("/sync", func(ctx *gin.Context) {
+	m.router.GET("/post/:id", func(ctx *gin.Context) {
+		id, err := hex.DecodeString(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "post id has invalid hex string"})
+			return
+		}
+		statusCode, response := m.postHandler(id)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/proof/:hash", func(ctx *gin.Context) {
+		hash, err := hex.DecodeString(ctx.Param("hash"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "post hash has invalid hex string"})
+			return
+		}
+		statusCode, response := m.proofHandler(hash)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.POST("/sync", m.authenticate, func(ctx *gin.Context) {
 		var request PostsJson
 		if err := ctx.BindJSON(&request); err != nil {
 			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
@@ -135,10 +470,72 @@ func (m *Miner) registerAPIs() {
 			}
 			posts = append(posts, post)
 		}
-		statusCode, response := m.syncHandler(posts)
+		statusCode, response := m.syncHandler(ctx.GetString(peerContextKey), posts)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/pool", func(ctx *gin.Context) {
+		statusCode, response := m.poolHandler()
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/peers", func(ctx *gin.Context) {
+		statusCode, response := m.peersHandler()
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/handshake", func(ctx *gin.Context) {
+		nonce, err := hex.DecodeString(ctx.Query("nonce"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "nonce has invalid hex string"})
+			return
+		}
+		statusCode, response := m.handshakeHandler(nonce)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.POST("/peers", m.authenticate, func(ctx *gin.Context) {
+		var request KnownPeersJson
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
+			return
+		}
+		statusCode, response := m.exchangeHandler(ctx.GetString(peerContextKey), request.Peers)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/headers", func(ctx *gin.Context) {
+		locator, err := parseHashes(ctx.Query("from"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "locator has invalid hex string"})
+			return
+		}
+		statusCode, response := m.headersHandler(locator)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/blocks", func(ctx *gin.Context) {
+		hashes, err := parseHashes(ctx.Query("hashes"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "block hashes have invalid hex string"})
+			return
+		}
+		statusCode, response := m.blocksHandler(hashes)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.POST("/announce", m.authenticate, func(ctx *gin.Context) {
+		var request AnnounceJson
+		if err := ctx.BindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
+			return
+		}
+		if request.Address != ctx.GetString(peerContextKey) {
+			ctx.JSON(http.StatusUnauthorized, map[string]string{"error": "request is signed by another peer"})
+			return
+		}
+		header, err := request.Header.DecodeBase64()
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "header has invalid base64 string"})
+			return
+		}
+		statusCode, response := m.announceHandler(request.Address, request.Height, header)
 		ctx.JSON(statusCode, response)
 	})
-	m.router.POST("/broadcast", func(ctx *gin.Context) {
+	m.router.POST("/broadcast", m.authenticate, func(ctx *gin.Context) {
 		var request BlockChainJson
 		if err := ctx.BindJSON(&request); err != nil {
 			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
@@ -153,7 +550,7 @@ func (m *Miner) registerAPIs() {
 			}
 			chain = append(chain, block)
 		}
-		statusCode, response := m.broadcastHandler(chain)
+		statusCode, response := m.broadcastHandler(ctx.GetString(peerContextKey), chain)
 		ctx.JSON(statusCode, response)
 	})
 }
@@ -0,0 +1,195 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrBadResponse - A peer answers a request with something that is not a valid answer to it.
+var ErrBadResponse = errors.New("peer sends an invalid response")
+
+// Offense - A kind of misbehavior of a peer, see PeerManager.
+type Offense int
+
+const (
+	BadProofOfWork   Offense = iota // a header that does not meet its difficulty, or declares a wrong one
+	BrokenLink                      // a block that does not link to the previous block, or a foreign genesis block
+	InvalidSignature                // a post with an invalid signature
+	OversizedPayload                // a block, post or peer exchange beyond the limits of the network
+	Timeout                         // no answer within Config.PeerTimeout
+	InvalidData                     // anything else that breaks the rules of the network or the protocol
+)
+
+// offenseNames - the name of each Offense, as listed by the /peers API.
+var offenseNames = [...]string{"bad-pow", "broken-link", "invalid-signature", "oversized-payload", "timeout", "invalid-data"}
+
+// offensePenalties - the score of each Offense. Offenses that cost the receiver work, or can only be on purpose, weigh
+// the most, while a timeout may just be a slow network.
+var offensePenalties = [...]int{50, 50, 100, 25, 10, 25}
+
+func (o Offense) String() string {
+	return offenseNames[o]
+}
+
+// OffenseOf - the offense that a peer commits by sending data that fails with err, or false if err is no fault of the
+// peer: it is nil, a refused connection, or a block timestamp that may just be ahead because of clock drift.
+func OffenseOf(err error) (Offense, bool) {
+	var netErr net.Error
+	switch {
+	case err == nil || errors.Is(err, blockchain.ErrTimeTooNew):
+		return 0, false
+	case errors.Is(err, blockchain.ErrBadPoW) || errors.Is(err, blockchain.ErrBadDifficulty):
+		return BadProofOfWork, true
+	case errors.Is(err, blockchain.ErrBrokenLink) || errors.Is(err, blockchain.ErrBadGenesis):
+		return BrokenLink, true
+	case errors.Is(err, blockchain.ErrBadSignature):
+		return InvalidSignature, true
+	case errors.Is(err, blockchain.ErrTooManyPosts) || errors.Is(err, blockchain.ErrBlockTooLarge) ||
+		errors.Is(err, blockchain.ErrContentTooLong) || errors.Is(err, blockchain.ErrPostTooLarge) ||
+		errors.Is(err, ErrTooManyPeers) || errors.Is(err, ErrTooManyHeaders):
+		return OversizedPayload, true
+	case errors.As(err, &netErr):
+		return Timeout, netErr.Timeout()
+	case errors.Is(err, ErrBadResponse) || errors.As(err, new(*blockchain.ValidationError)) ||
+		errors.Is(err, blockchain.ErrWrongChain):
+		return InvalidData, true
+	default:
+		return 0, false
+	}
+}
+
+// PeerManager - Scores peers by their offenses, and bans those that offend too much.
+//
+// Every offense adds its penalty to the peer's score. Once the score reaches threshold, the peer is banned for
+// banDuration: its requests are refused and nothing is sent to it. Scores decay steadily, by threshold every
+// banDuration, so that rare honest faults such as timeouts never add up to a ban, and a ban starts over from zero.
+// PeerManager is safe for concurrent use.
+type PeerManager struct {
+	lock        sync.Mutex
+	threshold   int                    // a peer is banned when its score reaches threshold
+	banDuration time.Duration          // how long a ban lasts
+	peers       map[string]*peerRecord // maps the address of each peer that ever offended to its record
+}
+
+// peerRecord - What a PeerManager knows about one peer.
+type peerRecord struct {
+	score       float64         // score at updated, see scoreAt
+	updated     time.Time       // when the last offense was scored
+	offenses    map[Offense]int // number of offenses of each kind so far
+	bans        int             // number of bans so far
+	bannedUntil time.Time       // the end of the current or last ban
+}
+
+// PeerJson - One peer in the response of the /peers API. BanLeft is in milliseconds, 0 if the peer is not banned.
+type PeerJson struct {
+	Address  string         `json:"address"`
+	Score    int            `json:"score"`
+	Offenses map[string]int `json:"offenses"`
+	Bans     int            `json:"bans"`
+	BanLeft  int64          `json:"ban-left-ms"`
+}
+
+// PeersJson - Response of the GET /peers API, with every peer that ever offended, sorted by address, and the peers in
+// the address book. BanDuration is in milliseconds.
+type PeersJson struct {
+	Threshold   int             `json:"threshold"`
+	BanDuration int64           `json:"ban-duration-ms"`
+	Peers       []PeerJson      `json:"peers"`
+	Known       []KnownPeerJson `json:"known,omitempty"`
+}
+
+// NewPeerManager - creates a PeerManager that bans a peer for banDuration once its score reaches threshold.
+func NewPeerManager(threshold int, banDuration time.Duration) *PeerManager {
+	return &PeerManager{
+		threshold:   threshold,
+		banDuration: banDuration,
+		peers:       make(map[string]*peerRecord),
+	}
+}
+
+// scoreAt - the score of record decayed until now.
+func (p *PeerManager) scoreAt(record *peerRecord, now time.Time) float64 {
+	elapsed := max(0, now.Sub(record.updated))
+	return max(0, record.score-float64(p.threshold)*elapsed.Seconds()/p.banDuration.Seconds())
+}
+
+// Punish - records an offense of the peer at address at now. Returns true if the peer gets banned for it. Offenses of a
+// peer that is banned already are ignored.
+func (p *PeerManager) Punish(address string, offense Offense, now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	record, ok := p.peers[address]
+	if !ok {
+		record = &peerRecord{updated: now, offenses: make(map[Offense]int)}
+		p.peers[address] = record
+	}
+	if now.Before(record.bannedUntil) {
+		return false
+	}
+	record.offenses[offense]++
+	record.score = p.scoreAt(record, now) + float64(offensePenalties[offense])
+	record.updated = now
+	if record.score < float64(p.threshold) {
+		return false
+	}
+	record.score = 0
+	record.bans++
+	record.bannedUntil = now.Add(p.banDuration)
+	return true
+}
+
+// Banned - whether the peer at address is banned at now.
+func (p *PeerManager) Banned(address string, now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	record, ok := p.peers[address]
+	return ok && now.Before(record.bannedUntil)
+}
+
+// Allowed - the addresses of peers that are not banned at now.
+func (p *PeerManager) Allowed(addresses []string, now time.Time) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	allowed := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if record, ok := p.peers[address]; !ok || !now.Before(record.bannedUntil) {
+			allowed = append(allowed, address)
+		}
+	}
+	return allowed
+}
+
+// Stats - the scores and bans of all peers that ever offended, at now.
+func (p *PeerManager) Stats(now time.Time) PeersJson {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := PeersJson{
+		Threshold:   p.threshold,
+		BanDuration: p.banDuration.Milliseconds(),
+		Peers:       make([]PeerJson, 0, len(p.peers)),
+	}
+	for address, record := range p.peers {
+		peer := PeerJson{
+			Address:  address,
+			Score:    int(math.Ceil(p.scoreAt(record, now))),
+			Offenses: make(map[string]int),
+			Bans:     record.bans,
+		}
+		for offense, count := range record.offenses {
+			peer.Offenses[offense.String()] = count
+		}
+		if now.Before(record.bannedUntil) {
+			peer.BanLeft = record.bannedUntil.Sub(now).Milliseconds()
+		}
+		stats.Peers = append(stats.Peers, peer)
+	}
+	sort.Slice(stats.Peers, func(i, j int) bool {
+		return stats.Peers[i].Address < stats.Peers[j].Address
+	})
+	return stats
+}
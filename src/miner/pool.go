@@ -0,0 +1,213 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"errors"
+	"github.com/emirpasic/gods/sets/treeset"
+	"github.com/emirpasic/gods/utils"
+	"strings"
+	"time"
+)
+
+// ErrPoolFull - The pool has no room for a post, see Pool.
+var ErrPoolFull = errors.New("pool is full")
+
+// ErrPostExpired - A post is older than the pool's TTL.
+var ErrPostExpired = errors.New("post is older than the pool's TTL")
+
+// ErrPostTooNew - A post is dated more than blockchain.MaxFutureDrift past the local time.
+var ErrPostTooNew = errors.New("post is dated too far in the future")
+
+// Pool - The posts waiting to be mined, sorted by blockchain.ComparePosts, so that the oldest posts are mined first.
+//
+// The pool holds at most maxPosts posts and maxBytes bytes, measured as the canonical encoding of each post, drops
+// posts whose timestamp is older than ttl, and turns away posts dated more than blockchain.MaxFutureDrift ahead. When
+// the pool is full, a new post only gets in by evicting posts that arrived after it, by the local time of their
+// arrival and not by the timestamps that their senders chose, so a flood of new posts is turned away instead of pushing
+// out the posts that were already waiting, however old or new it claims to be. Pool is not safe for concurrent use.
+type Pool struct {
+	cmp      utils.Comparator    // comparator of posts, see blockchain.ComparePosts
+	posts    *treeset.Set        // the posts, sorted by cmp
+	arrivals *treeset.Set        // the arrivals of the posts, sorted by compareArrivals
+	byID     map[string]*arrival // maps the ID of every post to its arrival
+	bytes    int                 // total size of posts
+	maxPosts int                 // at most maxPosts posts
+	maxBytes int                 // at most maxBytes bytes
+	ttl      time.Duration       // posts older than ttl are dropped
+
+	evicted  int // number of posts evicted to make room for ones that arrived earlier so far
+	expired  int // number of posts dropped for their age so far
+	rejected int // number of posts turned away so far, because they are too old or there is no room
+}
+
+// PoolStatsJson - Response of the /pool API. Ages and the TTL are in milliseconds.
+type PoolStatsJson struct {
+	Posts     int   `json:"posts"`
+	Bytes     int   `json:"bytes"`
+	MaxPosts  int   `json:"max-posts"`
+	MaxBytes  int   `json:"max-bytes"`
+	TTL       int64 `json:"ttl-ms"`
+	OldestAge int64 `json:"oldest-age-ms"` // age of the oldest post by its timestamp, 0 if the pool is empty
+	Evicted   int   `json:"evicted"`
+	Expired   int   `json:"expired"`
+	Rejected  int   `json:"rejected"`
+}
+
+// arrival - A post in the pool, and the local time it arrived at.
+type arrival struct {
+	at   time.Time
+	id   string
+	post blockchain.Post
+}
+
+// compareArrivals - orders arrivals by the time they arrived at, and arrivals at the same time by post ID.
+func compareArrivals(a, b any) int {
+	x, y := a.(*arrival), b.(*arrival)
+	if cmp := x.at.Compare(y.at); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(x.id, y.id)
+}
+
+// NewPool - creates an empty pool with the given limits, whose posts are sorted by cmp.
+func NewPool(cmp utils.Comparator, maxPosts int, maxBytes int, ttl time.Duration) *Pool {
+	return &Pool{
+		cmp:      cmp,
+		posts:    treeset.NewWith(cmp),
+		arrivals: treeset.NewWith(compareArrivals),
+		byID:     make(map[string]*arrival),
+		maxPosts: maxPosts,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+	}
+}
+
+// postSize - the size of a post in the pool.
+func postSize(post *blockchain.Post) int {
+	return len(blockchain.Encode(post))
+}
+
+// isExpired - whether the post's timestamp is older than the TTL at now.
+func (p *Pool) isExpired(post *blockchain.Post, now time.Time) bool {
+	return now.UnixNano()-post.Body.Timestamp > p.ttl.Nanoseconds()
+}
+
+// Add - adds a post that is not in the pool yet and arrives at now, evicting the posts that arrived after it, the last
+// one first, if there is no room for it.
+// Returns ErrPostExpired if the post is older than the TTL at now, ErrPostTooNew if it is dated more than
+// blockchain.MaxFutureDrift past now, or ErrPoolFull if there is no room even after evicting every post that arrived
+// after it. Adding a post that is already in the pool does nothing.
+func (p *Pool) Add(post blockchain.Post, now time.Time) error {
+	if p.posts.Contains(post) {
+		return nil
+	}
+	if p.isExpired(&post, now) {
+		p.rejected++
+		return ErrPostExpired
+	}
+	if post.Body.Timestamp > now.UnixNano()+blockchain.MaxFutureDrift {
+		p.rejected++
+		return ErrPostTooNew
+	}
+	// find the last arrivals to evict before changing anything
+	size := postSize(&post)
+	count, bytes := p.posts.Size()+1, p.bytes+size
+	victims := make([]blockchain.Post, 0)
+	iter := p.arrivals.Iterator()
+	iter.End()
+	for count > p.maxPosts || bytes > p.maxBytes {
+		if !iter.Prev() || !iter.Value().(*arrival).at.After(now) {
+			// only posts that arrived before it are left, which stay
+			p.rejected++
+			return ErrPoolFull
+		}
+		victim := iter.Value().(*arrival).post
+		victims = append(victims, victim)
+		count--
+		bytes -= postSize(&victim)
+	}
+	for _, victim := range victims {
+		p.Remove(victim)
+		p.evicted++
+	}
+	entry := &arrival{at: now, id: string(post.ID()), post: post}
+	p.posts.Add(post)
+	p.arrivals.Add(entry)
+	p.byID[entry.id] = entry
+	p.bytes += size
+	return nil
+}
+
+// Remove - removes a post from the pool, if it is there.
+func (p *Pool) Remove(post blockchain.Post) {
+	if p.posts.Contains(post) {
+		p.posts.Remove(post)
+		id := string(post.ID())
+		p.arrivals.Remove(p.byID[id])
+		delete(p.byID, id)
+		p.bytes -= postSize(&post)
+	}
+}
+
+// RemoveIf - removes every post for which drop returns true.
+func (p *Pool) RemoveIf(drop func(post blockchain.Post) bool) {
+	for _, value := range p.posts.Values() {
+		if post := value.(blockchain.Post); drop(post) {
+			p.Remove(post)
+		}
+	}
+}
+
+// Expire - drops every post older than the TTL at now, and returns how many were dropped.
+func (p *Pool) Expire(now time.Time) int {
+	expired := 0
+	p.RemoveIf(func(post blockchain.Post) bool {
+		if p.isExpired(&post, now) {
+			expired++
+			return true
+		}
+		return false
+	})
+	p.expired += expired
+	return expired
+}
+
+// Contains - whether the post is in the pool.
+func (p *Pool) Contains(post blockchain.Post) bool {
+	return p.posts.Contains(post)
+}
+
+// Iterator - iterates over the posts from the oldest to the newest.
+func (p *Pool) Iterator() treeset.Iterator {
+	return p.posts.Iterator()
+}
+
+// Size - the number of posts in the pool.
+func (p *Pool) Size() int {
+	return p.posts.Size()
+}
+
+// Bytes - the total size of the posts in the pool.
+func (p *Pool) Bytes() int {
+	return p.bytes
+}
+
+// Stats - the current size and limits of the pool, and what it has turned away so far.
+func (p *Pool) Stats(now time.Time) PoolStatsJson {
+	stats := PoolStatsJson{
+		Posts:    p.posts.Size(),
+		Bytes:    p.bytes,
+		MaxPosts: p.maxPosts,
+		MaxBytes: p.maxBytes,
+		TTL:      p.ttl.Milliseconds(),
+		Evicted:  p.evicted,
+		Expired:  p.expired,
+		Rejected: p.rejected,
+	}
+	iter := p.posts.Iterator()
+	if iter.First() {
+		oldest := iter.Value().(blockchain.Post)
+		stats.OldestAge = max(now.UnixNano()-oldest.Body.Timestamp, 0) / int64(time.Millisecond)
+	}
+	return stats
+}
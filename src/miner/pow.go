@@ -0,0 +1,57 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// StopCheckInterval - Mining workers check whether to stop every StopCheckInterval nonces.
+const StopCheckInterval = 1024
+
+// SearchNonce - searches for a nonce that makes header meet the difficulty it declares, with workers goroutines that
+// each try at most iterations nonces. Returns the mined header, or false if no nonce is found or stop returns true.
+//
+// Worker w owns the w-th of workers equal slices of the 32-bit nonce space. When it runs out of its slice, it bumps the
+// timestamp of its own copy of the header by one and starts its slice over, so no (timestamp, nonce) pair is tried
+// twice. Workers only share the header they start from, and stop as soon as one of them finds a nonce. stop is checked
+// every StopCheckInterval nonces, and may be nil.
+func SearchNonce(header blockchain.BlockHeader, workers int, iterations int, stop func() bool) (blockchain.BlockHeader, bool) {
+	workers = max(workers, 1)
+	sliceSize := (uint64(math.MaxUint32) + 1) / uint64(workers)
+	var found atomic.Bool
+	var result blockchain.BlockHeader
+	var once sync.Once
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			local := header
+			first := uint64(w) * sliceSize
+			next := first
+			for i := 0; i < iterations; i++ {
+				if i%StopCheckInterval == 0 && (found.Load() || (stop != nil && stop())) {
+					return
+				}
+				if next == first+sliceSize {
+					// my slice of the nonce space runs out
+					local.Timestamp++
+					next = first
+				}
+				local.Nonce = uint32(next)
+				next++
+				if blockchain.CheckPoW(blockchain.Hash(local), local.Bits) {
+					once.Do(func() {
+						result = local
+						found.Store(true)
+					})
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return result, found.Load()
+}
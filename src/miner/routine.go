@@ -2,9 +2,10 @@ package miner
 
 import (
 	"blockchain/blockchain"
+	"blockchain/peer"
 	"blockchain/tracker"
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -13,49 +14,42 @@ import (
 	"time"
 )
 
-// HeartbeatMin - Miner's heartbeat interval is randomly chosen from HeartbeatMin to HeartbeatMax.
-const HeartbeatMin = 200
-
-// HeartbeatMax - Miner's heartbeat interval is randomly chosen from HeartbeatMin to HeartbeatMax.
-const HeartbeatMax = 400
-
-// SyncMin - Miner's sync interval is randomly chosen from SyncMin to SyncMax.
-const SyncMin = 300
-
-// SyncMax - Miner's sync interval is randomly chosen from SyncMin to SyncMax.
-const SyncMax = 600
-
-// MiningIterations - Each call to mine() will try MiningIterations different nonces at most, before mine() returns.
-const MiningIterations = 10000
-
-// PostsPerBlock - Miner will pack at most PostsPerBlock posts to each block.
-const PostsPerBlock = 2
-
 // routine - A miner's background routine.
-// Responsible for sending heartbeats to the tracker, syncing with peers and mining.
-// In one loop, routine will check if it needs to send heartbeats or syncs with peers, and then call mine() once.
+// Responsible for syncing with peers and mining, while heartbeats go out from a goroutine of their own (see heartbeats).
+// In one loop, routine will check if it needs to exchange peers or sync with peers, and then call mine() once.
 func (m *Miner) routine() {
-	heartbeatInterval := time.Duration(HeartbeatMin+rand.Intn(HeartbeatMax-HeartbeatMin)) * time.Millisecond
-	syncInterval := time.Duration(SyncMin+rand.Intn(SyncMax-SyncMin)) * time.Millisecond
+	syncInterval := randomDuration(m.config.SyncMin, m.config.SyncMax)
 
 	// register to the tracker immediately
-	peers := m.register()
+	m.discover()
+	stopHeartbeats := make(chan struct{})
+	heartbeatsDone := make(chan struct{})
+	go m.heartbeats(stopHeartbeats, heartbeatsDone)
 	// set up timers
-	heartbeatTimer := time.NewTimer(heartbeatInterval)
 	syncTimer := time.NewTimer(syncInterval)
+	exchangeTimer := time.NewTimer(m.config.PeerExchange)
 
 loop:
 	for {
+		peers := m.currentNeighbors()
 	timerLoop:
 		for {
 			select {
-			case <-heartbeatTimer.C:
-				// send heartbeat to tracker
-				peers = m.register()
-				heartbeatTimer.Reset(heartbeatInterval)
+			case <-exchangeTimer.C:
+				// exchange known peers with a random peer
+				if allowed := m.peers.Allowed(peers, time.Now()); len(allowed) > 0 {
+					m.exchangeWith(allowed[rand.Intn(len(allowed))])
+				}
+				exchangeTimer.Reset(m.config.PeerExchange)
 			case <-syncTimer.C:
 				// sync my pool with all peers, if I have at least one post
 				request := PostsJson{}
+				// drop expired posts first
+				m.lock.Lock()
+				if expired := m.pool.Expire(time.Now()); expired > 0 {
+					log.Printf("%d: Dropped %d expired posts from pool\n", m.config.Port, expired)
+				}
+				m.lock.Unlock()
 				// gather all posts to send
 				m.lock.RLock()
 				iter := m.pool.Iterator()
@@ -63,7 +57,10 @@ loop:
 					post := iter.Value().(blockchain.Post)
 					request.Posts = append(request.Posts, post.EncodeBase64())
 				}
+				// also take this chance to store the pool and the address book
+				m.persistPool()
 				m.lock.RUnlock()
+				m.persistPeers()
 				if len(request.Posts) == 0 {
 					// no need to sync empty requests
 					syncTimer.Reset(syncInterval)
@@ -74,8 +71,8 @@ loop:
 					log.Fatalf("failed to encode sync request")
 				}
 				wg := sync.WaitGroup{}
-				// sync in parallel
-				for _, peer := range peers {
+				// sync in parallel, except with banned peers
+				for _, peer := range m.peers.Allowed(peers, time.Now()) {
 					peer := peer
 					wg.Add(1)
 					go m.syncWith(peer, reqBytes, &wg)
@@ -91,74 +88,218 @@ loop:
 		// mine
 		m.mine(peers)
 	}
-	// stop all timers
-	if !heartbeatTimer.Stop() {
-		<-heartbeatTimer.C
-	}
+	// stop heartbeats and all timers
+	close(stopHeartbeats)
+	<-heartbeatsDone
 	if !syncTimer.Stop() {
 		<-syncTimer.C
 	}
+	if !exchangeTimer.Stop() {
+		<-exchangeTimer.C
+	}
 	m.quit <- struct{}{}
 }
 
-// register - register this miner to the tracker. Also responsible for sending heartbeats to the tracker.
-func (m *Miner) register() []int {
-	request := tracker.PortJson{Port: m.port}
+// heartbeats - sends heartbeats to the trackers until stop is closed, and then closes done. Heartbeats have a goroutine
+// of their own, because a round of mining or announcing a block can take longer than the trackers wait for the next
+// heartbeat on a busy machine, and the trackers would drop the miner in the meantime.
+func (m *Miner) heartbeats(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	interval := randomDuration(m.config.HeartbeatMin, m.config.HeartbeatMax)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			m.discover()
+			timer.Reset(interval)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// register - register this miner to all trackers in parallel. Also responsible for sending heartbeats to the trackers.
+// Returns the addresses of the other miners that any of the trackers lists, or an error if no tracker answers.
+func (m *Miner) register() ([]string, error) {
+	request := tracker.PortJson{
+		Port:      m.config.Port,
+		Address:   m.config.Address(),
+		PublicKey: peer.EncodeKey(m.key.Public()),
+	}
 	reqBytes, err := json.Marshal(request)
 	if err != nil {
 		log.Fatal("failed to encode register request to tracker")
 	}
-	url := fmt.Sprintf("http://localhost:%d/register", m.trackerPort)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
+	trackers := m.config.TrackerAddresses()
+	responses := make([]*tracker.PortsJson, len(trackers))
+	errs := make([]error, len(trackers))
+	wg := sync.WaitGroup{}
+	for i, address := range trackers {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			responses[i], errs[i] = m.registerTo(address, reqBytes)
+		}(i, address)
+	}
+	wg.Wait()
+	// merge the miners that the trackers list, except myself
+	peers := make([]string, 0)
+	seen := map[string]bool{m.config.Address(): true}
+	answered := false
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+		answered = true
+		m.recordMiners(*response)
+		for _, address := range response.MinerAddresses() {
+			if !seen[address] {
+				seen[address] = true
+				peers = append(peers, address)
+			}
+		}
+	}
+	if !answered {
+		return nil, fmt.Errorf("no tracker answers: %w", errors.Join(errs...))
+	}
+	return peers, nil
+}
+
+// registerTo - sends the register request reqBytes to the tracker at address, and returns its response.
+func (m *Miner) registerTo(address string, reqBytes []byte) (*tracker.PortsJson, error) {
+	resp, err := m.post(apiURL(address, "/register"), reqBytes)
 	if err != nil {
-		log.Println("failed to send register request to tracker")
-		return nil
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Println("failed to register to server")
-		return nil
+		return nil, fmt.Errorf("tracker %s rejected registration: status code %d", address, resp.StatusCode)
 	}
 	var response tracker.PortsJson
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		log.Printf("failed to decode registration response: %s", err.Error())
-		return nil
-	}
-	peers := response.Ports
-	// delete myself from the response
-	i := 0
-	for ; i < len(peers); i++ {
-		if peers[i] == m.port {
-			break
-		}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode registration response of tracker %s: %w", address, err)
 	}
-	if i < len(peers) {
-		peers = append(peers[:i], peers[i+1:]...)
+	return &response, nil
+}
+
+// discover - registers to the trackers, and returns the other miners that they list. While no tracker is reachable,
+// returns the peers in the address book instead, so that miners keep talking to each other without them.
+func (m *Miner) discover() []string {
+	peers, err := m.register()
+	if err != nil {
+		log.Printf("%d: Failed to register to any tracker, falling back to known peers: %s\n", m.config.Port, err.Error())
+		peers = m.book.Addresses(time.Now())
 	}
+	m.lock.Lock()
+	m.neighbors = peers
+	m.lock.Unlock()
 	return peers
 }
 
+// currentNeighbors - the peers that the miner syncs with, as of the last heartbeat.
+func (m *Miner) currentNeighbors() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.neighbors
+}
+
+// knownPeers - the peers in the address book at now, and this miner itself, as it tells them to peers.
+func (m *Miner) knownPeers(now time.Time) []KnownPeerJson {
+	self := KnownPeerJson{Address: m.config.Address(), PublicKey: peer.EncodeKey(m.key.Public()), LastSeen: now.UnixNano()}
+	known := m.book.Known(now)
+	if len(known) >= MaxKnownPeers {
+		known = known[:MaxKnownPeers-1]
+	}
+	return append(known, self)
+}
+
+// exchangeWith - exchanges known peers with one peer, and gossips the ones that are new to the other peers
+func (m *Miner) exchangeWith(address string) {
+	now := time.Now()
+	data, err := json.Marshal(KnownPeersJson{Peers: m.knownPeers(now)})
+	if err != nil {
+		log.Fatalf("failed to encode peer exchange")
+	}
+	resp, err := m.post(apiURL(address, "/peers"), data)
+	if err != nil {
+		log.Printf("error when exchanging peers with peer %s: %s\n", address, err.Error())
+		m.punish(address, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("failed to exchange peers with peer %s\n", address)
+		return
+	}
+	var response KnownPeersJson
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		m.punish(address, fmt.Errorf("%w: %s", ErrBadResponse, err.Error()))
+		return
+	}
+	if err := CheckKnownPeers(response.Peers); err != nil {
+		m.punish(address, err)
+		return
+	}
+	m.book.Seen(address, now)
+	if learned := m.book.Learn(response.Peers, m.config.Address(), address, now); len(learned) > 0 {
+		log.Printf("%d: Learned about %d new peers from peer %s\n", m.config.Port, len(learned), address)
+		m.gossip(learned, address)
+	}
+}
+
+// gossip - tells the peers that the miner syncs with, except the one at source and banned ones, about newly learned
+// peers, in the background. They gossip the ones that are new to them in turn, so that news spreads through the
+// network, and stops where everyone knows them already.
+func (m *Miner) gossip(learned []KnownPeerJson, source string) {
+	data, err := json.Marshal(KnownPeersJson{Peers: learned})
+	if err != nil {
+		log.Fatalf("failed to encode peer exchange")
+	}
+	for _, address := range m.peers.Allowed(m.currentNeighbors(), time.Now()) {
+		if address == source {
+			continue
+		}
+		go func(address string) {
+			resp, err := m.post(apiURL(address, "/peers"), data)
+			if err != nil {
+				m.punish(address, err)
+				return
+			}
+			resp.Body.Close()
+		}(address)
+	}
+}
+
 // syncWith - sync Miner's pool with one peer
-func (m *Miner) syncWith(peer int, data []byte, wg *sync.WaitGroup) {
+func (m *Miner) syncWith(peer string, data []byte, wg *sync.WaitGroup) {
 	defer wg.Done()
-	url := fmt.Sprintf("http://localhost:%d/sync", peer)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	resp, err := m.post(apiURL(peer, "/sync"), data)
 	if err != nil {
-		log.Printf("error when syncing with peer %d: %s\n", peer, err.Error())
+		log.Printf("error when syncing with peer %s: %s\n", peer, err.Error())
+		m.punish(peer, err)
 		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("failed to sync with peer %d\n", peer)
+		log.Printf("failed to sync with peer %s\n", peer)
 	}
 }
 
-// mine - try to mine one block. It will try at most MiningIterations iterations before it returns.
-// If successful, it will broadcast the new block to peers, and append the new block to the local blockchain.
-func (m *Miner) mine(peers []int) {
+// newTip - wakes up everyone waiting on tipChange, and replaces it for the next change. Called whenever the tip of the
+// blockchain changes. The caller must hold the lock.
+func (m *Miner) newTip() {
+	close(m.tipChange)
+	m.tipChange = make(chan struct{})
+}
+
+// mine - try to mine one block with the Miner's mining workers (see SearchNonce). Each worker will try at most
+// Config.MiningIterations iterations before it returns, and all of them give up as soon as the tip of the blockchain changes,
+// so that the next call mines on the new tip.
+// If successful, it will append the new block to the local blockchain, and announce its header to peers.
+func (m *Miner) mine(peers []string) {
 	m.lock.RLock()
-	length := len(m.blockChain)
+	tipChange := m.tipChange
 	// fill in the block that is to be mined
 	posts := make([]blockchain.Post, 0)
 	iter := m.pool.Iterator()
@@ -166,69 +307,63 @@ func (m *Miner) mine(peers []int) {
 	for iter.Next() {
 		post := iter.Value().(blockchain.Post)
 		posts = append(posts, post)
+		if blockchain.BlockSize(posts) > m.params.MaxBlockBytes {
+			// leave the post for a later block, and try to fit smaller ones
+			posts = posts[:len(posts)-1]
+			continue
+		}
 		count++
-		if count >= PostsPerBlock {
+		if count >= min(m.config.PostsPerBlock, m.params.MaxPostsPerBlock) {
 			break
 		}
 	}
 	block := blockchain.Block{
 		Header: blockchain.BlockHeader{
-			PrevHash:  make([]byte, 32),
-			Summary:   blockchain.Hash(posts),
-			Timestamp: time.Now().UnixNano(),
+			PrevHash:  blockchain.Hash(m.blockChain[len(m.blockChain)-1].Header),
+			Summary:   blockchain.MerkleRoot(posts),
+			Timestamp: max(time.Now().UnixNano(), blockchain.MedianTime(m.blockChain)+1),
+			Bits:      m.params.NextBits(m.blockChain),
 		},
 		Posts: posts,
 	}
-	if len(m.blockChain) > 0 {
-		hash := blockchain.Hash(m.blockChain[len(m.blockChain)-1].Header)
-		copy(block.Header.PrevHash, hash)
-	}
 
-	success := false
-MineIter:
-	for i := 0; i < MiningIterations; i++ {
-		block.Header.Nonce = rand.Uint32()
-		hash := blockchain.Hash(block.Header)
-		zeroBytes := blockchain.TARGET / 8
-		zeroBits := blockchain.TARGET % 8
-		// the first zeroBytes bytes of hash must be zero
-		for i := 0; i < zeroBytes; i++ {
-			if hash[i] != 0 {
-				continue MineIter
-			}
-		}
-		// and then zeroBits bits of hash must be zero
-		if zeroBits > 0 {
-			nextByte := hash[zeroBytes]
-			nextByte = nextByte >> (8 - zeroBits)
-			if nextByte != 0 {
-				continue MineIter
-			}
+	m.lock.RUnlock()
+
+	// mine without holding the lock, and give up as soon as the tip changes
+	tipChanged := func() bool {
+		select {
+		case <-tipChange:
+			return true
+		default:
+			return false
 		}
-		success = true
-		break
 	}
-	m.lock.RUnlock()
+	header, success := SearchNonce(block.Header, m.config.Workers, m.config.MiningIterations, tipChanged)
 	if !success {
 		return
 	}
+	block.Header = header
 
 	// append the new block to my blockchain
 	m.lock.Lock()
-	if len(m.blockChain) != length {
-		// accepted other broadcasts between unlock and lock
+	if m.tipChange != tipChange {
+		// switched to another blockchain between unlock and lock
 		// abort
 		m.lock.Unlock()
 		return
 	}
 	m.blockChain = append(m.blockChain, block)
+	m.indexBlocks(len(m.blockChain) - 1)
+	m.newTip()
 	for _, post := range block.Posts {
-		m.posts.Add(post)
 		m.pool.Remove(post)
 	}
-	request := BlockChainJson{}
-	for _, block := range m.blockChain {
-		request.Blockchain = append(request.Blockchain, block.EncodeBase64())
+	m.persist(len(m.blockChain) - 1)
+	request := AnnounceJson{
+		Port:    m.config.Port,
+		Address: m.config.Address(),
+		Height:  len(m.blockChain) - 1,
+		Header:  block.Header.EncodeBase64(),
 	}
 	m.lock.Unlock()
 
@@ -236,32 +371,17 @@ MineIter:
 	for _, post := range block.Posts {
 		contents = append(contents, post.Body.Content)
 	}
-	log.Printf("%d: Mined a block with contents (%v), chain length %d\n", m.port, contents, len(request.Blockchain))
-	// broadcast the new block in parallel
+	log.Printf("%d: Mined a block with contents (%v), chain length %d\n", m.config.Port, contents, request.Height+1)
+	// announce the new block in parallel to peers that are not banned, they fetch it if they want it
 	reqBytes, err := json.Marshal(request)
 	if err != nil {
-		log.Fatalf("failed to encode broadcast request")
+		log.Fatalf("failed to encode announce request")
 	}
 	wg := sync.WaitGroup{}
-	for _, peer := range peers {
+	for _, peer := range m.peers.Allowed(peers, time.Now()) {
 		peer := peer
 		wg.Add(1)
-		go m.broadcastTo(peer, reqBytes, &wg)
+		go m.announceTo(peer, reqBytes, &wg)
 	}
 	wg.Wait()
 }
-
-// broadcastTo - broadcast a newly mined block to one peer
-func (m *Miner) broadcastTo(peer int, data []byte, wg *sync.WaitGroup) {
-	defer wg.Done()
-	url := fmt.Sprintf("http://localhost:%d/broadcast", peer)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
-	if err != nil {
-		log.Printf("error when broadcasting to peer %d: %s\n", peer, err.Error())
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("failed to broadcast to peer %d\n", peer)
-	}
-}
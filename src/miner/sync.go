@@ -0,0 +1,337 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxHeadersPerRequest - A /headers request returns at most MaxHeadersPerRequest headers.
+const MaxHeadersPerRequest = 2000
+
+// MaxBlocksPerRequest - A /blocks request asks for at most MaxBlocksPerRequest blocks.
+const MaxBlocksPerRequest = 50
+
+// MaxHeaderBatches - A sync requests at most MaxHeaderBatches batches of MaxHeadersPerRequest headers. A peer that is
+// further ahead is caught up with over several of its announcements.
+const MaxHeaderBatches = 50
+
+// ErrTooManyHeaders - A peer sends more headers than a /headers response holds.
+var ErrTooManyHeaders = errors.New("peer sends too many headers")
+
+// LocatorDense - A locator lists the last LocatorDense blocks one by one, and then exponentially sparser blocks.
+const LocatorDense = 10
+
+// parseHashes - decodes a comma-separated list of hex-encoded hashes. An empty string is an empty list.
+func parseHashes(s string) ([][]byte, error) {
+	hashes := make([][]byte, 0)
+	if s == "" {
+		return hashes, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		hash, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// formatHashes - encodes hashes as a comma-separated list of hex strings, the reverse of parseHashes.
+func formatHashes(hashes [][]byte) string {
+	fields := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		fields = append(fields, hex.EncodeToString(hash))
+	}
+	return strings.Join(fields, ",")
+}
+
+// indexBlocks - adds the blocks on the blockchain from height on to heights, and their posts to posts. The caller must
+// hold the lock.
+func (m *Miner) indexBlocks(height int) {
+	for i := height; i < len(m.blockChain); i++ {
+		m.heights[string(blockchain.Hash(m.blockChain[i].Header))] = i
+		for _, post := range m.blockChain[i].Posts {
+			m.posts[string(post.ID())] = i
+		}
+	}
+}
+
+// unindexBlocks - removes the blocks on the blockchain from height on from heights, and their posts from posts, before
+// they are discarded. The caller must hold the lock.
+func (m *Miner) unindexBlocks(height int) {
+	for i := height; i < len(m.blockChain); i++ {
+		delete(m.heights, string(blockchain.Hash(m.blockChain[i].Header)))
+		for _, post := range m.blockChain[i].Posts {
+			delete(m.posts, string(post.ID()))
+		}
+	}
+}
+
+// onChain - whether post is on the blockchain. The caller must hold the lock.
+func (m *Miner) onChain(post blockchain.Post) bool {
+	_, ok := m.posts[string(post.ID())]
+	return ok
+}
+
+// forkPoint - the height of the first block of newChain that is not on the blockchain, found from the tip down. The
+// blocks before it are the same as on the blockchain, if newChain links to them. The caller must hold the lock.
+func (m *Miner) forkPoint(newChain []blockchain.Block) int {
+	for i := min(len(newChain)-1, len(m.blockChain)); i > 0; i-- {
+		if height, ok := m.heights[string(newChain[i].Header.PrevHash)]; ok && height == i-1 {
+			return i
+		}
+	}
+	return 0
+}
+
+// locator - hashes of blocks on the blockchain from the tip back to the genesis block: the last LocatorDense blocks one
+// by one, then every 2nd, 4th, 8th... block. A peer finds where its blockchain forks from this one as the first hash
+// in the locator that it knows. The caller must hold the lock.
+func (m *Miner) locator() [][]byte {
+	hashes := make([][]byte, 0)
+	step := 1
+	for i := len(m.blockChain) - 1; i > 0; i -= step {
+		hashes = append(hashes, blockchain.Hash(m.blockChain[i].Header))
+		if len(hashes) >= LocatorDense {
+			step *= 2
+		}
+	}
+	return append(hashes, blockchain.Hash(m.blockChain[0].Header))
+}
+
+// earlierPosts - maps the ID of every post in blocks that is also on the blockchain below height to the height of its
+// block, which is all that Chain.ValidateIndexed looks up when it validates blocks on top of the blockchain's first
+// height blocks. The caller must hold the lock.
+func (m *Miner) earlierPosts(blocks []blockchain.Block, height int) map[string]int {
+	earlier := make(map[string]int)
+	for _, block := range blocks {
+		for _, post := range block.Posts {
+			key := string(post.ID())
+			if i, ok := m.posts[key]; ok && i < height {
+				earlier[key] = i
+			}
+		}
+	}
+	return earlier
+}
+
+// adoptChain - switches to newChain if it is valid and preferred over the current blockchain by
+// blockchain.CompareChains, and returns the posts of discarded blocks to the pool.
+// The blocks before the fork point (see forkPoint) are taken from the blockchain before newChain is compared, so that
+// only blocks that are validated count for its work, whatever newChain claims before the fork point. The blocks from
+// the fork point on are validated without holding the lock, so that reads and mining go on meanwhile, and the
+// blockchain and its indexes are then only updated from the fork point on, if the blockchain still has the same blocks
+// before it and newChain is still preferred.
+func (m *Miner) adoptChain(newChain []blockchain.Block) error {
+	m.lock.RLock()
+	fork := m.forkPoint(newChain)
+	newChain = append(m.blockChain[:fork:fork], newChain[fork:]...)
+	preferred := blockchain.CompareChains(newChain, m.blockChain) > 0
+	var earlier map[string]int
+	if preferred {
+		earlier = m.earlierPosts(newChain[fork:], fork)
+	}
+	m.lock.RUnlock()
+	if !preferred {
+		// less work than mine, or loses the tie-break, just ignore it
+		return nil
+	}
+	if err := blockchain.Chain(newChain).ValidateIndexed(m.params, fork, earlier); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// the blockchain may have changed while newChain was validated
+	if fork > 0 {
+		if height, ok := m.heights[string(blockchain.Hash(newChain[fork-1].Header))]; !ok || height != fork-1 {
+			// switched to another blockchain meanwhile, the peer announces its blocks again
+			return nil
+		}
+	}
+	if blockchain.CompareChains(newChain, m.blockChain) <= 0 {
+		return nil
+	}
+	// all checks passed, blocks from fork to the end are discarded
+	discarded := m.blockChain[fork:]
+	m.unindexBlocks(fork)
+	m.blockChain = append(m.blockChain[:fork:fork], newChain[fork:]...)
+	m.indexBlocks(fork)
+	m.newTip()
+	// drop the posts on the new blocks from the pool, and return the posts of the discarded blocks to it, unless they
+	// are expired or there is no room
+	for _, block := range newChain[fork:] {
+		for _, post := range block.Posts {
+			m.pool.Remove(post)
+		}
+	}
+	now := time.Now()
+	for _, block := range discarded {
+		for _, post := range block.Posts {
+			if !m.onChain(post) {
+				_ = m.pool.Add(post, now)
+			}
+		}
+	}
+	m.persist(fork)
+	log.Printf("%d: Switched to a new blockchain, chain length %d\n", m.config.Port, len(m.blockChain))
+	return nil
+}
+
+// syncFrom - catches up with the blockchain of a peer that announced a block at height, headers first.
+// Sends the peer a locator of this miner's blockchain, and receives the headers after the fork point up to height. Only
+// if the headers are valid and the peer's blockchain is preferred, fetches the blocks after the fork point, and
+// switches to the peer's blockchain (see adoptChain).
+func (m *Miner) syncFrom(peer string, height int) error {
+	m.lock.RLock()
+	chain := m.blockChain
+	locator := m.locator()
+	m.lock.RUnlock()
+
+	start, headers, err := m.fetchHeaders(peer, locator, height)
+	if err != nil {
+		return err
+	}
+	if len(headers) == 0 {
+		// the peer has nothing new
+		return nil
+	}
+	if start < 1 || start > len(chain) {
+		return fmt.Errorf("%w: headers from invalid height %d", ErrBadResponse, start)
+	}
+	candidate := chain[:start:start]
+	for _, header := range headers {
+		candidate = append(candidate, blockchain.Block{Header: header})
+	}
+	if blockchain.CompareChains(candidate, chain) <= 0 {
+		return nil
+	}
+	if err := blockchain.Chain(candidate).ValidateHeaders(m.params, start); err != nil {
+		return err
+	}
+	// the headers are worth it, fetch the blocks
+	for i := start; i < len(candidate); i += MaxBlocksPerRequest {
+		hashes := make([][]byte, 0)
+		for j := i; j < min(len(candidate), i+MaxBlocksPerRequest); j++ {
+			hashes = append(hashes, blockchain.Hash(candidate[j].Header))
+		}
+		blocks, err := m.fetchBlocks(peer, hashes)
+		if err != nil {
+			return err
+		}
+		if len(blocks) != len(hashes) {
+			return fmt.Errorf("%w: a wrong number of blocks", ErrBadResponse)
+		}
+		for j := range blocks {
+			if !bytes.Equal(blockchain.Hash(blocks[j].Header), hashes[j]) {
+				return fmt.Errorf("%w: a block that was not requested", ErrBadResponse)
+			}
+			candidate[i+j] = blocks[j]
+		}
+	}
+
+	return m.adoptChain(candidate)
+}
+
+// fetchHeaders - requests the headers after the fork point of locator up to height from a peer, MaxHeadersPerRequest
+// at a time, and at most MaxHeaderBatches times. Returns the height of the first header and the headers. Headers past
+// height are dropped, since the peer may have mined more blocks since it announced height, while a peer that sends more
+// than MaxHeadersPerRequest headers at a time fails with ErrTooManyHeaders.
+func (m *Miner) fetchHeaders(peer string, locator [][]byte, height int) (int, []blockchain.BlockHeader, error) {
+	start := -1
+	headers := make([]blockchain.BlockHeader, 0)
+	for batch := 0; batch < MaxHeaderBatches; batch++ {
+		url := apiURL(peer, "/headers?from="+formatHashes(locator))
+		resp, err := m.client.Get(url)
+		if err != nil {
+			return 0, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return 0, nil, fmt.Errorf("peer rejected headers request: status code %d", resp.StatusCode)
+		}
+		var response HeadersJson
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return 0, nil, err
+		}
+		if start < 0 {
+			start = response.Start
+		} else if response.Start != start+len(headers) {
+			return 0, nil, fmt.Errorf("%w: headers that do not continue the previous ones", ErrBadResponse)
+		}
+		if len(response.Headers) > MaxHeadersPerRequest {
+			return 0, nil, fmt.Errorf("%w: %d in one response, at most %d", ErrTooManyHeaders, len(response.Headers),
+				MaxHeadersPerRequest)
+		}
+		if past := response.Start + len(response.Headers) - 1 - height; past > 0 {
+			response.Headers = response.Headers[:max(len(response.Headers)-past, 0)]
+		}
+		for _, encoded := range response.Headers {
+			header, err := encoded.DecodeBase64()
+			if err != nil {
+				return 0, nil, err
+			}
+			headers = append(headers, header)
+		}
+		if len(response.Headers) < MaxHeadersPerRequest {
+			return start, headers, nil
+		}
+		// continue after the last header
+		locator = [][]byte{blockchain.Hash(headers[len(headers)-1])}
+	}
+	// the rest on the next announcement
+	return start, headers, nil
+}
+
+// fetchBlocks - requests the blocks with the given header hashes from a peer.
+func (m *Miner) fetchBlocks(peer string, hashes [][]byte) ([]blockchain.Block, error) {
+	url := apiURL(peer, "/blocks?hashes="+formatHashes(hashes))
+	resp, err := m.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer rejected blocks request: status code %d", resp.StatusCode)
+	}
+	var response BlocksJson
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	blocks := make([]blockchain.Block, 0, len(response.Blocks))
+	for _, encoded := range response.Blocks {
+		block, err := encoded.DecodeBase64()
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// announceTo - announce the header of a newly mined block to one peer
+func (m *Miner) announceTo(peer string, data []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	resp, err := m.post(apiURL(peer, "/announce"), data)
+	if err != nil {
+		log.Printf("error when announcing to peer %s: %s\n", peer, err.Error())
+		m.punish(peer, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("failed to announce to peer %s\n", peer)
+	}
+}
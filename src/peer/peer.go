@@ -0,0 +1,208 @@
+// Package peer authenticates the requests that miners send to each other and to the tracker with their node keys.
+package peer
+
+import (
+	"blockchain/blockchain"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of a signed request, see Sign.
+const (
+	AddressHeader   = "X-Peer-Address"   // the address of the miner that sends the request, see URL
+	TimestampHeader = "X-Peer-Timestamp" // when the request is signed, in nanoseconds since the Unix epoch
+	SignatureHeader = "X-Peer-Signature" // the base64 signature of the request
+)
+
+// MaxClockSkew - A signed request is rejected if it is signed more than MaxClockSkew before or after the receiver's
+// clock, so that a captured request cannot be replayed much later.
+const MaxClockSkew = 30 * time.Second
+
+// KeyType - PEM block type of a node key file, a plain PKCS#8 private key.
+const KeyType = "PRIVATE KEY"
+
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrStale        = errors.New("request is signed too far from the current time")
+	ErrUnknownPeer  = errors.New("peer has no known node key")
+	ErrBadSignature = errors.New("request signature is invalid")
+)
+
+// digest - the hash that the signature of a request covers: its method, path and query, the address and the timestamp
+// it claims, and the sha256 of its body.
+func digest(method string, uri string, address string, timestamp int64, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%s\n%s\n%s\n%d\n", method, uri, address, timestamp)
+	hash.Write(bodyHash[:])
+	return hash.Sum(nil)
+}
+
+// Sign - signs request, which is sent by the miner at address and carries body, with the miner's node key.
+func Sign(request *http.Request, body []byte, address string, key blockchain.Signer) {
+	timestamp := time.Now().UnixNano()
+	signature := key.SignHash(digest(request.Method, request.URL.RequestURI(), address, timestamp, body))
+	request.Header.Set(AddressHeader, address)
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(signature))
+}
+
+// Post - sends a json body to url in a POST request signed by the miner at address (see Sign), like http.Post.
+func Post(url string, body []byte, address string, key blockchain.Signer) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	Sign(request, body, address, key)
+	return http.DefaultClient.Do(request)
+}
+
+// Verify - checks that request, which carries body, is signed by the miner it claims to be sent by, and returns the
+// address of that miner. keyOf returns the node key of the miner at an address, or nil if it is unknown.
+func Verify(request *http.Request, body []byte, keyOf func(address string) blockchain.PublicKey) (string, error) {
+	if request.Header.Get(SignatureHeader) == "" {
+		return "", ErrUnsigned
+	}
+	address := request.Header.Get(AddressHeader)
+	if address == "" {
+		return "", ErrBadSignature
+	}
+	timestamp, err := strconv.ParseInt(request.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(request.Header.Get(SignatureHeader))
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	if skew := time.Since(time.Unix(0, timestamp)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return "", ErrStale
+	}
+	key := keyOf(address)
+	if key == nil {
+		return "", ErrUnknownPeer
+	}
+	if !key.VerifyHash(digest(request.Method, request.URL.RequestURI(), address, timestamp, body), signature) {
+		return "", ErrBadSignature
+	}
+	return address, nil
+}
+
+// handshakeDigest - the hash that the signature of a handshake covers: the nonce that the asking miner chose, and the
+// address of the answering miner. It starts differently from digest, so that no request signature is also a handshake.
+func handshakeDigest(nonce []byte, address string) []byte {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "handshake\n%s\n", address)
+	hash.Write(nonce)
+	return hash.Sum(nil)
+}
+
+// SignHandshake - signs nonce, which another miner sent to the miner at address, with the miner's node key, so that the
+// other miner can check that whoever answers at address holds the key, see VerifyHandshake.
+func SignHandshake(nonce []byte, address string, key blockchain.Signer) []byte {
+	return key.SignHash(handshakeDigest(nonce, address))
+}
+
+// VerifyHandshake - checks that signature is the output of SignHandshake for nonce and address with key.
+func VerifyHandshake(nonce []byte, address string, key blockchain.PublicKey, signature []byte) bool {
+	return key.VerifyHash(handshakeDigest(nonce, address), signature)
+}
+
+// CheckAddress - checks that address is either host:port, or an http or https URL with a host and no query, which is
+// how miners and the tracker are addressed.
+func CheckAddress(address string) error {
+	if !strings.Contains(address, "://") {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("address %q is neither host:port nor a URL", address)
+		}
+		return nil
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" || parsed.RawQuery != "" {
+		return fmt.Errorf("address %q is not an http or https URL", address)
+	}
+	return nil
+}
+
+// URL - the base URL of the APIs of a miner or the tracker at address: address itself if it is a URL, without a
+// trailing slash, or http://host:port otherwise. address must pass CheckAddress.
+func URL(address string) string {
+	if strings.Contains(address, "://") {
+		return strings.TrimSuffix(address, "/")
+	}
+	return "http://" + address
+}
+
+// PortOf - the port in address, or 0 if it names none, for clients that still identify miners by their ports alone.
+func PortOf(address string) int {
+	parsed, err := url.Parse(URL(address))
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(parsed.Port())
+	return port
+}
+
+// EncodeKey - encodes a node key as the base64 of blockchain.PublicKeyToBytes, as it is sent to the tracker.
+func EncodeKey(key blockchain.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(blockchain.PublicKeyToBytes(key))
+}
+
+// DecodeKey - decodes the output of EncodeKey.
+func DecodeKey(encoded string) (blockchain.PublicKey, error) {
+	buffer, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return blockchain.PublicKeyFromBytes(buffer)
+}
+
+// LoadOrCreateKey - reads the node key in the PEM file at path. If there is no such file, generates a new Ed25519 key
+// and saves it there, readable by the owner only, so that the miner keeps its identity across restarts.
+func LoadOrCreateKey(path string) (blockchain.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != KeyType {
+		return nil, fmt.Errorf("%s is not a PEM %s file", path, KeyType)
+	}
+	return blockchain.ParsePrivateKey(block.Bytes)
+}
+
+// createKey - generates a new Ed25519 node key and saves it in a new PEM file at path.
+func createKey(path string) (blockchain.Signer, error) {
+	key := blockchain.GenerateKey(blockchain.Ed25519)
+	der, err := blockchain.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: KeyType, Bytes: der}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return key, file.Close()
+}
@@ -0,0 +1,27 @@
+package settings
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+)
+
+// Load - reads the settings in the YAML or JSON file at path into out, which already holds the defaults.
+// Settings missing from the file keep their defaults, and a setting that out does not have is an error, so that typos
+// do not go unnoticed. Durations are written like "500ms" or "2s". JSON is read as YAML, which it is a subset of.
+func Load(path string, out any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		// an empty file is no settings at all
+		return fmt.Errorf("invalid settings in %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package store
+
+import (
+	"blockchain/blockchain"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BlocksFile - Name of the block log in a store's directory.
+const BlocksFile = "blocks.log"
+
+// PoolFile - Name of the pending pool in a store's directory.
+const PoolFile = "pool.json"
+
+// PeersFile - Name of the address book in a store's directory.
+const PeersFile = "peers.json"
+
+// MaxRecordSize - A record in the block log is at most MaxRecordSize bytes. Anything larger is treated as a torn write.
+const MaxRecordSize = 64 * 1024 * 1024
+
+// recordHeaderSize - Every record starts with the length of its payload and the crc32 of its payload, both uint32.
+const recordHeaderSize = 8
+
+// Store - Persistent storage of a miner's blockchain, pending pool and address book in one directory.
+//
+// The blockchain is kept in an append-only log with one record per block, in order of height. A record is the length
+// and the crc32 of its payload, followed by the payload, which is the json encoding of a blockchain.BlockBase64.
+// The offset of every record is indexed in memory, so that the log can be truncated back to any height when the
+// blockchain switches to another fork. A record that is cut short or fails its checksum can only be the result of a
+// crash in the middle of a write, so it is discarded together with everything after it when the store is opened.
+//
+// The pool and the address book are each rewritten as a whole into a temporary file, which then atomically replaces the
+// previous one.
+type Store struct {
+	dir     string   // directory of all files
+	blocks  *os.File // the block log, opened for reading and appending
+	offsets []int64  // offsets[i] is the offset of the record of the block at height i
+	size    int64    // the end of the last valid record
+}
+
+// Open - opens the store in dir, creating the directory if needed, and returns the blocks in the log.
+// A torn record at the end of the log is discarded. The returned blocks are not validated.
+func Open(dir string) (*Store, []blockchain.Block, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, BlocksFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &Store{dir: dir, blocks: file}
+	blocks, err := s.scan()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return s, blocks, nil
+}
+
+// scan - reads all valid records from the block log, builds the index, and truncates any torn record at the end.
+func (s *Store) scan() ([]blockchain.Block, error) {
+	blocks := make([]blockchain.Block, 0)
+	reader := bufio.NewReader(s.blocks)
+	offset := int64(0)
+	for {
+		payload, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// a torn write, drop it and everything after it
+			break
+		}
+		var encoded blockchain.BlockBase64
+		if err := json.Unmarshal(payload, &encoded); err != nil {
+			return nil, fmt.Errorf("block %d in the log is corrupted: %w", len(blocks), err)
+		}
+		block, err := encoded.DecodeBase64()
+		if err != nil {
+			return nil, fmt.Errorf("block %d in the log is corrupted: %w", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+		s.offsets = append(s.offsets, offset)
+		offset += recordHeaderSize + int64(len(payload))
+	}
+	s.size = offset
+	if err := s.blocks.Truncate(s.size); err != nil {
+		return nil, err
+	}
+	if err := s.blocks.Sync(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// readRecord - reads the payload of one record. Returns io.EOF at the clean end of the log, and another error for a
+// torn record.
+func readRecord(reader io.Reader) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	checksum := binary.BigEndian.Uint32(header[4:])
+	if length > MaxRecordSize {
+		return nil, errors.New("record is too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// Height - the number of blocks in the log.
+func (s *Store) Height() int {
+	return len(s.offsets)
+}
+
+// Append - appends blocks to the end of the log, and flushes them to the disk.
+func (s *Store) Append(blocks ...blockchain.Block) error {
+	buffer := make([]byte, 0)
+	offsets := make([]int64, 0, len(blocks))
+	for _, block := range blocks {
+		payload, err := json.Marshal(block.EncodeBase64())
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, s.size+int64(len(buffer)))
+		buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(payload)))
+		buffer = binary.BigEndian.AppendUint32(buffer, crc32.ChecksumIEEE(payload))
+		buffer = append(buffer, payload...)
+	}
+	if _, err := s.blocks.WriteAt(buffer, s.size); err != nil {
+		return err
+	}
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(len(buffer))
+	return nil
+}
+
+// Truncate - discards the blocks at height and above from the log.
+func (s *Store) Truncate(height int) error {
+	if height >= len(s.offsets) {
+		return nil
+	}
+	if err := s.blocks.Truncate(s.offsets[height]); err != nil {
+		return err
+	}
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+	s.size = s.offsets[height]
+	s.offsets = s.offsets[:height]
+	return nil
+}
+
+// SavePool - replaces the stored pool with posts. A crash leaves either the old or the new pool, but never a mix.
+func (s *Store) SavePool(posts []blockchain.Post) error {
+	encoded := make([]blockchain.PostBase64, 0, len(posts))
+	for _, post := range posts {
+		encoded = append(encoded, post.EncodeBase64())
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	return s.replaceFile(PoolFile, data)
+}
+
+// replaceFile - atomically replaces the file name in the store's directory with data, through a temporary file.
+func (s *Store) replaceFile(name string, data []byte) error {
+	temp, err := os.CreateTemp(s.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// LoadPool - reads the stored pool. Returns no posts if the pool was never saved. The posts are not validated.
+func (s *Store) LoadPool() ([]blockchain.Post, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, PoolFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var encoded []blockchain.PostBase64
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("pool is corrupted: %w", err)
+	}
+	posts := make([]blockchain.Post, 0, len(encoded))
+	for _, e := range encoded {
+		post, err := e.DecodeBase64()
+		if err != nil {
+			return nil, fmt.Errorf("pool is corrupted: %w", err)
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// Peer - A peer in the stored address book of a miner.
+type Peer struct {
+	Address   string    `json:"address"`              // address of the peer, see peer.URL
+	PublicKey string    `json:"public-key,omitempty"` // node key of the peer, as the tracker or a handshake verified it
+	KeyHint   string    `json:"key-hint,omitempty"`   // node key that other peers report for it, which is not trusted
+	LastSeen  time.Time `json:"last-seen"`            // when the peer was last known to be alive
+	Source    string    `json:"source,omitempty"`     // the peer it was learned from, unless the tracker recorded it
+}
+
+// SavePeers - replaces the stored address book with peers, atomically like SavePool.
+func (s *Store) SavePeers(peers []Peer) error {
+	data, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	return s.replaceFile(PeersFile, data)
+}
+
+// LoadPeers - reads the stored address book. Returns no peers if it was never saved. The peers are not checked.
+func (s *Store) LoadPeers() ([]Peer, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, PeersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("address book is corrupted: %w", err)
+	}
+	return peers, nil
+}
+
+// Close - closes the block log.
+func (s *Store) Close() error {
+	return s.blocks.Close()
+}
+
+// syncDir - flushes a directory, so that a rename in it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
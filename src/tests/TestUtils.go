@@ -3,6 +3,7 @@ package tests
 import (
 	"blockchain/blockchain"
 	"blockchain/miner"
+	"blockchain/peer"
 	"blockchain/tracker"
 	Tracker "blockchain/tracker"
 	"bytes"
@@ -12,7 +13,9 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,18 +23,20 @@ import (
 
 // PartitionTracker manages a list of blockchain miners and supports network partitioning for testing.
 type PartitionTracker struct {
-	miners      map[int]*time.Timer // maps each miner's port to its expiration timer
-	lock        sync.Mutex          // protects access to the miners map
-	router      *gin.Engine         // HTTP router for handling API requests
-	server      *http.Server        // HTTP server to serve API requests
-	partitioned atomic.Bool         // flag to control network partitioning behavior
+	miners      map[string]*time.Timer // maps each miner's address to its expiration timer
+	keys        map[string]string      // maps each miner's address to its node key, which is trusted without checking
+	lock        sync.Mutex             // protects access to the miners map
+	router      *gin.Engine            // HTTP router for handling API requests
+	server      *http.Server           // HTTP server to serve API requests
+	partitioned atomic.Bool            // flag to control network partitioning behavior
 }
 
 // NewPartitionTracker creates and initializes a new PartitionTracker instance.
 // It sets up HTTP routes and prepares the server to listen on the specified port.
 func NewPartitionTracker(port int) *PartitionTracker {
 	tracker := &PartitionTracker{
-		miners: make(map[int]*time.Timer),
+		miners: make(map[string]*time.Timer),
+		keys:   make(map[string]string),
 		router: gin.New(),
 	}
 
@@ -42,7 +47,12 @@ func NewPartitionTracker(port int) *PartitionTracker {
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
 		}
-		statusCode, response := tracker.registerHandler(request)
+		address, err := request.ResolveAddress(ctx.Request.RemoteAddr)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		statusCode, response := tracker.registerHandler(address, request.PublicKey)
 		ctx.JSON(statusCode, response)
 	})
 	tracker.router.GET("/get_miners", func(ctx *gin.Context) {
@@ -87,39 +97,42 @@ func (t *PartitionTracker) Partition(partition bool) {
 	t.partitioned.Store(partition)
 }
 
-// registerHandler processes the /register API requests to manage miner registrations.
-func (t *PartitionTracker) registerHandler(request Tracker.PortJson) (int, any) {
-	port := request.Port
-	r := port % 2
+// registerHandler processes the /register API requests to manage miner registrations. When partitioned, miners are
+// split by the parity of their ports.
+func (t *PartitionTracker) registerHandler(address string, key string) (int, any) {
+	r := peer.PortOf(address) % 2
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	timer, ok := t.miners[port]
+	timer, ok := t.miners[address]
 	if ok {
 		// stop timer
 		timer.Stop()
 	}
 	// register a new timer
-	t.miners[port] = time.AfterFunc(Tracker.EntryTimeout, func() {
+	if key != "" {
+		t.keys[address] = key
+	}
+	t.miners[address] = time.AfterFunc(Tracker.DefaultConfig().EntryTimeout, func() {
 		t.lock.Lock()
 		defer t.lock.Unlock()
-		delete(t.miners, port)
+		delete(t.miners, address)
 	})
-	var response Tracker.PortsJson
-	if t.partitioned.Load() {
-		// do partitioning
-		for port := range t.miners {
-			if port%2 == r {
-				response.Ports = append(response.Ports, port)
-			}
-		}
-	} else {
-		// act normally
-		for port := range t.miners {
-			response.Ports = append(response.Ports, port)
+	addresses := make([]string, 0)
+	for address := range t.miners {
+		if !t.partitioned.Load() || peer.PortOf(address)%2 == r {
+			addresses = append(addresses, address)
 		}
 	}
+	return http.StatusOK, t.response(addresses)
+}
 
-	return http.StatusOK, response
+// response builds the response that lists the miners at addresses, with the node keys of all miners.
+func (t *PartitionTracker) response(addresses []string) Tracker.PortsJson {
+	response := Tracker.PortsJson{Addresses: addresses, Keys: maps.Clone(t.keys)}
+	for _, address := range addresses {
+		response.Ports = append(response.Ports, peer.PortOf(address))
+	}
+	return response
 }
 
 // getMinersHandler provides a list of registered miners.
@@ -130,12 +143,11 @@ func (t *PartitionTracker) getMinersHandler() (int, any) {
 		// no miners currently
 		return http.StatusNotFound, nil
 	}
-	ports := make([]int, 0)
-	for port := range t.miners {
-		ports = append(ports, port)
+	addresses := make([]string, 0)
+	for address := range t.miners {
+		addresses = append(addresses, address)
 	}
-	response := Tracker.PortsJson{Ports: ports}
-	return http.StatusOK, response
+	return http.StatusOK, t.response(addresses)
 }
 
 // ReadBlockchain queries a miner and retrieves the blockchain content.
@@ -163,12 +175,80 @@ func ReadBlockchain(port int) []blockchain.Block {
 	return chain
 }
 
+// GetJSON sends a GET request to url, decodes a successful json response into response, and returns the status code.
+func GetJSON(url string, response any) (int, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(response)
+}
+
+// RegisterPeer registers a fake miner on localhost:port with the node key key to the tracker on trackerPort, so that
+// miners accept the requests it signs, and returns the status code of the tracker.
+func RegisterPeer(trackerPort int, port int, key blockchain.Signer) (int, error) {
+	address := PeerAddress(port)
+	body, _ := json.Marshal(tracker.PortJson{Port: port, Address: address, PublicKey: peer.EncodeKey(key.Public())})
+	resp, err := peer.Post(fmt.Sprintf("http://localhost:%d/register", trackerPort), body, address, key)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// WaitForMiner polls the tracker on trackerPort for up to 5 seconds until it lists the miner at address, and reports
+// whether it did.
+func WaitForMiner(trackerPort int, address string) bool {
+	for i := 0; i < 50; i++ {
+		var response tracker.PortsJson
+		if code, _ := GetJSON(fmt.Sprintf("http://localhost:%d/get_miners", trackerPort), &response); code == http.StatusOK {
+			if slices.Contains(response.MinerAddresses(), address) {
+				return true
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// WaitForPeer registers the fake peer on localhost:port with the node key key to the tracker on trackerPort again at
+// every poll, as its heartbeats, for up to 5 seconds until the miner on minerPort holds the verified node key, and
+// reports whether it did, so that a fake peer does not sign requests before the miner knows its key.
+func WaitForPeer(trackerPort int, minerPort int, port int, key blockchain.Signer) bool {
+	for i := 0; i < 50; i++ {
+		if code, err := RegisterPeer(trackerPort, port, key); err != nil || code != http.StatusOK {
+			return false
+		}
+		var response miner.PeersJson
+		if code, _ := GetJSON(fmt.Sprintf("http://localhost:%d/peers", minerPort), &response); code == http.StatusOK {
+			for _, known := range response.Known {
+				if known.Address == PeerAddress(port) && known.Verified {
+					return true
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// PeerAddress returns the address of a miner or fake peer on localhost:port, as miners identify it.
+func PeerAddress(port int) string {
+	return fmt.Sprintf("localhost:%d", port)
+}
+
 // WriteBlockchain submits a post to a miner for inclusion in the blockchain.
 func WriteBlockchain(port int, content string) error {
-	privateKey := blockchain.GenerateKey()
+	privateKey := blockchain.GenerateKey(blockchain.RSA)
 	post := blockchain.Post{
-		User: &privateKey.PublicKey,
+		User: privateKey.Public(),
 		Body: blockchain.PostBody{
+			ChainID:   blockchain.DefaultChainID,
 			Content:   content,
 			Timestamp: time.Now().UnixNano(),
 		},
@@ -220,3 +300,53 @@ func (t *mockTracker) handleGetMiners(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// NewSignedPost creates a post with the given content, signed by a freshly generated Ed25519 key.
+func NewSignedPost(content string) blockchain.Post {
+	return NewSignedPostAt(content, time.Now().UnixNano())
+}
+
+// NewSignedPostAt creates a post on the main network with the given content and timestamp, signed by a new Ed25519 key.
+func NewSignedPostAt(content string, timestamp int64) blockchain.Post {
+	privateKey := blockchain.GenerateKey(blockchain.Ed25519)
+	post := blockchain.Post{
+		User: privateKey.Public(),
+		Body: blockchain.PostBody{
+			ChainID:   blockchain.DefaultChainID,
+			Content:   content,
+			Timestamp: timestamp,
+		},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	return post
+}
+
+// MineBlock searches nonces until the block's header meets the difficulty it declares, and returns the mined block.
+func MineBlock(block blockchain.Block) blockchain.Block {
+	for !blockchain.CheckPoW(blockchain.Hash(block.Header), block.Header.Bits) {
+		block.Header.Nonce++
+	}
+	return block
+}
+
+// chainParams holds the consensus parameters of the main network, which the miners and users under test run on.
+var chainParams = blockchain.DefaultChainParams()
+
+// NextBlock mines a valid block containing posts on top of chain, which starts with the genesis block.
+func NextBlock(chain []blockchain.Block, posts []blockchain.Post) blockchain.Block {
+	return NextBlockAt(chain, posts, time.Now().UnixNano())
+}
+
+// NextBlockAt mines a block containing posts on top of chain, dated at timestamp.
+func NextBlockAt(chain []blockchain.Block, posts []blockchain.Post, timestamp int64) blockchain.Block {
+	block := blockchain.Block{
+		Header: blockchain.BlockHeader{
+			PrevHash:  blockchain.Hash(chain[len(chain)-1].Header),
+			Summary:   blockchain.MerkleRoot(posts),
+			Timestamp: timestamp,
+			Bits:      chainParams.NextBits(chain),
+		},
+		Posts: posts,
+	}
+	return MineBlock(block)
+}
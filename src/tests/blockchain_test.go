@@ -2,10 +2,19 @@ package tests
 
 import (
 	"blockchain/blockchain"
+	"bytes"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,10 +26,11 @@ import (
 // 3. Tamper Detection: Tests the system's ability to detect and reject tampered posts after signing.
 // It performs tampering on both content and timestamp to check the robustness of the signature system.
 func TestPostSafety(t *testing.T) {
-	privateKey := blockchain.GenerateKey()
+	privateKey := blockchain.GenerateKey(blockchain.RSA)
 	post := blockchain.Post{
-		User: &privateKey.PublicKey,
+		User: privateKey.Public(),
 		Body: blockchain.PostBody{
+			ChainID:   blockchain.DefaultChainID,
 			Content:   "Hello World",
 			Timestamp: time.Now().UnixNano(),
 		},
@@ -58,13 +68,14 @@ func TestPostSafety(t *testing.T) {
 // 3. Tamper Detection: Tests detection of tampering in block contents, including post deletions and modifications to the 'PrevHash'.
 // This function performs detailed checks by modifying block components and verifying that these changes invalidate the block.
 func TestBlockSafety(t *testing.T) {
-	users := make([]*rsa.PrivateKey, 0)
+	users := make([]blockchain.Signer, 0)
 	posts := make([]blockchain.Post, 0)
 	for i := 0; i < 3; i++ {
-		privateKey := blockchain.GenerateKey()
+		privateKey := blockchain.GenerateKey(blockchain.RSA)
 		post := blockchain.Post{
-			User: &privateKey.PublicKey,
+			User: privateKey.Public(),
 			Body: blockchain.PostBody{
+				ChainID:   blockchain.DefaultChainID,
 				Content:   fmt.Sprintf("Hello from %d", i),
 				Timestamp: time.Now().UnixNano(),
 			},
@@ -76,8 +87,9 @@ func TestBlockSafety(t *testing.T) {
 	block := blockchain.Block{
 		Header: blockchain.BlockHeader{
 			PrevHash:  make([]byte, 32),
-			Summary:   blockchain.Hash(posts),
+			Summary:   blockchain.MerkleRoot(posts),
 			Timestamp: time.Now().UnixNano(),
+			Bits:      chainParams.InitialBits,
 		},
 		Posts: posts,
 	}
@@ -88,10 +100,10 @@ mine:
 		count++
 		block.Header.Nonce = rand.Uint32()
 		hash := blockchain.Hash(block.Header)
-		zeroBytes := blockchain.TARGET / 8
-		zeroBits := blockchain.TARGET % 8
+		zeroBytes := chainParams.InitialBits / 8
+		zeroBits := chainParams.InitialBits % 8
 		// the first zeroBytes bytes of hash must be zero
-		for i := 0; i < zeroBytes; i++ {
+		for i := uint32(0); i < zeroBytes; i++ {
 			if hash[i] != 0 {
 				continue mine
 			}
@@ -109,7 +121,7 @@ mine:
 	end := time.Now().UnixMilli()
 	t.Logf("used %d ms (%d iterations) to mine a block", end-start, count)
 
-	if !block.Verify() {
+	if !block.Verify(chainParams) {
 		t.Fatalf("the mined block is not valid")
 	}
 
@@ -122,13 +134,784 @@ mine:
 
 	// delete a post
 	block.Posts = posts[:2]
-	if block.Verify() {
+	if block.Verify(chainParams) {
 		t.Fatalf("fails to detect a tamper of posts")
 	}
 
 	// tamper PrevHash
 	block.Header.PrevHash[0] = 1
-	if block.Verify() {
+	if block.Verify(chainParams) {
 		t.Fatalf("fails to detect a tamper of previous block's hash")
 	}
 }
+
+// TestCanonicalEncoding pins the exact bytes of the canonical encoding with golden test vectors.
+// Any change to these vectors changes the identity of every post and block, so the vectors must only be updated
+// together with blockchain.EncodingVersion.
+func TestCanonicalEncoding(t *testing.T) {
+	body := blockchain.PostBody{ChainID: "main", Content: "Hello", Timestamp: 1700000000000000000}
+	post := blockchain.Post{
+		User:      blockchain.RSAPublicKey{Key: &rsa.PublicKey{N: big.NewInt(0x0102030405), E: 65537}},
+		Signature: []byte{0xaa, 0xbb},
+		Body:      body,
+	}
+	ed25519Key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	for i := range ed25519Key {
+		ed25519Key[i] = byte(i)
+	}
+	ed25519Post := blockchain.Post{
+		User:      blockchain.Ed25519PublicKey{Key: ed25519Key},
+		Signature: []byte{0xaa, 0xbb},
+		Body:      body,
+	}
+	header := blockchain.BlockHeader{
+		PrevHash:  make([]byte, 4),
+		Summary:   []byte{1, 2, 3, 4},
+		Timestamp: 1700000000000000001,
+		Bits:      20,
+		Nonce:     0xdeadbeef,
+	}
+	vectors := []struct {
+		name     string
+		object   any
+		encoding string
+		hash     string
+	}{
+		{
+			name:   "PostBody",
+			object: body,
+			encoding: "0101" + // version, tag
+				"00000004" + "6d61696e" + // chain id
+				"00000005" + "48656c6c6f" + // content
+				"17979cfe362a0000", // timestamp
+			hash: "5bc286308721cf4c217e214e2b818f6198e3a8ce5a535471750b7336d13d2f56",
+		},
+		{
+			name:   "Post",
+			object: post,
+			encoding: "0102" + // version, tag
+				"0000000a" + "10" + "010001000102030405" + // user
+				"00000002" + "aabb" + // signature
+				"00000004" + "6d61696e" + "00000005" + "48656c6c6f" + "17979cfe362a0000", // body
+			hash: "15712bdeba678fe4f101931eda6a5d251ab2e5887d48b148d98c51c9f38aa0c5",
+		},
+		{
+			name:   "Ed25519Post",
+			object: ed25519Post,
+			encoding: "0102" + // version, tag
+				"00000021" + "20" + "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" + // user
+				"00000002" + "aabb" + // signature
+				"00000004" + "6d61696e" + "00000005" + "48656c6c6f" + "17979cfe362a0000", // body
+			hash: "c061d78a673161ef0e805abca3f652e9039d0e1f769e8540445d4107e6842b45",
+		},
+		{
+			name:   "BlockHeader",
+			object: header,
+			encoding: "0103" + // version, tag
+				"00000004" + "00000000" + // prev hash
+				"00000004" + "01020304" + // summary
+				"17979cfe362a0001" + // timestamp
+				"00000014" + // bits
+				"deadbeef", // nonce
+			hash: "b64ad9642ad8d8beab2338acdd31a90cf6336c62ee98977758b325f677dd4fdb",
+		},
+		{
+			name:   "Posts",
+			object: []blockchain.Post{post},
+			encoding: "0104" + // version, tag
+				"00000001" + // count
+				"0000000a" + "10" + "010001000102030405" + "00000002" + "aabb" +
+				"00000004" + "6d61696e" + "00000005" + "48656c6c6f" + "17979cfe362a0000", // post
+			hash: "9a66972c8efedb612ab691b5cd7dd60930d0f913be0fe3d9e6e58c73907cbd1f",
+		},
+		{
+			name:     "EmptyPosts",
+			object:   []blockchain.Post{},
+			encoding: "0104" + "00000000",
+			hash:     "a7f2c683f40fc12b19a427d4167ca50660c9a18b8231ad34c1ddd5511c6d3b3a",
+		},
+	}
+	for _, vector := range vectors {
+		encoding := hex.EncodeToString(blockchain.Encode(vector.object))
+		if encoding != vector.encoding {
+			t.Fatalf("wrong encoding of %s: expected %s, got %s", vector.name, vector.encoding, encoding)
+		}
+		hash := hex.EncodeToString(blockchain.Hash(vector.object))
+		if hash != vector.hash {
+			t.Fatalf("wrong hash of %s: expected %s, got %s", vector.name, vector.hash, hash)
+		}
+	}
+
+	// a nil slice is encoded the same as an empty slice
+	if !bytes.Equal(blockchain.Encode([]blockchain.Post(nil)), blockchain.Encode([]blockchain.Post{})) {
+		t.Fatal("nil and empty post lists are encoded differently")
+	}
+}
+
+// TestDifficultyRetargeting checks that the required difficulty follows the recent block timestamps.
+// Blocks mined faster than the target interval raise the difficulty, slower blocks lower it, and the difficulty only
+// changes at multiples of the RetargetInterval of the chain parameters.
+func TestDifficultyRetargeting(t *testing.T) {
+	// makeChain creates a chain of length headers after the genesis block, with a constant interval between their
+	// timestamps
+	makeChain := func(length int, interval int64) []blockchain.Block {
+		chain := []blockchain.Block{chainParams.Genesis}
+		for i := 1; i <= length; i++ {
+			block := blockchain.Block{
+				Header: blockchain.BlockHeader{
+					Timestamp: int64(i) * interval,
+					Bits:      chainParams.NextBits(chain),
+				},
+			}
+			chain = append(chain, block)
+		}
+		return chain
+	}
+	initial := chainParams.InitialBits
+	interval := chainParams.RetargetInterval
+	target := chainParams.TargetBlockInterval
+	step := uint32(chainParams.MaxRetargetStep)
+
+	// the first blocks use the initial difficulty
+	chain := makeChain(interval, time.Millisecond.Nanoseconds())
+	for i, block := range chain {
+		if block.Header.Bits != initial {
+			t.Fatalf("block %d has difficulty %d, expected %d", i, block.Header.Bits, initial)
+		}
+	}
+	// blocks on target keep the difficulty
+	chain = makeChain(interval, target)
+	if bits := chainParams.NextBits(chain); bits != initial {
+		t.Fatalf("difficulty changed to %d for blocks on target", bits)
+	}
+	// blocks 3 times faster than the target go up by one bit
+	chain = makeChain(interval, target/3)
+	if bits := chainParams.NextBits(chain); bits != initial+1 {
+		t.Fatalf("expected difficulty %d for fast blocks, got %d", initial+1, bits)
+	}
+	// much faster or slower blocks change by at most MaxRetargetStep bits
+	chain = makeChain(interval, 1)
+	if bits := chainParams.NextBits(chain); bits != initial+step {
+		t.Fatalf("expected difficulty %d for very fast blocks, got %d", initial+step, bits)
+	}
+	chain = makeChain(interval, 100*target)
+	if bits := chainParams.NextBits(chain); bits != initial-step {
+		t.Fatalf("expected difficulty %d for very slow blocks, got %d", initial-step, bits)
+	}
+	// the difficulty is inherited between retargets
+	chain = makeChain(2*interval, 1)
+	for i := interval + 1; i < len(chain); i++ {
+		if chain[i].Header.Bits != chain[interval+1].Header.Bits {
+			t.Fatalf("difficulty changed between retargets at block %d", i)
+		}
+	}
+
+	// a block must satisfy the difficulty it declares
+	block := blockchain.Block{
+		Header: blockchain.BlockHeader{
+			PrevHash: make([]byte, 32),
+			Summary:  blockchain.MerkleRoot(nil),
+			Bits:     8,
+		},
+	}
+	for !blockchain.CheckPoW(blockchain.Hash(block.Header), block.Header.Bits) {
+		block.Header.Nonce++
+	}
+	if !block.Verify(chainParams) {
+		t.Fatal("the mined block is not valid")
+	}
+	block.Header.Bits = 0
+	if block.Verify(chainParams) {
+		t.Fatal("fails to reject a block without difficulty")
+	}
+}
+
+// TestForkChoice checks that forks are chosen by accumulated work instead of length.
+// It compares forks of equal length but different work, a long chain of cheap blocks against a short chain of
+// expensive blocks, and forks of equal work that must be ordered the same way regardless of argument order.
+func TestForkChoice(t *testing.T) {
+	// makeChain creates a chain of headers with the given difficulties
+	makeChain := func(bits ...uint32) []blockchain.Block {
+		chain := make([]blockchain.Block, 0)
+		for i, b := range bits {
+			chain = append(chain, blockchain.Block{
+				Header: blockchain.BlockHeader{Timestamp: int64(i), Bits: b, Nonce: rand.Uint32()},
+			})
+		}
+		return chain
+	}
+
+	// equal length, different work
+	light := makeChain(20, 20, 20)
+	heavy := makeChain(20, 20, 21)
+	if blockchain.ChainWork(heavy).Cmp(blockchain.ChainWork(light)) <= 0 {
+		t.Fatal("a harder block does not add more work")
+	}
+	if blockchain.CompareChains(heavy, light) != 1 || blockchain.CompareChains(light, heavy) != -1 {
+		t.Fatal("the fork with more work is not preferred")
+	}
+	// longer but less work
+	long := makeChain(18, 18, 18, 18, 18, 18, 18)
+	short := makeChain(21, 21)
+	if blockchain.CompareChains(short, long) != 1 {
+		t.Fatal("a longer chain of cheap blocks beats a shorter chain with more work")
+	}
+	// equal work is broken by the tip hash in both directions
+	fork1 := makeChain(20, 20, 20)
+	fork2 := makeChain(20, 20, 20)
+	for reflect.DeepEqual(fork1, fork2) {
+		fork2 = makeChain(20, 20, 20)
+	}
+	if blockchain.CompareChains(fork1, fork2) != -blockchain.CompareChains(fork2, fork1) ||
+		blockchain.CompareChains(fork1, fork2) == 0 {
+		t.Fatal("tie-break between forks of equal work is not consistent")
+	}
+	if blockchain.CompareChains(fork1, fork1) != 0 {
+		t.Fatal("a chain is not equal to itself")
+	}
+	// blocks declaring an invalid difficulty add no work
+	if blockchain.ChainWork(makeChain(0, blockchain.MaxBits+1)).Sign() != 0 {
+		t.Fatal("invalid difficulties add work")
+	}
+}
+
+// TestMerkleProof checks the Merkle root used as a block's Summary and the inclusion proofs built from it.
+// For blocks of different sizes, the proof of every post must verify against the root, and must fail for a different
+// post, a different root, or a tampered proof.
+func TestMerkleProof(t *testing.T) {
+	privateKey := blockchain.GenerateKey(blockchain.RSA)
+	posts := make([]blockchain.Post, 0)
+	for i := 0; i < 9; i++ {
+		post := blockchain.Post{
+			User: privateKey.Public(),
+			Body: blockchain.PostBody{
+				ChainID:   blockchain.DefaultChainID,
+				Content:   fmt.Sprintf("Hello from %d", i),
+				Timestamp: time.Now().UnixNano(),
+			},
+		}
+		post.Signature = blockchain.Sign(privateKey, post.Body)
+		posts = append(posts, post)
+	}
+	if len(blockchain.MerkleRoot(nil)) != 32 {
+		t.Fatal("wrong Merkle root of an empty block")
+	}
+	if !bytes.Equal(blockchain.MerkleRoot(posts[:1]), blockchain.Hash(posts[0])) {
+		t.Fatal("the Merkle root of a single post is not its hash")
+	}
+
+	for n := 1; n <= len(posts); n++ {
+		root := blockchain.MerkleRoot(posts[:n])
+		for i := 0; i < n; i++ {
+			proof, err := blockchain.NewMerkleProof(posts[:n], i)
+			if err != nil {
+				t.Fatalf("failed to build proof %d of %d: %v", i, n, err)
+			}
+			// encoding and then decoding should return the identical proof
+			encoded := proof.EncodeBase64()
+			proof, _ = encoded.DecodeBase64()
+			if !proof.Verify(posts[i], root) {
+				t.Fatalf("proof %d of %d does not verify", i, n)
+			}
+			if n > 1 && proof.Verify(posts[(i+1)%n], root) {
+				t.Fatalf("proof %d of %d verifies a different post", i, n)
+			}
+			if proof.Verify(posts[i], blockchain.MerkleRoot(posts[:n-1])) {
+				t.Fatalf("proof %d of %d verifies against a different root", i, n)
+			}
+			if len(proof.Siblings) > 0 {
+				proof.Siblings[0][0] ^= 1
+				if proof.Verify(posts[i], root) {
+					t.Fatalf("fails to detect a tamper of proof %d of %d", i, n)
+				}
+				proof.Siblings = proof.Siblings[1:]
+				if proof.Verify(posts[i], root) {
+					t.Fatalf("fails to detect a truncated proof %d of %d", i, n)
+				}
+			}
+		}
+	}
+	if _, err := blockchain.NewMerkleProof(posts, len(posts)); err == nil {
+		t.Fatal("built a proof for a post out of range")
+	}
+}
+
+// TestChainValidation checks that blockchain.Chain.Validate accepts a valid blockchain, and reports the reason and
+// the height of the first offending block for each kind of invalid blockchain.
+func TestChainValidation(t *testing.T) {
+	post1 := NewSignedPost("Hello from 1")
+	post2 := NewSignedPost("Hello from 2")
+	chain := []blockchain.Block{chainParams.Genesis}
+	chain = append(chain, NextBlock(chain, []blockchain.Post{post1}))
+	chain = append(chain, NextBlock(chain, []blockchain.Post{post2}))
+	if err := blockchain.Chain(chain).Validate(chainParams); err != nil {
+		t.Fatalf("valid blockchain is rejected: %v", err)
+	}
+	if err := blockchain.Chain(nil).Validate(chainParams); err != nil {
+		t.Fatalf("empty blockchain is rejected: %v", err)
+	}
+
+	// expectError checks that Validate fails with reason at height
+	expectError := func(name string, chain []blockchain.Block, reason error, height int) {
+		err := blockchain.Chain(chain).Validate(chainParams)
+		var validationError *blockchain.ValidationError
+		if !errors.As(err, &validationError) || !errors.Is(err, reason) {
+			t.Fatalf("%s: expected %v, got %v", name, reason, err)
+		}
+		if validationError.Height != height {
+			t.Fatalf("%s: expected height %d, got %d", name, height, validationError.Height)
+		}
+	}
+	// copyChain copies the blocks of a chain, but not the posts
+	copyChain := func(chain []blockchain.Block) []blockchain.Block {
+		return append(make([]blockchain.Block, 0), chain...)
+	}
+
+	// tamper the nonce
+	tampered := copyChain(chain)
+	tampered[2].Header.Nonce++
+	for blockchain.CheckPoW(blockchain.Hash(tampered[2].Header), tampered[2].Header.Bits) {
+		tampered[2].Header.Nonce++
+	}
+	expectError("nonce", tampered, blockchain.ErrBadPoW, 2)
+
+	// tamper the posts
+	tampered = copyChain(chain)
+	tampered[1].Posts = []blockchain.Post{post2}
+	expectError("posts", tampered, blockchain.ErrBadSummary, 1)
+
+	// a post with a forged signature
+	forged := post2
+	forged.Body.Content = "Forged"
+	tampered = copyChain(chain[:2])
+	tampered = append(tampered, NextBlock(tampered, []blockchain.Post{forged}))
+	expectError("signature", tampered, blockchain.ErrBadSignature, 2)
+
+	// a block on top of another block
+	tampered = copyChain(chain[:2])
+	tampered = append(tampered, NextBlock(chain[:1], []blockchain.Post{post2}))
+	expectError("link", tampered, blockchain.ErrBrokenLink, 2)
+	expectError("no genesis", chain[1:], blockchain.ErrBadGenesis, 0)
+
+	// a post that is already on the blockchain
+	tampered = copyChain(chain)
+	tampered = append(tampered, NextBlock(tampered, []blockchain.Post{post1}))
+	expectError("duplicate", tampered, blockchain.ErrDuplicatePost, 3)
+
+	// a block easier than required
+	easy := blockchain.Block{
+		Header: blockchain.BlockHeader{
+			PrevHash:  blockchain.Hash(chain[2].Header),
+			Summary:   blockchain.MerkleRoot(nil),
+			Timestamp: time.Now().UnixNano(),
+			Bits:      chainParams.InitialBits - 4,
+		},
+	}
+	tampered = copyChain(chain)
+	tampered = append(tampered, MineBlock(easy))
+	expectError("difficulty", tampered, blockchain.ErrBadDifficulty, 3)
+}
+
+// TestSignatureSchemes checks that posts can be signed with either RSA or Ed25519 keys.
+// For each scheme, a signed post must verify, survive encoding and decoding, and detect a tamper, and the private key
+// must survive encoding and decoding. Signatures must not verify under a key of the other scheme, and posts from
+// clients that send untagged RSA keys must still verify.
+func TestSignatureSchemes(t *testing.T) {
+	algorithms := []blockchain.Algorithm{blockchain.RSA, blockchain.Ed25519}
+	posts := make([]blockchain.Post, 0)
+	for _, algorithm := range algorithms {
+		privateKey := blockchain.GenerateKey(algorithm)
+		if privateKey.Public().Algorithm() != algorithm {
+			t.Fatalf("generated a key of algorithm %#x instead of %#x", privateKey.Public().Algorithm(), algorithm)
+		}
+		post := blockchain.Post{
+			User: privateKey.Public(),
+			Body: blockchain.PostBody{
+				ChainID:   blockchain.DefaultChainID,
+				Content:   "Hello World",
+				Timestamp: time.Now().UnixNano(),
+			},
+		}
+		post.Signature = blockchain.Sign(privateKey, post.Body)
+		if !post.Verify() {
+			t.Fatalf("post is not signed correctly with algorithm %#x", algorithm)
+		}
+		encoded := post.EncodeBase64()
+		decoded, err := encoded.DecodeBase64()
+		if err != nil || !reflect.DeepEqual(post, decoded) {
+			t.Fatalf("post with algorithm %#x is not encoded or decoded correctly", algorithm)
+		}
+		tampered := post
+		tampered.Body.Content = "Bye World"
+		if tampered.Verify() {
+			t.Fatalf("signature with algorithm %#x fails to detect a tamper of content", algorithm)
+		}
+		der, err := blockchain.MarshalPrivateKey(privateKey)
+		if err != nil {
+			t.Fatalf("failed to encode a private key with algorithm %#x: %v", algorithm, err)
+		}
+		parsed, err := blockchain.ParsePrivateKey(der)
+		if err != nil || !reflect.DeepEqual(parsed.Public(), privateKey.Public()) {
+			t.Fatalf("private key with algorithm %#x is not encoded or decoded correctly", algorithm)
+		}
+		posts = append(posts, post)
+	}
+
+	// a signature does not verify under a key of another scheme
+	mixed := posts[0]
+	mixed.Signature = posts[1].Signature
+	if mixed.Verify() {
+		t.Fatal("an ed25519 signature verifies under an rsa key")
+	}
+	mixed = posts[1]
+	mixed.Signature = posts[0].Signature
+	if mixed.Verify() {
+		t.Fatal("an rsa signature verifies under an ed25519 key")
+	}
+
+	// untagged rsa keys are still accepted
+	encoded := posts[0].EncodeBase64()
+	tagged, _ := base64.StdEncoding.DecodeString(encoded.User)
+	encoded.User = base64.StdEncoding.EncodeToString(tagged[1:])
+	decoded, err := encoded.DecodeBase64()
+	if err != nil {
+		t.Fatalf("failed to decode a post with an untagged rsa key: %v", err)
+	}
+	if !decoded.Verify() || !reflect.DeepEqual(decoded, posts[0]) {
+		t.Fatal("post with an untagged rsa key does not verify")
+	}
+
+	// unknown or malformed keys are rejected
+	if _, err := blockchain.PublicKeyFromBytes([]byte{0x30, 1, 2, 3}); err == nil {
+		t.Fatal("accepted a key with an unknown algorithm")
+	}
+	if _, err := blockchain.PublicKeyFromBytes([]byte{byte(blockchain.Ed25519), 1, 2, 3}); err == nil {
+		t.Fatal("accepted an ed25519 key of the wrong length")
+	}
+	if _, err := blockchain.PublicKeyFromBytes(nil); err == nil {
+		t.Fatal("accepted an empty key")
+	}
+	rsaKey := posts[0].User.(blockchain.RSAPublicKey).Key
+	short := blockchain.RSAPublicKey{Key: &rsa.PublicKey{N: new(big.Int).Rsh(rsaKey.N, 1024), E: rsaKey.E}}
+	if _, err := blockchain.PublicKeyFromBytes(blockchain.PublicKeyToBytes(short)); err == nil {
+		t.Fatal("accepted an rsa key of 1024 bits")
+	}
+	for _, exponent := range []int{0, 1, 2, 65536, 1 << 31, 1<<32 - 1} {
+		badExponent := blockchain.RSAPublicKey{Key: &rsa.PublicKey{N: rsaKey.N, E: exponent}}
+		if _, err := blockchain.PublicKeyFromBytes(blockchain.PublicKeyToBytes(badExponent)); err == nil {
+			t.Fatalf("accepted an rsa key with the exponent %d", exponent)
+		}
+	}
+	if _, err := blockchain.ParsePrivateKey([]byte{1, 2, 3}); err == nil {
+		t.Fatal("accepted a malformed private key")
+	}
+
+	// and so are rsa keys of 1024 bits in the standard encodings
+	weakKey, err := rsa.GenerateKey(cryptorand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate an rsa key of 1024 bits: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&weakKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal an rsa key of 1024 bits: %v", err)
+	}
+	if _, err := blockchain.ParsePublicKey(der); err == nil {
+		t.Fatal("accepted an rsa public key of 1024 bits")
+	}
+	der, err = x509.MarshalPKCS8PrivateKey(weakKey)
+	if err != nil {
+		t.Fatalf("failed to marshal an rsa key of 1024 bits: %v", err)
+	}
+	if _, err := blockchain.ParsePrivateKey(der); err == nil {
+		t.Fatal("accepted an rsa private key of 1024 bits")
+	}
+}
+
+// TestTimestampRules checks the consensus rules for block timestamps.
+// A block must be later than the median timestamp of the previous blocks, and must not be dated too far past the
+// local time. Back-dated and future-dated blocks are rejected, while a block just after the median is accepted.
+func TestTimestampRules(t *testing.T) {
+	chain := []blockchain.Block{chainParams.Genesis}
+	for i := 0; i < 3; i++ {
+		chain = append(chain, NextBlock(chain, nil))
+	}
+	if err := blockchain.Chain(chain).Validate(chainParams); err != nil {
+		t.Fatalf("valid blockchain is rejected: %v", err)
+	}
+	median := blockchain.MedianTime(chain)
+	if median != chain[2].Header.Timestamp {
+		t.Fatalf("wrong median time %d, expected %d", median, chain[2].Header.Timestamp)
+	}
+
+	// back-dated to the median
+	backDated := append(chain[:4:4], NextBlockAt(chain, nil, median))
+	err := blockchain.Chain(backDated).Validate(chainParams)
+	if !errors.Is(err, blockchain.ErrTimeTooOld) {
+		t.Fatalf("expected %v for a back-dated block, got %v", blockchain.ErrTimeTooOld, err)
+	}
+	// earlier than the parent, but later than the median
+	earlier := append(chain[:4:4], NextBlockAt(chain, nil, median+1))
+	if err := blockchain.Chain(earlier).Validate(chainParams); err != nil {
+		t.Fatalf("block later than the median is rejected: %v", err)
+	}
+
+	// future-dated past the allowed drift
+	future := NextBlockAt(chain, nil, time.Now().UnixNano()+2*blockchain.MaxFutureDrift)
+	if future.Verify(chainParams) {
+		t.Fatal("fails to reject a future-dated block")
+	}
+	err = blockchain.Chain(append(chain[:4:4], future)).Validate(chainParams)
+	if !errors.Is(err, blockchain.ErrTimeTooNew) {
+		t.Fatalf("expected %v for a future-dated block, got %v", blockchain.ErrTimeTooNew, err)
+	}
+	// slightly in the future, within the allowed drift
+	drifted := NextBlockAt(chain, nil, time.Now().UnixNano()+blockchain.MaxFutureDrift/2)
+	if err := blockchain.Chain(append(chain[:4:4], drifted)).Validate(chainParams); err != nil {
+		t.Fatalf("block within the allowed drift is rejected: %v", err)
+	}
+}
+
+// TestBlockLimits checks that the limits on posts per block, bytes per block and content length are consensus rules.
+// Blocks exceeding any of them are rejected before their proof-of-work is even checked.
+func TestBlockLimits(t *testing.T) {
+	// makeBlock creates an unmined block containing posts
+	makeBlock := func(posts []blockchain.Post) blockchain.Block {
+		return blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  make([]byte, 32),
+				Summary:   blockchain.MerkleRoot(posts),
+				Timestamp: time.Now().UnixNano(),
+				Bits:      chainParams.InitialBits,
+			},
+			Posts: posts,
+		}
+	}
+
+	// too many posts
+	posts := make([]blockchain.Post, 0)
+	for i := 0; i <= chainParams.MaxPostsPerBlock; i++ {
+		posts = append(posts, NewSignedPost(fmt.Sprintf("Hello from %d", i)))
+	}
+	block := makeBlock(posts)
+	if err := block.Validate(chainParams); !errors.Is(err, blockchain.ErrTooManyPosts) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrTooManyPosts, err)
+	}
+
+	// too many bytes
+	content := strings.Repeat("a", chainParams.MaxContentLength)
+	posts = make([]blockchain.Post, 0)
+	for blockchain.BlockSize(posts) <= chainParams.MaxBlockBytes {
+		posts = append(posts, NewSignedPost(content))
+	}
+	if len(posts) > chainParams.MaxPostsPerBlock {
+		t.Fatalf("cannot exceed the block size with %d posts", chainParams.MaxPostsPerBlock)
+	}
+	block = makeBlock(posts)
+	if err := block.Validate(chainParams); !errors.Is(err, blockchain.ErrBlockTooLarge) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrBlockTooLarge, err)
+	}
+
+	// content too long
+	post := NewSignedPost(content + "a")
+	if err := post.Validate(chainParams); !errors.Is(err, blockchain.ErrContentTooLong) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrContentTooLong, err)
+	}
+	block = makeBlock([]blockchain.Post{post})
+	if err := block.Validate(chainParams); !errors.Is(err, blockchain.ErrContentTooLong) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrContentTooLong, err)
+	}
+	err := blockchain.Chain([]blockchain.Block{chainParams.Genesis, block}).Validate(chainParams)
+	if !errors.Is(err, blockchain.ErrContentTooLong) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrContentTooLong, err)
+	}
+
+	// a post at the limit is fine
+	post = NewSignedPost(content)
+	if err := post.Validate(chainParams); err != nil {
+		t.Fatalf("post at the content limit is rejected: %v", err)
+	}
+
+	// a post that does not fit in a block on its own
+	smallBlocks := blockchain.NewChainParams(blockchain.DefaultChainID)
+	smallBlocks.MaxBlockBytes = chainParams.MaxContentLength / 2
+	if err := post.Validate(smallBlocks); !errors.Is(err, blockchain.ErrPostTooLarge) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrPostTooLarge, err)
+	}
+}
+
+// TestChainParams checks that networks with different chain IDs are kept apart.
+// Each network has its own genesis block, a post signed for one network is rejected on another, and a blockchain
+// that starts from a foreign genesis block is rejected.
+func TestChainParams(t *testing.T) {
+	testParams := blockchain.NewChainParams("test")
+	if !reflect.DeepEqual(blockchain.DefaultChainParams().Genesis, chainParams.Genesis) {
+		t.Fatal("the genesis block is not deterministic")
+	}
+	if bytes.Equal(blockchain.Hash(testParams.Genesis.Header), blockchain.Hash(chainParams.Genesis.Header)) {
+		t.Fatal("different networks have the same genesis block")
+	}
+
+	// parameters that cannot run a network
+	if err := chainParams.Validate(); err != nil {
+		t.Fatalf("default parameters are invalid: %v", err)
+	}
+	invalid := map[string]func(params *blockchain.ChainParams){
+		"no retargeting":     func(params *blockchain.ChainParams) { params.RetargetInterval = 0 },
+		"no block interval":  func(params *blockchain.ChainParams) { params.TargetBlockInterval = 0 },
+		"no retarget step":   func(params *blockchain.ChainParams) { params.MaxRetargetStep = -1 },
+		"no posts":           func(params *blockchain.ChainParams) { params.MaxPostsPerBlock = 0 },
+		"no block bytes":     func(params *blockchain.ChainParams) { params.MaxBlockBytes = -1 },
+		"no content":         func(params *blockchain.ChainParams) { params.MaxContentLength = 0 },
+		"too easy":           func(params *blockchain.ChainParams) { params.InitialBits = blockchain.MinBits - 1 },
+		"harder than a hash": func(params *blockchain.ChainParams) { params.InitialBits = blockchain.MaxBits + 1 },
+	}
+	for name, change := range invalid {
+		params := blockchain.NewChainParams("test")
+		change(params)
+		if err := params.Validate(); err == nil {
+			t.Fatalf("expected parameters with %s to be invalid", name)
+		}
+	}
+
+	// a post signed for another network
+	privateKey := blockchain.GenerateKey(blockchain.Ed25519)
+	post := blockchain.Post{
+		User: privateKey.Public(),
+		Body: blockchain.PostBody{
+			ChainID:   testParams.ChainID,
+			Content:   "Hello World",
+			Timestamp: time.Now().UnixNano(),
+		},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	if err := post.Validate(testParams); err != nil {
+		t.Fatalf("post is rejected on its own network: %v", err)
+	}
+	if err := post.Validate(chainParams); !errors.Is(err, blockchain.ErrWrongChain) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrWrongChain, err)
+	}
+	// changing the chain ID breaks the signature
+	replayed := post
+	replayed.Body.ChainID = chainParams.ChainID
+	if err := replayed.Validate(chainParams); !errors.Is(err, blockchain.ErrBadSignature) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrBadSignature, err)
+	}
+	block := NextBlock([]blockchain.Block{chainParams.Genesis}, []blockchain.Post{post})
+	err := blockchain.Chain([]blockchain.Block{chainParams.Genesis, block}).Validate(chainParams)
+	if !errors.Is(err, blockchain.ErrWrongChain) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrWrongChain, err)
+	}
+
+	// a blockchain of another network
+	testChain := []blockchain.Block{testParams.Genesis}
+	testChain = append(testChain, NextBlock(testChain, []blockchain.Post{post}))
+	if err := blockchain.Chain(testChain).Validate(testParams); err != nil {
+		t.Fatalf("blockchain is rejected on its own network: %v", err)
+	}
+	err = blockchain.Chain(testChain).Validate(chainParams)
+	var validationError *blockchain.ValidationError
+	if !errors.As(err, &validationError) || !errors.Is(err, blockchain.ErrBadGenesis) || validationError.Height != 0 {
+		t.Fatalf("expected %v at block 0, got %v", blockchain.ErrBadGenesis, err)
+	}
+}
+
+// TestPostID checks that posts are identified by the hash of their canonical encoding.
+// Two different posts from the same user at the same timestamp have different IDs, are ordered consistently, and can
+// both be on the blockchain, while the same post twice is a duplicate.
+func TestPostID(t *testing.T) {
+	privateKey := blockchain.GenerateKey(blockchain.Ed25519)
+	timestamp := time.Now().UnixNano()
+	posts := make([]blockchain.Post, 0)
+	for _, content := range []string{"Hello", "World"} {
+		post := blockchain.Post{
+			User: privateKey.Public(),
+			Body: blockchain.PostBody{
+				ChainID:   blockchain.DefaultChainID,
+				Content:   content,
+				Timestamp: timestamp,
+			},
+		}
+		post.Signature = blockchain.Sign(privateKey, post.Body)
+		posts = append(posts, post)
+	}
+	if !bytes.Equal(posts[0].ID(), blockchain.Hash(posts[0])) {
+		t.Fatal("post ID is not the hash of the post")
+	}
+	if bytes.Equal(posts[0].ID(), posts[1].ID()) {
+		t.Fatal("different posts have the same ID")
+	}
+	if blockchain.ComparePosts(&posts[0], &posts[1]) == 0 ||
+		blockchain.ComparePosts(&posts[0], &posts[1]) != -blockchain.ComparePosts(&posts[1], &posts[0]) {
+		t.Fatal("posts with the same user and timestamp are not ordered consistently")
+	}
+	if blockchain.ComparePosts(&posts[0], &posts[0]) != 0 {
+		t.Fatal("a post is not equal to itself")
+	}
+
+	chain := []blockchain.Block{chainParams.Genesis}
+	chain = append(chain, NextBlock(chain, posts))
+	if err := blockchain.Chain(chain).Validate(chainParams); err != nil {
+		t.Fatalf("posts with the same user and timestamp are rejected: %v", err)
+	}
+	chain = append(chain, NextBlock(chain, posts[1:]))
+	if err := blockchain.Chain(chain).Validate(chainParams); !errors.Is(err, blockchain.ErrDuplicatePost) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrDuplicatePost, err)
+	}
+}
+
+// TestHeaderValidation checks the cheaper validations used to sync with peers.
+// ValidateHeaders accepts a fork without its posts but rejects a broken header, and ValidateFrom only validates the
+// blocks from the given height on, while still detecting posts duplicated from earlier blocks.
+func TestHeaderValidation(t *testing.T) {
+	post := NewSignedPost("Hello World")
+	chain := []blockchain.Block{chainParams.Genesis}
+	chain = append(chain, NextBlock(chain, []blockchain.Post{post}))
+	chain = append(chain, NextBlock(chain, nil))
+
+	// headers only
+	headers := make([]blockchain.Block, 0)
+	for _, block := range chain {
+		headers = append(headers, blockchain.Block{Header: block.Header})
+	}
+	if err := blockchain.Chain(headers).ValidateHeaders(chainParams, 0); err != nil {
+		t.Fatalf("valid headers are rejected: %v", err)
+	}
+	if err := blockchain.Chain(headers).Validate(chainParams); !errors.Is(err, blockchain.ErrBadSummary) {
+		t.Fatalf("expected %v for blocks without their posts, got %v", blockchain.ErrBadSummary, err)
+	}
+	headers[2].Header.Timestamp++
+	for blockchain.CheckPoW(blockchain.Hash(headers[2].Header), headers[2].Header.Bits) {
+		headers[2].Header.Timestamp++
+	}
+	err := blockchain.Chain(headers).ValidateHeaders(chainParams, 1)
+	if !errors.Is(err, blockchain.ErrBadPoW) {
+		t.Fatalf("expected %v for a tampered header, got %v", blockchain.ErrBadPoW, err)
+	}
+
+	// blocks before start are trusted
+	tampered := append(make([]blockchain.Block, 0), chain...)
+	tampered[1].Header.Nonce++
+	tampered[2] = NextBlock(tampered[:2], nil)
+	if err := blockchain.Chain(tampered).ValidateFrom(chainParams, 2); err != nil {
+		t.Fatalf("blocks before start are validated: %v", err)
+	}
+	if err := blockchain.Chain(tampered).ValidateFrom(chainParams, 1); err == nil {
+		t.Fatal("fails to detect a tampered block after start")
+	}
+	// but their posts still count as duplicates
+	duplicate := append(chain[:3:3], NextBlock(chain, []blockchain.Post{post}))
+	err = blockchain.Chain(duplicate).ValidateFrom(chainParams, 3)
+	if !errors.Is(err, blockchain.ErrDuplicatePost) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrDuplicatePost, err)
+	}
+
+	// or are looked up in an index of the posts before start
+	postHeights := map[string]int{string(post.ID()): 1}
+	err = blockchain.Chain(duplicate).ValidateIndexed(chainParams, 3, postHeights)
+	if !errors.Is(err, blockchain.ErrDuplicatePost) {
+		t.Fatalf("expected %v, got %v", blockchain.ErrDuplicatePost, err)
+	}
+	if err := blockchain.Chain(duplicate).ValidateIndexed(chainParams, 3, map[string]int{}); err != nil {
+		t.Fatalf("posts before start are hashed again instead of looked up: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	Miner "blockchain/miner"
+	Tracker "blockchain/tracker"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestConfig checks that miner and tracker settings are read from YAML and JSON files on top of the defaults, that
+// unknown or invalid settings are rejected, and that a miner and a tracker created from settings work together.
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	// write creates a settings file in dir
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("error when writing %s: %v", name, err)
+		}
+		return path
+	}
+
+	trackerConfig, err := Tracker.LoadConfig(write("tracker.yaml", "port: 8090\nentry-timeout: 2s\n"))
+	if err != nil {
+		t.Fatalf("error when loading tracker settings: %v", err)
+	}
+	if trackerConfig.Port != 8090 || trackerConfig.EntryTimeout != 2*time.Second ||
+		trackerConfig.Host != Tracker.DefaultConfig().Host {
+		t.Fatalf("tracker settings are not loaded on top of the defaults: %+v", trackerConfig)
+	}
+	minerConfig, err := Miner.LoadConfig(write("miner.json",
+		`{"port": 3027, "tracker": "localhost:8090", "workers": 2, "heartbeat-min": "50ms", "heartbeat-max": "100ms"}`))
+	if err != nil {
+		t.Fatalf("error when loading miner settings: %v", err)
+	}
+	defaults := Miner.DefaultConfig()
+	if minerConfig.Port != 3027 || minerConfig.Tracker != "localhost:8090" || minerConfig.Workers != 2 ||
+		minerConfig.HeartbeatMin != 50*time.Millisecond || minerConfig.HeartbeatMax != 100*time.Millisecond ||
+		minerConfig.SyncMin != defaults.SyncMin || minerConfig.ChainID != defaults.ChainID {
+		t.Fatalf("miner settings are not loaded on top of the defaults: %+v", minerConfig)
+	}
+	if _, err := Miner.LoadConfig(write("empty.yaml", "")); err != nil {
+		t.Fatalf("an empty settings file is rejected: %v", err)
+	}
+
+	// unknown and invalid settings
+	for name, content := range map[string]string{
+		"typo.yaml":      "prot: 3027\n",
+		"port.yaml":      "port: 70000\n",
+		"tracker.yaml":   "tracker: 8090\n",
+		"trackers.yaml":  "trackers: [localhost:8090, 8091]\n",
+		"workers.yaml":   "workers: 0\n",
+		"heartbeat.yaml": "heartbeat-min: 1s\nheartbeat-max: 500ms\n",
+		"duration.yaml":  "sync-min: soon\n",
+	} {
+		if _, err := Miner.LoadConfig(write(name, content)); err == nil {
+			t.Fatalf("miner settings %q are accepted", content)
+		}
+	}
+	if _, err := Tracker.LoadConfig(write("timeout.yaml", "entry-timeout: 0s\n")); err == nil {
+		t.Fatalf("tracker settings with no entry timeout are accepted")
+	}
+	if _, err := Tracker.LoadConfig(write("peers.yaml", "peers: [8091]\n")); err == nil {
+		t.Fatalf("tracker settings with an invalid peer tracker are accepted")
+	}
+	if _, err := Tracker.LoadConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Fatalf("a missing settings file is accepted")
+	}
+
+	// a miner and a tracker created from the settings
+	tracker, err := Tracker.NewTrackerWithConfig(trackerConfig)
+	if err != nil {
+		t.Fatalf("error when creating tracker: %v", err)
+	}
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	miner, err := Miner.NewMinerWithConfig(minerConfig)
+	if err != nil {
+		t.Fatalf("error when creating miner: %v", err)
+	}
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	var response Tracker.PortsJson
+	if code, err := GetJSON("http://localhost:8090/get_miners", &response); err != nil || code != 200 {
+		t.Fatalf("error when getting miners: %d %v", code, err)
+	}
+	if fmt.Sprint(response.Ports) != "[3027]" {
+		t.Fatalf("expected the miner to register to the tracker, got %v", response.Ports)
+	}
+	if _, err := Miner.NewMinerWithConfig(Miner.Config{Port: 3027}); err == nil {
+		t.Fatalf("a miner is created without a tracker")
+	}
+}
@@ -3,12 +3,26 @@ package tests
 import (
 	"blockchain/blockchain"
 	Miner "blockchain/miner"
+	"blockchain/peer"
+	"blockchain/store"
 	Tracker "blockchain/tracker"
 	User "blockchain/user"
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,13 +38,16 @@ func TestMaliciousUser(t *testing.T) {
 	legitimateMiner := Miner.NewMiner(3003, 8082)
 	legitimateMiner.Start()
 	defer legitimateMiner.Shutdown()
+	if !WaitForMiner(8082, PeerAddress(3003)) {
+		t.Fatal("expected the miner to register to the tracker")
+	}
 
 	// Create a malicious user
 	maliciousUser := User.NewUser(8082)
 
 	// Malicious user attempts to post a legitimate message
 	legitimateContent := "Legitimate content"
-	err := maliciousUser.WritePost(legitimateContent)
+	_, err := maliciousUser.WritePost(legitimateContent)
 	if err != nil {
 		t.Fatalf("error when posting legitimate content: %v", err)
 	}
@@ -39,6 +56,9 @@ func TestMaliciousUser(t *testing.T) {
 	time.Sleep(20000 * time.Millisecond)
 
 	// Attempt to duplicate the legitimate post
+	if !WaitForMiner(8082, PeerAddress(3003)) {
+		t.Fatal("expected the miner to stay registered to the tracker")
+	}
 	posts, err := maliciousUser.ReadPosts()
 	if err != nil {
 		t.Fatalf("error reading user's posts: %v", err)
@@ -60,13 +80,14 @@ func TestMaliciousUser(t *testing.T) {
 	// Malicious user modifies a post's content without updating the signature correctly
 	tamperedContent := "Tampered content"
 	maliciousPost := blockchain.Post{
-		User: &blockchain.GenerateKey().PublicKey, // New key simulating another user's identity or a new identity
+		User: blockchain.GenerateKey(blockchain.RSA).Public(), // New key simulating another user's identity or a new identity
 		Body: blockchain.PostBody{
+			ChainID:   blockchain.DefaultChainID,
 			Content:   tamperedContent,
 			Timestamp: time.Now().UnixNano(),
 		},
 	}
-	maliciousPost.Signature = blockchain.Sign(blockchain.GenerateKey(), maliciousPost.Body) // Incorrect signature
+	maliciousPost.Signature = blockchain.Sign(blockchain.GenerateKey(blockchain.RSA), maliciousPost.Body) // Incorrect signature
 	maliciousPostEncoded := maliciousPost.EncodeBase64()
 	maliciousPostJSON, _ := json.Marshal(maliciousPostEncoded)
 	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/write", 3003), "application/json", bytes.NewBuffer(maliciousPostJSON))
@@ -78,6 +99,9 @@ func TestMaliciousUser(t *testing.T) {
 	}
 
 	// Check that only the legitimate post is on the blockchain
+	if !WaitForMiner(8082, PeerAddress(3003)) {
+		t.Fatal("expected the miner to stay registered to the tracker")
+	}
 	posts, err = maliciousUser.ReadPosts()
 	if err != nil {
 		t.Fatalf("error when reading posts: %v", err)
@@ -99,10 +123,11 @@ func TestMaliciousMiner(t *testing.T) {
 	// wait for everything to start
 	time.Sleep(1000 * time.Millisecond)
 	// post one message
-	privateKey := blockchain.GenerateKey()
+	privateKey := blockchain.GenerateKey(blockchain.RSA)
 	post := blockchain.Post{
-		User: &privateKey.PublicKey,
+		User: privateKey.Public(),
 		Body: blockchain.PostBody{
+			ChainID:   blockchain.DefaultChainID,
 			Content:   "Legitimate content",
 			Timestamp: time.Now().UnixNano(),
 		},
@@ -121,6 +146,23 @@ func TestMaliciousMiner(t *testing.T) {
 	// wait for a block to be mined
 	time.Sleep(20000 * time.Millisecond)
 
+	// signed sends body to the miner's API at path, signed by a fake peer on port that is registered to the tracker,
+	// and returns the status code and the error of the response
+	signed := func(port int, path string, body []byte) (int, string) {
+		key := blockchain.GenerateKey(blockchain.Ed25519)
+		if !WaitForPeer(8080, 3000, port, key) {
+			t.Fatal("expected the miner to learn the node key of the peer")
+		}
+		resp, err := peer.Post("http://localhost:3000"+path, body, PeerAddress(port), key)
+		if err != nil {
+			t.Fatalf("error when sending %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var response map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, response["error"]
+	}
+
 	// tries to attack miner's /sync API with a fake post
 	fakePost, _ := postBase64.DecodeBase64()
 	fakePost.Body.Content = "Malicious content"
@@ -128,21 +170,43 @@ func TestMaliciousMiner(t *testing.T) {
 	syncReq := Miner.PostsJson{}
 	syncReq.Posts = append(syncReq.Posts, fakePostBase64)
 	fakePostJson, _ := json.Marshal(syncReq)
-	resp, _ = http.Post("http://localhost:3000/sync", "application/json", bytes.NewReader(fakePostJson))
-	resp.Body.Close()
+	code, message := signed(3170, "/sync", fakePostJson)
+	if code != http.StatusBadRequest || !strings.Contains(message, blockchain.ErrBadSignature.Error()) {
+		t.Fatalf("expected the fake post to be rejected for its signature, got %d %q", code, message)
+	}
 
-	// tries to attack miner's /sync API with a replayed post
-	resp, _ = http.Post("http://localhost:3000/sync", "application/json", bytes.NewReader(postJSON))
-	resp.Body.Close()
+	// tries to attack miner's /sync API with a replayed post, which is skipped
+	replayJson, _ := json.Marshal(Miner.PostsJson{Posts: []blockchain.PostBase64{postBase64}})
+	if code, message := signed(3171, "/sync", replayJson); code != http.StatusOK {
+		t.Fatalf("expected the replayed post to be skipped, got %d %q", code, message)
+	}
 
-	// tries to attack miner's /broadcast API with a very long, fake blockchain
-	fakeBlockchain := make([]blockchain.BlockBase64, 100)
+	// tries to attack miner's /broadcast API with a very long, fake blockchain without proof-of-work
+	fakeChain := []blockchain.Block{chainParams.Genesis}
+	fakeBlockchain := []blockchain.BlockBase64{chainParams.Genesis.EncodeBase64()}
+	for i := 1; i < 100; i++ {
+		block := blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.Hash(fakeChain[i-1].Header),
+				Summary:   blockchain.MerkleRoot(nil),
+				Timestamp: time.Now().UnixNano(),
+				Bits:      chainParams.NextBits(fakeChain),
+			},
+		}
+		fakeChain = append(fakeChain, block)
+		fakeBlockchain = append(fakeBlockchain, block.EncodeBase64())
+	}
 	fakeBroadcastReq := Miner.BlockChainJson{Blockchain: fakeBlockchain}
 	fakeBroadcastJson, _ := json.Marshal(fakeBroadcastReq)
-	resp, _ = http.Post("http://localhost:3000/broadcast", "application/json", bytes.NewReader(fakeBroadcastJson))
-	resp.Body.Close()
+	code, message = signed(3172, "/broadcast", fakeBroadcastJson)
+	if code != http.StatusBadRequest || !strings.Contains(message, blockchain.ErrBadPoW.Error()) {
+		t.Fatalf("expected the fake blockchain to be rejected for its proof-of-work, got %d %q", code, message)
+	}
 
 	time.Sleep(10000 * time.Millisecond)
+	if !WaitForMiner(8080, PeerAddress(3000)) {
+		t.Fatal("expected the miner to stay registered to the tracker")
+	}
 	user := User.NewUser(8080)
 	posts, err := user.ReadPosts()
 	if err != nil {
@@ -160,3 +224,1515 @@ func TestMaliciousMiner(t *testing.T) {
 	miner.Shutdown()
 	tracker.Shutdown()
 }
+
+// TestInclusionProof - Tests that a miner returns a Merkle proof that lets a client check a post's inclusion with only
+// the block header.
+func TestInclusionProof(t *testing.T) {
+	tracker := Tracker.NewTracker(8084)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	miner := Miner.NewMiner(3020, 8084)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	// post one message
+	privateKey := blockchain.GenerateKey(blockchain.RSA)
+	post := blockchain.Post{
+		User: privateKey.Public(),
+		Body: blockchain.PostBody{
+			ChainID:   blockchain.DefaultChainID,
+			Content:   "Included content",
+			Timestamp: time.Now().UnixNano(),
+		},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	postJSON, _ := json.Marshal(post.EncodeBase64())
+	resp, err := http.Post("http://localhost:3020/write", "application/json", bytes.NewReader(postJSON))
+	if err != nil {
+		t.Fatalf("error when writing blockchain: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("miner rejected post: status code %d", resp.StatusCode)
+	}
+
+	// wait for the post to be mined
+	url := fmt.Sprintf("http://localhost:3020/proof/%s", hex.EncodeToString(blockchain.Hash(post)))
+	var response Miner.ProofJson
+	for i := 0; ; i++ {
+		if i == 200 {
+			t.Fatalf("post is not mined in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		resp, err = http.Get(url)
+		if err != nil {
+			t.Fatalf("error when requesting proof: %v", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&response)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("miner sends invalid proof: %v", err)
+			}
+			break
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected status code %d", resp.StatusCode)
+		}
+	}
+
+	// the header and proof alone show that the post is included
+	header, err := response.Header.DecodeBase64()
+	if err != nil {
+		t.Fatalf("miner sends invalid header: %v", err)
+	}
+	proof, err := response.Proof.DecodeBase64()
+	if err != nil {
+		t.Fatalf("miner sends invalid proof: %v", err)
+	}
+	if !blockchain.CheckPoW(blockchain.Hash(header), header.Bits) {
+		t.Fatalf("header does not have a valid proof-of-work")
+	}
+	if !proof.Verify(post, header.Summary) {
+		t.Fatalf("proof does not show that the post is included")
+	}
+	chain := ReadBlockchain(3020)
+	if response.Height >= len(chain) || !reflect.DeepEqual(chain[response.Height].Header, header) {
+		t.Fatalf("header does not match the blockchain at height %d", response.Height)
+	}
+
+	// unknown posts are not found
+	resp, err = http.Get(fmt.Sprintf("http://localhost:3020/proof/%s", hex.EncodeToString(make([]byte, 32))))
+	if err != nil {
+		t.Fatalf("error when requesting proof: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status Not Found for an unknown post, but got %d", resp.StatusCode)
+	}
+}
+
+// TestPostLimits - Tests that a miner's /write and /sync APIs reject posts whose content is too long, with an error
+// explaining the limit.
+func TestPostLimits(t *testing.T) {
+	tracker := Tracker.NewTracker(8085)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	miner := Miner.NewMiner(3021, 8085)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	post := NewSignedPost(strings.Repeat("a", chainParams.MaxContentLength+1))
+	postJSON, _ := json.Marshal(post.EncodeBase64())
+	syncJSON, _ := json.Marshal(Miner.PostsJson{Posts: []blockchain.PostBase64{post.EncodeBase64()}})
+	requests := map[string][]byte{"write": postJSON, "sync": syncJSON}
+	// /sync only accepts requests signed by a registered peer
+	nodeKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if _, err := RegisterPeer(8085, 3121, nodeKey); err != nil {
+		t.Fatalf("error when registering a peer: %v", err)
+	}
+	if !WaitForPeer(8085, 3021, 3121, nodeKey) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	for api, body := range requests {
+		resp, err := peer.Post(fmt.Sprintf("http://localhost:3021/%s", api), body, PeerAddress(3121), nodeKey)
+		if err != nil {
+			t.Fatalf("error when posting to /%s: %v", api, err)
+		}
+		var response map[string]string
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status Bad Request from /%s for a long post, but got %d", api, resp.StatusCode)
+		}
+		if !strings.Contains(response["error"], blockchain.ErrContentTooLong.Error()) {
+			t.Fatalf("unclear error from /%s for a long post: %s", api, response["error"])
+		}
+	}
+
+	// the user client refuses to send it
+	user := User.NewUser(8085)
+	if _, err := user.WritePost(post.Body.Content); !errors.Is(err, blockchain.ErrContentTooLong) {
+		t.Fatalf("expected %v when writing a long post, got %v", blockchain.ErrContentTooLong, err)
+	}
+}
+
+// TestPostSize - Tests that a miner's /write API rejects a post that is too large for any block on its own, and that a
+// miner fills a block with the posts that still fit after one that does not.
+func TestPostSize(t *testing.T) {
+	tracker := Tracker.NewTracker(8101)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	// one large post fits in a block, but two do not
+	params := blockchain.NewChainParams(blockchain.DefaultChainID)
+	params.MaxBlockBytes = 2048
+	now := time.Now().UnixNano()
+	large := strings.Repeat("a", 1200)
+	pool := []blockchain.Post{NewSignedPostAt(large, now), NewSignedPostAt(large, now+1), NewSignedPostAt("small", now+2)}
+	dir := t.TempDir()
+	s, _, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if err := s.SavePool(pool); err != nil {
+		t.Fatalf("failed to save pool: %v", err)
+	}
+	s.Close()
+	miner, err := Miner.NewMinerWithStore(3038, 8101, params, dir)
+	if err != nil {
+		t.Fatalf("failed to create miner: %v", err)
+	}
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	post := NewSignedPost(strings.Repeat("a", 3000))
+	postJSON, _ := json.Marshal(post.EncodeBase64())
+	resp, err := http.Post("http://localhost:3038/write", "application/json", bytes.NewReader(postJSON))
+	if err != nil {
+		t.Fatalf("error when posting to /write: %v", err)
+	}
+	var response map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(response["error"], blockchain.ErrPostTooLarge.Error()) {
+		t.Fatalf("expected /write to refuse a post larger than a block, got %d %s", resp.StatusCode, response["error"])
+	}
+
+	// the second large post is left for a later block, and the small post takes its place
+	for i := 0; ; i++ {
+		if i == 200 {
+			t.Fatal("the miner does not mine the pool")
+		}
+		time.Sleep(100 * time.Millisecond)
+		chain := ReadBlockchain(3038)
+		if len(chain) < 2 {
+			continue
+		}
+		posts := chain[1].Posts
+		if len(posts) != 2 || posts[0].Body.Content != large || posts[1].Body.Content != "small" {
+			t.Fatalf("expected the first block to hold a large and the small post, got %d posts", len(posts))
+		}
+		break
+	}
+}
+
+// TestPostLookup - Tests that a post written by a user can be looked up by its ID on a miner, first in the pool and
+// then on the blockchain with its height and confirmations.
+func TestPostLookup(t *testing.T) {
+	tracker := Tracker.NewTracker(8086)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	miner := Miner.NewMiner(3022, 8086)
+	miner.Start()
+	defer miner.Shutdown()
+	if !WaitForMiner(8086, PeerAddress(3022)) {
+		t.Fatal("expected the miner to register to the tracker")
+	}
+
+	user := User.NewUser(8086)
+	id, err := user.WritePost("Hello World")
+	if err != nil {
+		t.Fatalf("error when writing post: %v", err)
+	}
+
+	// wait for the post to be confirmed by another block
+	url := fmt.Sprintf("http://localhost:3022/post/%s", id)
+	var response Miner.PostJson
+	for i := 0; ; i++ {
+		if i == 300 {
+			t.Fatalf("post is not confirmed in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("error when requesting post: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("expected status OK for a written post, but got %d", resp.StatusCode)
+		}
+		response = Miner.PostJson{}
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("miner sends invalid post: %v", err)
+		}
+		if response.Height < 0 && response.Confirmations != 0 {
+			t.Fatalf("post in the pool has %d confirmations", response.Confirmations)
+		}
+		if response.Confirmations >= 2 {
+			break
+		}
+	}
+
+	post, err := response.Post.DecodeBase64()
+	if err != nil {
+		t.Fatalf("miner sends invalid post: %v", err)
+	}
+	if hex.EncodeToString(post.ID()) != id || post.Body.Content != "Hello World" {
+		t.Fatalf("miner sends a different post")
+	}
+	chain := ReadBlockchain(3022)
+	if response.Height <= 0 || response.Height >= len(chain) {
+		t.Fatalf("post has invalid height %d", response.Height)
+	}
+	if response.Confirmations > len(chain)-response.Height {
+		t.Fatalf("post has %d confirmations at height %d of %d blocks", response.Confirmations, response.Height, len(chain))
+	}
+
+	// unknown posts are not found
+	resp, err := http.Get(fmt.Sprintf("http://localhost:3022/post/%s", hex.EncodeToString(make([]byte, 32))))
+	if err != nil {
+		t.Fatalf("error when requesting post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status Not Found for an unknown post, but got %d", resp.StatusCode)
+	}
+}
+
+// TestMinerRestart - Tests that a miner with a store keeps its blockchain across a restart, and refuses a store of
+// another network.
+func TestMinerRestart(t *testing.T) {
+	tracker := Tracker.NewTracker(8087)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	dir := t.TempDir()
+	miner, err := Miner.NewMinerWithStore(3023, 8087, chainParams, dir)
+	if err != nil {
+		t.Fatalf("failed to create miner: %v", err)
+	}
+	nodeKey := miner.NodeKey()
+	miner.Start()
+	time.Sleep(500 * time.Millisecond)
+	if err := WriteBlockchain(3023, "Hello World"); err != nil {
+		t.Fatalf("error when writing blockchain: %v", err)
+	}
+	// wait for the post to be mined, in whichever block it ends up
+	var chain []blockchain.Block
+	mined := func() bool {
+		for _, block := range chain {
+			if len(block.Posts) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; !mined(); i++ {
+		if i == 200 {
+			miner.Shutdown()
+			t.Fatalf("post is not mined in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		chain = ReadBlockchain(3023)
+	}
+	miner.Shutdown()
+
+	// the restarted miner continues from the stored blockchain
+	miner, err = Miner.NewMinerWithStore(3023, 8087, chainParams, dir)
+	if err != nil {
+		t.Fatalf("failed to restart miner: %v", err)
+	}
+	miner.Start()
+	time.Sleep(500 * time.Millisecond)
+	restored := ReadBlockchain(3023)
+	miner.Shutdown()
+	if len(restored) < len(chain) {
+		t.Fatalf("restarted miner has %d blocks, expected at least %d", len(restored), len(chain))
+	}
+	for i := range chain {
+		if !bytes.Equal(blockchain.Hash(restored[i].Header), blockchain.Hash(chain[i].Header)) {
+			t.Fatalf("restarted miner has a different block at height %d", i)
+		}
+	}
+	if err := blockchain.Chain(restored).Validate(chainParams); err != nil {
+		t.Fatalf("restarted miner has an invalid blockchain: %v", err)
+	}
+	// and keeps its node key
+	if !bytes.Equal(blockchain.PublicKeyToBytes(miner.NodeKey()), blockchain.PublicKeyToBytes(nodeKey)) {
+		t.Fatal("restarted miner has a different node key")
+	}
+
+	// the store of another network is refused
+	if _, err := Miner.NewMinerWithStore(3023, 8087, blockchain.NewChainParams("test"), dir); err == nil {
+		t.Fatal("miner accepted the store of another network")
+	}
+	// and so are invalid chain params
+	invalid := blockchain.NewChainParams(blockchain.DefaultChainID)
+	invalid.RetargetInterval = 0
+	if _, err := Miner.NewMinerWithStore(3023, 8087, invalid, dir); err == nil {
+		t.Fatal("miner accepted invalid chain params")
+	}
+	if _, err := Miner.NewMinerWithParams(3023, invalid, 8087); err == nil {
+		t.Fatal("miner accepted invalid chain params")
+	}
+	if _, err := User.NewUserWithParams(invalid, 8087); err == nil {
+		t.Fatal("user accepted invalid chain params")
+	}
+}
+
+// TestHeadersFirstSync - Tests that a miner catches up with a peer's blockchain from announced headers, and that the
+// /headers and /blocks APIs serve only what is asked for.
+func TestHeadersFirstSync(t *testing.T) {
+	tracker := Tracker.NewTracker(8088)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	miner1 := Miner.NewMiner(3024, 8088)
+	miner1.Start()
+	defer miner1.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	if err := WriteBlockchain(3024, "Hello World"); err != nil {
+		t.Fatalf("error when writing blockchain: %v", err)
+	}
+	// wait for a few blocks
+	var chain []blockchain.Block
+	for i := 0; len(chain) < 4; i++ {
+		if i == 300 {
+			t.Fatalf("blocks are not mined in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		chain = ReadBlockchain(3024)
+	}
+
+	// headers after the genesis block
+	genesis := hex.EncodeToString(blockchain.Hash(chainParams.Genesis.Header))
+	resp, err := http.Get(fmt.Sprintf("http://localhost:3024/headers?from=%s", genesis))
+	if err != nil {
+		t.Fatalf("error when requesting headers: %v", err)
+	}
+	var headers Miner.HeadersJson
+	err = json.NewDecoder(resp.Body).Decode(&headers)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to request headers: status code %d, %v", resp.StatusCode, err)
+	}
+	if headers.Start != 1 || len(headers.Headers) < len(chain)-1 {
+		t.Fatalf("expected headers from height 1, got %d headers from height %d", len(headers.Headers), headers.Start)
+	}
+	for i := 1; i < len(chain); i++ {
+		header, _ := headers.Headers[i-1].DecodeBase64()
+		if !reflect.DeepEqual(header, chain[i].Header) {
+			t.Fatalf("wrong header at height %d", i)
+		}
+	}
+	// the first known hash of the locator is the fork point
+	from := hex.EncodeToString(make([]byte, 32)) + "," + hex.EncodeToString(blockchain.Hash(chain[2].Header)) + "," + genesis
+	resp, err = http.Get(fmt.Sprintf("http://localhost:3024/headers?from=%s", from))
+	if err != nil {
+		t.Fatalf("error when requesting headers: %v", err)
+	}
+	headers = Miner.HeadersJson{}
+	err = json.NewDecoder(resp.Body).Decode(&headers)
+	resp.Body.Close()
+	if err != nil || headers.Start != 3 {
+		t.Fatalf("expected headers from height 3, got height %d: %v", headers.Start, err)
+	}
+	resp, err = http.Get(fmt.Sprintf("http://localhost:3024/headers?from=%s", hex.EncodeToString(make([]byte, 32))))
+	if err != nil {
+		t.Fatalf("error when requesting headers: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status Not Found for an unknown locator, but got %d", resp.StatusCode)
+	}
+
+	// blocks by hash
+	hashes := hex.EncodeToString(blockchain.Hash(chain[2].Header)) + "," + hex.EncodeToString(blockchain.Hash(chain[1].Header))
+	resp, err = http.Get(fmt.Sprintf("http://localhost:3024/blocks?hashes=%s", hashes))
+	if err != nil {
+		t.Fatalf("error when requesting blocks: %v", err)
+	}
+	var blocks Miner.BlocksJson
+	err = json.NewDecoder(resp.Body).Decode(&blocks)
+	resp.Body.Close()
+	if err != nil || len(blocks.Blocks) != 2 {
+		t.Fatalf("failed to request blocks: %v", err)
+	}
+	for i, height := range []int{2, 1} {
+		block, _ := blocks.Blocks[i].DecodeBase64()
+		if !bytes.Equal(blockchain.Hash(block.Header), blockchain.Hash(chain[height].Header)) ||
+			!bytes.Equal(blockchain.MerkleRoot(block.Posts), chain[height].Header.Summary) {
+			t.Fatalf("wrong block at height %d", height)
+		}
+	}
+	resp, err = http.Get(fmt.Sprintf("http://localhost:3024/blocks?hashes=%s", hex.EncodeToString(make([]byte, 32))))
+	if err != nil {
+		t.Fatalf("error when requesting blocks: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status Not Found for an unknown block, but got %d", resp.StatusCode)
+	}
+
+	// a new miner catches up after the next announcement
+	miner2 := Miner.NewMiner(3025, 8088)
+	miner2.Start()
+	defer miner2.Shutdown()
+	for i := 0; ; i++ {
+		if i == 300 {
+			t.Fatalf("new miner does not catch up in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		synced := ReadBlockchain(3025)
+		if len(synced) >= len(chain) {
+			for height := range chain {
+				if !bytes.Equal(blockchain.Hash(synced[height].Header), blockchain.Hash(chain[height].Header)) {
+					t.Fatalf("new miner has a different block at height %d", height)
+				}
+			}
+			break
+		}
+	}
+}
+
+// TestQueryEndpoints - Tests the miner's APIs to query the tip, blocks by height or hash, ranges of headers, the posts
+// in a block, and pages of the blockchain.
+func TestQueryEndpoints(t *testing.T) {
+	tracker := Tracker.NewTracker(8089)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	miner := Miner.NewMiner(3026, 8089)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	if err := WriteBlockchain(3026, "Hello World"); err != nil {
+		t.Fatalf("error when writing blockchain: %v", err)
+	}
+	// wait for the post to be mined, with one block on top
+	// the only miner never switches to another blockchain, so mined blocks stay where they are
+	var chain []blockchain.Block
+	height := 0
+	for i := 0; height == 0 || len(chain) <= height+1; i++ {
+		if i == 300 {
+			t.Fatalf("post is not mined in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		chain = ReadBlockchain(3026)
+		for h := range chain {
+			if len(chain[h].Posts) > 0 {
+				height = h
+			}
+		}
+	}
+	hash := hex.EncodeToString(blockchain.Hash(chain[height].Header))
+
+	// the tip
+	var block Miner.BlockJson
+	if code, err := GetJSON("http://localhost:3026/tip", &block); code != http.StatusOK || err != nil {
+		t.Fatalf("failed to query the tip: status code %d, %v", code, err)
+	}
+	if block.Height < len(chain)-1 {
+		t.Fatalf("tip is at height %d, expected at least %d", block.Height, len(chain)-1)
+	}
+	tip, _ := block.Block.DecodeBase64()
+	if hex.EncodeToString(blockchain.Hash(tip.Header)) != block.Hash {
+		t.Fatal("tip has a wrong hash")
+	}
+
+	// a block by height and by hash
+	for _, url := range []string{
+		fmt.Sprintf("http://localhost:3026/block/height/%d", height),
+		fmt.Sprintf("http://localhost:3026/block/hash/%s", hash),
+	} {
+		block = Miner.BlockJson{}
+		if code, err := GetJSON(url, &block); code != http.StatusOK || err != nil {
+			t.Fatalf("failed to query %s: status code %d, %v", url, code, err)
+		}
+		decoded, _ := block.Block.DecodeBase64()
+		if block.Height != height || block.Hash != hash || !reflect.DeepEqual(decoded.Header, chain[height].Header) {
+			t.Fatalf("%s returns a wrong block", url)
+		}
+	}
+
+	// the posts in a block by height and by hash
+	for _, url := range []string{
+		fmt.Sprintf("http://localhost:3026/block/height/%d/posts", height),
+		fmt.Sprintf("http://localhost:3026/block/hash/%s/posts", hash),
+	} {
+		var posts Miner.BlockPostsJson
+		if code, err := GetJSON(url, &posts); code != http.StatusOK || err != nil {
+			t.Fatalf("failed to query %s: status code %d, %v", url, code, err)
+		}
+		if posts.Height != height || posts.Hash != hash || len(posts.Posts) != len(chain[height].Posts) {
+			t.Fatalf("%s returns wrong posts", url)
+		}
+		post, _ := posts.Posts[0].DecodeBase64()
+		if !bytes.Equal(post.ID(), chain[height].Posts[0].ID()) {
+			t.Fatalf("%s returns wrong posts", url)
+		}
+	}
+
+	// a range of headers
+	var headers Miner.HeaderRangeJson
+	url := fmt.Sprintf("http://localhost:3026/headers/range?start=1&end=%d", len(chain))
+	if code, err := GetJSON(url, &headers); code != http.StatusOK || err != nil {
+		t.Fatalf("failed to query headers: status code %d, %v", code, err)
+	}
+	if len(headers.Headers) != len(chain)-1 {
+		t.Fatalf("expected %d headers, got %d", len(chain)-1, len(headers.Headers))
+	}
+	for i, header := range headers.Headers {
+		decoded, _ := header.Header.DecodeBase64()
+		if header.Height != i+1 || !reflect.DeepEqual(decoded, chain[i+1].Header) ||
+			header.Hash != hex.EncodeToString(blockchain.Hash(decoded)) {
+			t.Fatalf("wrong header at height %d", i+1)
+		}
+	}
+
+	// a page of the blockchain
+	var page Miner.BlockChainJson
+	if code, err := GetJSON("http://localhost:3026/read?start=1&count=1", &page); code != http.StatusOK || err != nil {
+		t.Fatalf("failed to read a page: status code %d, %v", code, err)
+	}
+	if page.Start != 1 || page.Length < len(chain) || len(page.Blockchain) != 1 {
+		t.Fatalf("wrong page from height %d with %d blocks of %d", page.Start, len(page.Blockchain), page.Length)
+	}
+	decoded, _ := page.Blockchain[0].DecodeBase64()
+	if !reflect.DeepEqual(decoded.Header, chain[1].Header) {
+		t.Fatal("page has a wrong block")
+	}
+
+	// unknown blocks are not found, and invalid requests are rejected
+	for url, expected := range map[string]int{
+		"http://localhost:3026/block/height/100000":                    http.StatusNotFound,
+		"http://localhost:3026/block/height/-1":                        http.StatusNotFound,
+		"http://localhost:3026/block/height/first":                     http.StatusBadRequest,
+		"http://localhost:3026/block/hash/xyz/posts":                   http.StatusBadRequest,
+		"http://localhost:3026/block/height/100000/posts":              http.StatusNotFound,
+		"http://localhost:3026/headers/range?start=100000&end=100001":  http.StatusNotFound,
+		"http://localhost:3026/headers/range?start=2&end=1":            http.StatusBadRequest,
+		"http://localhost:3026/read?start=0&count=1000":                http.StatusBadRequest,
+		"http://localhost:3026/block/hash/" + strings.Repeat("00", 32): http.StatusNotFound,
+	} {
+		if code, _ := GetJSON(url, &struct{}{}); code != expected {
+			t.Fatalf("expected status %d from %s, but got %d", expected, url, code)
+		}
+	}
+}
+
+// TestNonceSearch - Tests that mining workers find a valid nonce together, move on to the next timestamp when the nonce
+// space runs out, and stop when asked to.
+func TestNonceSearch(t *testing.T) {
+	header := blockchain.BlockHeader{
+		PrevHash:  blockchain.Hash(chainParams.Genesis.Header),
+		Summary:   blockchain.MerkleRoot(nil),
+		Timestamp: time.Now().UnixNano(),
+		Bits:      12,
+	}
+	for _, workers := range []int{1, 4} {
+		mined, ok := Miner.SearchNonce(header, workers, 1<<20, nil)
+		if !ok {
+			t.Fatalf("%d workers failed to find a nonce", workers)
+		}
+		if !blockchain.CheckPoW(blockchain.Hash(mined), mined.Bits) {
+			t.Fatalf("%d workers found an invalid nonce", workers)
+		}
+		if !bytes.Equal(mined.PrevHash, header.PrevHash) || !bytes.Equal(mined.Summary, header.Summary) ||
+			mined.Bits != header.Bits || mined.Timestamp < header.Timestamp {
+			t.Fatalf("%d workers changed more than the nonce and the timestamp", workers)
+		}
+	}
+
+	// a nonce that is never found, so each worker walks through its whole slice of the nonce space
+	header.Bits = blockchain.MaxBits
+	stop := func() bool { return true }
+	if _, ok := Miner.SearchNonce(header, 4, 1<<30, stop); ok {
+		t.Fatalf("workers found a nonce at the maximum difficulty")
+	}
+	calls := 0
+	stop = func() bool {
+		calls++
+		return calls > 1
+	}
+	start := time.Now()
+	if _, ok := Miner.SearchNonce(header, 1, 1<<30, stop); ok {
+		t.Fatalf("workers found a nonce at the maximum difficulty")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("workers did not stop in time")
+	}
+}
+
+// TestMiningAbort - Tests that mining workers at the maximum difficulty give up promptly when the tip changes while
+// they search, like mine() does when a new block arrives, instead of trying all their iterations first.
+func TestMiningAbort(t *testing.T) {
+	header := blockchain.BlockHeader{
+		PrevHash:  blockchain.Hash(chainParams.Genesis.Header),
+		Summary:   blockchain.MerkleRoot(nil),
+		Timestamp: time.Now().UnixNano(),
+		Bits:      blockchain.MaxBits, // never found
+	}
+	for _, workers := range []int{1, 4} {
+		tipChange := make(chan struct{})
+		tipChanged := func() bool {
+			select {
+			case <-tipChange:
+				return true
+			default:
+				return false
+			}
+		}
+		done := make(chan bool)
+		go func() {
+			// 1<<30 iterations take minutes
+			_, ok := Miner.SearchNonce(header, workers, 1<<30, tipChanged)
+			done <- ok
+		}()
+		time.Sleep(200 * time.Millisecond)
+		select {
+		case <-done:
+			t.Fatalf("%d workers returned before the tip changed", workers)
+		default:
+		}
+		close(tipChange)
+		select {
+		case ok := <-done:
+			if ok {
+				t.Fatalf("%d workers found a nonce at the maximum difficulty", workers)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d workers did not give up within a second after the tip changed", workers)
+		}
+	}
+}
+
+// BenchmarkMining - Measures the hashrate of different numbers of mining workers.
+func BenchmarkMining(b *testing.B) {
+	header := blockchain.BlockHeader{
+		PrevHash:  blockchain.Hash(chainParams.Genesis.Header),
+		Summary:   blockchain.MerkleRoot(nil),
+		Timestamp: time.Now().UnixNano(),
+		Bits:      blockchain.MaxBits, // never found, every worker tries all its iterations
+	}
+	counts := []int{1, 2, 4}
+	if runtime.NumCPU() > 4 {
+		counts = append(counts, runtime.NumCPU())
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			iterations := max(b.N/workers, 1)
+			b.ResetTimer()
+			Miner.SearchNonce(header, workers, iterations, nil)
+			b.ReportMetric(float64(iterations*workers)/b.Elapsed().Seconds(), "hashes/s")
+		})
+	}
+}
+
+// TestPoolLimits - Tests that the pool keeps within its limits on posts and bytes by turning away or evicting the
+// posts that arrived last, whatever their timestamps, drops posts older than its TTL, turns away posts dated too far in
+// the future, and reports its stats on the /pool API.
+func TestPoolLimits(t *testing.T) {
+	cmp := func(a, b any) int {
+		post1 := a.(blockchain.Post)
+		post2 := b.(blockchain.Post)
+		return blockchain.ComparePosts(&post1, &post2)
+	}
+	now := time.Now()
+	// at creates a post that is age old
+	at := func(age time.Duration) blockchain.Post {
+		return NewSignedPostAt("Hello World", now.Add(-age).UnixNano())
+	}
+
+	// limit on posts
+	pool := Miner.NewPool(cmp, 3, 1<<20, time.Minute)
+	waiting := make([]blockchain.Post, 0)
+	for i, age := range []time.Duration{4 * time.Second, 3 * time.Second, 2 * time.Second} {
+		post := at(age)
+		if err := pool.Add(post, now.Add(time.Duration(i-2)*time.Second)); err != nil {
+			t.Fatalf("error when adding a post to the pool: %v", err)
+		}
+		waiting = append(waiting, post)
+	}
+	if err := pool.Add(at(time.Second), now); !errors.Is(err, Miner.ErrPoolFull) {
+		t.Fatalf("expected a full pool to turn away a new post, got %v", err)
+	}
+	if err := pool.Add(at(59*time.Second), now); !errors.Is(err, Miner.ErrPoolFull) {
+		t.Fatalf("expected a full pool to turn away a new post dated just inside the TTL, got %v", err)
+	}
+	earlier := at(time.Second)
+	if err := pool.Add(earlier, now.Add(-time.Second)); err != nil || !pool.Contains(earlier) || pool.Size() != 3 {
+		t.Fatalf("expected a full pool to evict the post that arrived last for one that arrived earlier, got %v", err)
+	}
+	if pool.Contains(waiting[2]) {
+		t.Fatal("expected the post that arrived last to be evicted")
+	}
+	if err := pool.Add(at(2*time.Minute), now); !errors.Is(err, Miner.ErrPostExpired) {
+		t.Fatalf("expected the pool to turn away an expired post, got %v", err)
+	}
+
+	// a flood of posts dated in the future hits the full pool
+	for i := 0; i < 10; i++ {
+		if err := pool.Add(at(-5*time.Second), now); !errors.Is(err, Miner.ErrPoolFull) {
+			t.Fatalf("expected a full pool to turn away a post dated in the future, got %v", err)
+		}
+	}
+	if err := pool.Add(at(-time.Hour), now); !errors.Is(err, Miner.ErrPostTooNew) {
+		t.Fatalf("expected the pool to turn away a post dated past the future drift, got %v", err)
+	}
+	if !pool.Contains(waiting[0]) || !pool.Contains(waiting[1]) || !pool.Contains(earlier) {
+		t.Fatal("expected the posts already waiting to stay in the pool")
+	}
+	stats := pool.Stats(now)
+	if stats.Posts != 3 || stats.Evicted != 1 || stats.Rejected != 14 || stats.OldestAge != 4000 {
+		t.Fatalf("wrong pool stats: %+v", stats)
+	}
+
+	// limit on bytes
+	size := len(blockchain.Encode(at(0)))
+	pool = Miner.NewPool(cmp, 100, 2*size, time.Minute)
+	pool.Add(at(3*time.Second), now)
+	pool.Add(at(2*time.Second), now)
+	if err := pool.Add(at(time.Second), now); !errors.Is(err, Miner.ErrPoolFull) || pool.Bytes() != 2*size {
+		t.Fatalf("expected a pool full of bytes to turn away a new post, got %v", err)
+	}
+	large := NewSignedPostAt(strings.Repeat("a", 3*size), now.Add(-time.Hour).UnixNano())
+	if err := Miner.NewPool(cmp, 100, 2*size, 2*time.Hour).Add(large, now); !errors.Is(err, Miner.ErrPoolFull) {
+		t.Fatalf("expected the pool to turn away a post larger than the pool, got %v", err)
+	}
+
+	// expiry
+	pool = Miner.NewPool(cmp, 100, 1<<20, time.Minute)
+	pool.Add(at(30*time.Second), now)
+	pool.Add(at(10*time.Second), now)
+	if expired := pool.Expire(now.Add(40 * time.Second)); expired != 1 || pool.Size() != 1 || pool.Bytes() != size {
+		t.Fatalf("expected 1 post to expire, got %d", expired)
+	}
+
+	// the /pool API
+	tracker := Tracker.NewTracker(8092)
+	tracker.Start()
+	defer tracker.Shutdown()
+	miner := Miner.NewMiner(3028, 8092)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	var response Miner.PoolStatsJson
+	if code, err := GetJSON("http://localhost:3028/pool", &response); err != nil || code != http.StatusOK {
+		t.Fatalf("error when getting pool stats: %d %v", code, err)
+	}
+	defaults := Miner.DefaultConfig()
+	if response.MaxPosts != defaults.PoolMaxPosts || response.MaxBytes != defaults.PoolMaxBytes ||
+		response.TTL != defaults.PoolTTL.Milliseconds() {
+		t.Fatalf("wrong pool limits: %+v", response)
+	}
+}
+
+// TestPeerAuthentication - Tests that a miner registers its node key to the tracker, and only accepts /sync,
+// /announce and /broadcast requests signed by the node key that the tracker records for the sender's port.
+func TestPeerAuthentication(t *testing.T) {
+	// the fake peer registers only once, so its entry must outlive the whole test
+	config := Tracker.DefaultConfig()
+	config.Port = 8093
+	config.EntryTimeout = 10 * time.Second
+	tracker, err := Tracker.NewTrackerWithConfig(config)
+	if err != nil {
+		t.Fatalf("error when creating tracker: %v", err)
+	}
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	miner := Miner.NewMiner(3029, 8093)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	// the miner registers its node key
+	var miners Tracker.PortsJson
+	if code, err := GetJSON("http://localhost:8093/get_miners", &miners); err != nil || code != http.StatusOK {
+		t.Fatalf("error when getting miners: %d %v", code, err)
+	}
+	if miners.Keys[PeerAddress(3029)] != peer.EncodeKey(miner.NodeKey()) {
+		t.Fatalf("tracker does not record the node key of the miner: %v", miners.Keys)
+	}
+
+	// a fake peer on port 3130
+	nodeKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8093, 3130, nodeKey); err != nil || code != http.StatusOK {
+		t.Fatalf("error when registering a peer: %d %v", code, err)
+	}
+	otherKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, _ := RegisterPeer(8093, 3130, otherKey); code != http.StatusConflict {
+		t.Fatalf("expected the tracker to refuse another node key for a live port, got %d", code)
+	}
+
+	synced := NewSignedPost("Hello World")
+	syncJSON, _ := json.Marshal(Miner.PostsJson{Posts: []blockchain.PostBase64{synced.EncodeBase64()}})
+	post := func(request *http.Request) int {
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("error when posting to %s: %v", request.URL, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	newRequest := func(api string, body []byte) *http.Request {
+		request, _ := http.NewRequest(http.MethodPost, "http://localhost:3029"+api, bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		return request
+	}
+
+	// unsigned
+	for _, api := range []string{"/sync", "/announce", "/broadcast"} {
+		if code := post(newRequest(api, []byte("{}"))); code != http.StatusUnauthorized {
+			t.Fatalf("expected an unsigned request to %s to be refused, got %d", api, code)
+		}
+	}
+	// signed by another key than the one registered for the port
+	request := newRequest("/sync", syncJSON)
+	peer.Sign(request, syncJSON, PeerAddress(3130), otherKey)
+	if code := post(request); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request signed by the wrong key to be refused, got %d", code)
+	}
+	// signed for another body
+	request = newRequest("/sync", syncJSON)
+	peer.Sign(request, []byte("{}"), PeerAddress(3130), nodeKey)
+	if code := post(request); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request with a forged body to be refused, got %d", code)
+	}
+	// replayed long after it was signed
+	request = newRequest("/sync", syncJSON)
+	peer.Sign(request, syncJSON, PeerAddress(3130), nodeKey)
+	request.Header.Set(peer.TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano(), 10))
+	if code := post(request); code != http.StatusUnauthorized {
+		t.Fatalf("expected a stale request to be refused, got %d", code)
+	}
+	// announcing for another address
+	announceJSON, _ := json.Marshal(Miner.AnnounceJson{
+		Port:    3029,
+		Address: PeerAddress(3029),
+		Header:  chainParams.Genesis.Header.EncodeBase64(),
+	})
+	request = newRequest("/announce", announceJSON)
+	peer.Sign(request, announceJSON, PeerAddress(3130), nodeKey)
+	if code := post(request); code != http.StatusUnauthorized {
+		t.Fatalf("expected an announcement for another address to be refused, got %d", code)
+	}
+	// signed for the address of a peer on another host
+	request = newRequest("/sync", syncJSON)
+	peer.Sign(request, syncJSON, "127.0.0.1:3130", nodeKey)
+	if code := post(request); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request from an unregistered address to be refused, got %d", code)
+	}
+
+	// signed by the registered key
+	request = newRequest("/sync", syncJSON)
+	peer.Sign(request, syncJSON, PeerAddress(3130), nodeKey)
+	if code := post(request); code != http.StatusOK {
+		t.Fatalf("expected a signed request to be accepted, got %d", code)
+	}
+	// the synced post is in the pool, unless it is mined already
+	var found Miner.PostJson
+	url := fmt.Sprintf("http://localhost:3029/post/%s", hex.EncodeToString(synced.ID()))
+	if code, err := GetJSON(url, &found); err != nil || code != http.StatusOK {
+		t.Fatalf("expected the miner to have the synced post, got %d %v", code, err)
+	}
+}
+
+// TestKeyRefresh - Tests that requests from unknown peers make a miner fetch node keys from the tracker at most once
+// at a time, and at most once every KeyRefresh.
+func TestKeyRefresh(t *testing.T) {
+	// a tracker that lists no miners, slowly
+	var fetches atomic.Int32
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/get_miners" {
+			fetches.Add(1)
+			time.Sleep(300 * time.Millisecond)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer tracker.Close()
+
+	config := Miner.DefaultConfig()
+	config.Port = 3040
+	config.Tracker = tracker.URL
+	config.KeyRefresh = 3 * time.Second
+	miner, err := Miner.NewMinerWithConfig(config)
+	if err != nil {
+		t.Fatalf("failed to create miner: %v", err)
+	}
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	syncJSON, _ := json.Marshal(Miner.PostsJson{Posts: []blockchain.PostBase64{}})
+	sync := func(port int) int {
+		request, _ := http.NewRequest(http.MethodPost, "http://localhost:3040/sync", bytes.NewReader(syncJSON))
+		request.Header.Set("Content-Type", "application/json")
+		peer.Sign(request, syncJSON, PeerAddress(port), blockchain.GenerateKey(blockchain.Ed25519))
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Errorf("error when syncing: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// made-up peers at the same time
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		go func(port int) { codes <- sync(port) }(3157 + i)
+	}
+	for i := 0; i < 10; i++ {
+		if code := <-codes; code != http.StatusUnauthorized {
+			t.Fatalf("expected a request from an unknown peer to be refused, got %d", code)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected unknown peers to fetch node keys once at a time, got %d fetches", n)
+	}
+	// another one right after
+	if code := sync(3167); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request from an unknown peer to be refused, got %d", code)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected unknown peers to fetch node keys at most every %v, got %d fetches", config.KeyRefresh, n)
+	}
+	// and one after KeyRefresh
+	time.Sleep(config.KeyRefresh)
+	if code := sync(3168); code != http.StatusUnauthorized {
+		t.Fatalf("expected a request from an unknown peer to be refused, got %d", code)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected an unknown peer to fetch node keys again after %v, got %d fetches", config.KeyRefresh, n)
+	}
+}
+
+// TestPeerBans - Tests that a miner scores peers by their offenses, bans a peer whose score reaches the threshold, and
+// lists scores and bans in the /peers API.
+func TestPeerBans(t *testing.T) {
+	// offenses
+	offenses := map[error]Miner.Offense{
+		&blockchain.ValidationError{Height: 3, Err: blockchain.ErrBadPoW}: Miner.BadProofOfWork,
+		blockchain.ErrBrokenLink:     Miner.BrokenLink,
+		blockchain.ErrBadSignature:   Miner.InvalidSignature,
+		blockchain.ErrContentTooLong: Miner.OversizedPayload,
+		Miner.ErrTooManyHeaders:      Miner.OversizedPayload,
+		&url.Error{Op: "Get", URL: "http://localhost:3000", Err: context.DeadlineExceeded}: Miner.Timeout,
+		fmt.Errorf("%w: a wrong number of blocks", Miner.ErrBadResponse):                   Miner.InvalidData,
+	}
+	for err, expected := range offenses {
+		if offense, ok := Miner.OffenseOf(err); !ok || offense != expected {
+			t.Fatalf("expected %v to be a %s offense, got %s %v", err, expected, offense, ok)
+		}
+	}
+	for _, err := range []error{nil, blockchain.ErrTimeTooNew, errors.New("connection refused")} {
+		if offense, ok := Miner.OffenseOf(err); ok {
+			t.Fatalf("expected %v not to be an offense, got %s", err, offense)
+		}
+	}
+
+	// scores and bans
+	now := time.Now()
+	peers := Miner.NewPeerManager(100, time.Minute)
+	for i := 0; i < 9; i++ {
+		if peers.Punish("localhost:3000", Miner.Timeout, now) {
+			t.Fatal("peer is banned before its score reaches the threshold")
+		}
+	}
+	if stats := peers.Stats(now.Add(30 * time.Second)); stats.Peers[0].Score != 40 {
+		t.Fatalf("expected the score to decay by half the threshold in half the ban duration, got %+v", stats)
+	}
+	if peers.Punish("localhost:3000", Miner.Timeout, now) != true || !peers.Banned("localhost:3000", now) {
+		t.Fatal("peer is not banned when its score reaches the threshold")
+	}
+	allowed := peers.Allowed([]string{"localhost:3000", "localhost:3001"}, now)
+	if !reflect.DeepEqual(allowed, []string{"localhost:3001"}) {
+		t.Fatalf("expected only the peer that is not banned to be allowed, got %v", allowed)
+	}
+	if peers.Punish("localhost:3000", Miner.InvalidSignature, now) || peers.Banned("localhost:3000", now.Add(time.Minute)) {
+		t.Fatal("expected the ban to ignore further offenses and to end after the ban duration")
+	}
+
+	// the miner
+	tracker := Tracker.NewTracker(8094)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3031, 8094)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	// a peer that announces a header without proof-of-work loses points
+	slowKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8094, 3132, slowKey); err != nil || code != http.StatusOK {
+		t.Fatalf("error when registering a peer: %d %v", code, err)
+	}
+	if !WaitForPeer(8094, 3031, 3132, slowKey) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	announceJSON, _ := json.Marshal(Miner.AnnounceJson{
+		Port:    3132,
+		Address: PeerAddress(3132),
+		Header:  chainParams.Genesis.Header.EncodeBase64(),
+	})
+	resp, err := peer.Post("http://localhost:3031/announce", announceJSON, PeerAddress(3132), slowKey)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an announcement without proof-of-work to be refused: %v", err)
+	}
+	resp.Body.Close()
+
+	// a peer that syncs a forged post is banned at once
+	badKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8094, 3133, badKey); err != nil || code != http.StatusOK {
+		t.Fatalf("error when registering a peer: %d %v", code, err)
+	}
+	if !WaitForPeer(8094, 3031, 3133, badKey) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	forged := NewSignedPost("Hello World")
+	forged.Body.Content = "Forged"
+	syncJSON, _ := json.Marshal(Miner.PostsJson{Posts: []blockchain.PostBase64{forged.EncodeBase64()}})
+	for _, expected := range []int{http.StatusBadRequest, http.StatusForbidden} {
+		resp, err := peer.Post("http://localhost:3031/sync", syncJSON, PeerAddress(3133), badKey)
+		if err != nil || resp.StatusCode != expected {
+			t.Fatalf("expected status %d when syncing a forged post, got %v", expected, err)
+		}
+		resp.Body.Close()
+	}
+
+	var response Miner.PeersJson
+	if code, err := GetJSON("http://localhost:3031/peers", &response); err != nil || code != http.StatusOK {
+		t.Fatalf("error when getting peers: %d %v", code, err)
+	}
+	if len(response.Peers) != 2 || response.Threshold != Miner.DefaultConfig().BanThreshold {
+		t.Fatalf("wrong peers: %+v", response)
+	}
+	slow, bad := response.Peers[0], response.Peers[1]
+	if slow.Address != PeerAddress(3132) || slow.Score != 50 || slow.Offenses["bad-pow"] != 1 || slow.Bans != 0 || slow.BanLeft != 0 {
+		t.Fatalf("wrong score of the peer without proof-of-work: %+v", slow)
+	}
+	if bad.Address != PeerAddress(3133) || bad.Offenses["invalid-signature"] != 1 || bad.Bans != 1 || bad.BanLeft <= 0 {
+		t.Fatalf("wrong score of the peer with a forged post: %+v", bad)
+	}
+}
+
+// TestPeerExchange - Tests that miners exchange and gossip the peers they know about, keep them in an address book
+// that survives a restart, and keep syncing with each other while the tracker is down.
+func TestPeerExchange(t *testing.T) {
+	// the address book
+	now := time.Now()
+	trackerKey := peer.EncodeKey(blockchain.GenerateKey(blockchain.Ed25519).Public())
+	gossipSigner := blockchain.GenerateKey(blockchain.Ed25519)
+	gossipKey := peer.EncodeKey(gossipSigner.Public())
+	book := Miner.NewAddressBook(time.Minute)
+	book.Record("localhost:3000", trackerKey, now)
+	learned := book.Learn([]Miner.KnownPeerJson{
+		{Address: "localhost:3000", PublicKey: gossipKey, LastSeen: now.UnixNano()},
+		{Address: "localhost:3001", PublicKey: gossipKey, LastSeen: now.UnixNano()},
+		{Address: "localhost:3002", LastSeen: now.Add(-time.Hour).UnixNano()},
+		{Address: "localhost:3003", LastSeen: now.UnixNano()},
+	}, "localhost:3003", "localhost:3000", now)
+	if len(learned) != 1 || learned[0].Address != "localhost:3001" {
+		t.Fatalf("expected to learn only the new peer that is not expired or myself, got %v", learned)
+	}
+	if peer.EncodeKey(book.Key("localhost:3000")) != trackerKey {
+		t.Fatal("a gossiped node key replaces the one that the tracker reports")
+	}
+	if book.Key("localhost:3001") != nil {
+		t.Fatal("a gossiped node key authenticates a peer")
+	}
+	book.Verify("localhost:3001", gossipKey, now)
+	if peer.EncodeKey(book.Key("localhost:3001")) != gossipKey {
+		t.Fatal("a node key that the peer proves to hold in a handshake does not authenticate it")
+	}
+	if addresses := book.Addresses(now.Add(30 * time.Second)); len(addresses) != 2 {
+		t.Fatalf("expected 2 known peers, got %v", addresses)
+	}
+	if addresses := book.Addresses(now.Add(time.Minute)); len(addresses) != 0 {
+		t.Fatalf("expected peers to expire, got %v", addresses)
+	}
+	if err := Miner.CheckKnownPeers([]Miner.KnownPeerJson{{Address: "localhost"}}); !errors.Is(err, Miner.ErrBadResponse) {
+		t.Fatalf("expected an invalid address to be refused, got %v", err)
+	}
+
+	// two miners, one of which keeps its address book in a store
+	tracker := Tracker.NewTracker(8096)
+	tracker.Start()
+	time.Sleep(1000 * time.Millisecond)
+	newMiner := func(port int, dir string) *Miner.Miner {
+		config := Miner.DefaultConfig()
+		config.Port = port
+		config.Tracker = "localhost:8096"
+		config.StoreDir = dir
+		config.PeerExchange = 200 * time.Millisecond
+		miner, err := Miner.NewMinerWithConfig(config)
+		if err != nil {
+			t.Fatalf("failed to create miner: %v", err)
+		}
+		miner.Start()
+		return miner
+	}
+	dir := t.TempDir()
+	miner1 := newMiner(3034, "")
+	defer miner1.Shutdown()
+	miner2 := newMiner(3035, dir)
+	time.Sleep(1000 * time.Millisecond)
+
+	// a fake peer tells miner 1 about a new peer, which miner 1 gossips to miner 2
+	nodeKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8096, 3136, nodeKey); err != nil || code != http.StatusOK {
+		t.Fatalf("error when registering a peer: %d %v", code, err)
+	}
+	if !WaitForPeer(8096, 3034, 3136, nodeKey) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	exchangeJSON, _ := json.Marshal(Miner.KnownPeersJson{Peers: []Miner.KnownPeerJson{
+		{Address: PeerAddress(3137), PublicKey: gossipKey, LastSeen: time.Now().UnixNano()},
+	}})
+	resp, err := peer.Post("http://localhost:3034/peers", exchangeJSON, PeerAddress(3136), nodeKey)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error when exchanging peers: %v", err)
+	}
+	var exchanged Miner.KnownPeersJson
+	_ = json.NewDecoder(resp.Body).Decode(&exchanged)
+	resp.Body.Close()
+	addresses := make(map[string]bool)
+	for _, known := range exchanged.Peers {
+		addresses[known.Address] = true
+	}
+	if !addresses[PeerAddress(3034)] || !addresses[PeerAddress(3035)] || !addresses[PeerAddress(3137)] {
+		t.Fatalf("expected miner 1 to tell itself, miner 2 and the new peer, got %v", exchanged.Peers)
+	}
+	var stats Miner.PeersJson
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatalf("miner 2 does not learn about the gossiped peer: %v", stats.Known)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, err := GetJSON("http://localhost:3035/peers", &stats); err != nil {
+			t.Fatalf("error when getting peers: %v", err)
+		}
+		if slices.ContainsFunc(stats.Known, func(known Miner.KnownPeerJson) bool {
+			return known.Address == PeerAddress(3137)
+		}) {
+			break
+		}
+	}
+
+	// the gossiped node key does not authenticate the new peer, until it proves that it holds the key in a handshake
+	exchange := func() int {
+		emptyJSON, _ := json.Marshal(Miner.KnownPeersJson{Peers: []Miner.KnownPeerJson{}})
+		resp, err := peer.Post("http://localhost:3034/peers", emptyJSON, PeerAddress(3137), gossipSigner)
+		if err != nil {
+			t.Fatalf("error when exchanging peers: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := exchange(); code != http.StatusUnauthorized {
+		t.Fatalf("expected a peer with a gossiped node key to be refused, got status %d", code)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/handshake", func(w http.ResponseWriter, r *http.Request) {
+		nonce, _ := hex.DecodeString(r.URL.Query().Get("nonce"))
+		signature := peer.SignHandshake(nonce, PeerAddress(3137), gossipSigner)
+		_ = json.NewEncoder(w).Encode(Miner.HandshakeJson{
+			Address:   PeerAddress(3137),
+			PublicKey: gossipKey,
+			Signature: base64.StdEncoding.EncodeToString(signature),
+		})
+	})
+	server := &http.Server{Addr: PeerAddress(3137), Handler: mux}
+	go func() {
+		_ = server.ListenAndServe()
+	}()
+	defer server.Close()
+	for i := 0; exchange() != http.StatusOK; i++ {
+		if i == 50 {
+			t.Fatal("expected a peer that proves its node key in a handshake to be accepted")
+		}
+		// node keys are refreshed at most once every key-refresh
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// without the tracker, a post written to miner 1 still reaches miner 2
+	tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	if err := WriteBlockchain(3034, "Hello World"); err != nil {
+		t.Fatalf("error when writing blockchain: %v", err)
+	}
+	for i := 0; ; i++ {
+		if i == 200 {
+			t.Fatalf("post does not reach miner 2 without the tracker")
+		}
+		time.Sleep(100 * time.Millisecond)
+		chain := ReadBlockchain(3035)
+		if len(chain) >= 2 && slices.ContainsFunc(chain, func(block blockchain.Block) bool {
+			return len(block.Posts) > 0
+		}) {
+			break
+		}
+	}
+
+	// miner 2 remembers its peers
+	miner2.Shutdown()
+	s, _, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer s.Close()
+	peers, err := s.LoadPeers()
+	if err != nil || !slices.ContainsFunc(peers, func(known store.Peer) bool { return known.Address == PeerAddress(3034) }) {
+		t.Fatalf("expected miner 1 in the stored address book, got %v %v", peers, err)
+	}
+}
+
+// TestPeerFlood - Tests that peers that flood a miner with made-up peers in peer exchanges cannot crowd the miners
+// that the tracker lists out of the address book, so that a new miner can still authenticate to it.
+func TestPeerFlood(t *testing.T) {
+	// madeUp returns n made-up peers from port on, seen at now
+	madeUp := func(port int, n int, now time.Time) []Miner.KnownPeerJson {
+		key := peer.EncodeKey(blockchain.GenerateKey(blockchain.Ed25519).Public())
+		peers := make([]Miner.KnownPeerJson, n)
+		for i := range peers {
+			peers[i] = Miner.KnownPeerJson{Address: PeerAddress(port + i), PublicKey: key, LastSeen: now.UnixNano()}
+		}
+		return peers
+	}
+
+	// the address book
+	now := time.Now()
+	book := Miner.NewAddressBook(time.Minute)
+	if learned := book.Learn(madeUp(40000, 2*Miner.MaxPeersPerSource, now), "", "localhost:3000", now); len(learned) != Miner.MaxPeersPerSource {
+		t.Fatalf("expected a peer to add at most %d peers, got %d", Miner.MaxPeersPerSource, len(learned))
+	}
+	for i := 1; len(book.Addresses(now)) < Miner.MaxKnownPeers; i++ {
+		book.Learn(madeUp(40000+i*Miner.MaxPeersPerSource, Miner.MaxPeersPerSource, now), "", PeerAddress(3000+i), now)
+	}
+	trackerKey := peer.EncodeKey(blockchain.GenerateKey(blockchain.Ed25519).Public())
+	book.Record("localhost:3999", trackerKey, now.Add(time.Second))
+	if book.Key("localhost:3999") == nil {
+		t.Fatal("expected a peer that the tracker records to be admitted to a full address book")
+	}
+	if addresses := book.Addresses(now); len(addresses) != Miner.MaxKnownPeers {
+		t.Fatalf("expected a learned peer to make room for the recorded one, got %d peers", len(addresses))
+	}
+	if learned := book.Learn(madeUp(50000, 1, now), "", "localhost:3998", now); len(learned) != 0 {
+		t.Fatal("expected a full address book to refuse learned peers")
+	}
+
+	// peers that the tracker lists flood a miner with made-up peers
+	tracker := Tracker.NewTracker(8100)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3037, 8100)
+	miner.Start()
+	defer miner.Shutdown()
+	if !WaitForMiner(8100, PeerAddress(3037)) {
+		t.Fatal("expected the miner to register to the tracker")
+	}
+	for i := 0; i < 10; i++ {
+		floodKey := blockchain.GenerateKey(blockchain.Ed25519)
+		if !WaitForPeer(8100, 3037, 3144+i, floodKey) {
+			t.Fatal("expected the miner to learn the node key of the peer")
+		}
+		flood, _ := json.Marshal(Miner.KnownPeersJson{Peers: madeUp(40000+i*Miner.MaxKnownPeers, Miner.MaxKnownPeers, time.Now())})
+		resp, err := peer.Post("http://localhost:3037/peers", flood, PeerAddress(3144+i), floodKey)
+		if err != nil {
+			t.Fatalf("error when flooding peers: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the miner to accept the peers of a registered peer, got status %d", resp.StatusCode)
+		}
+	}
+	var stats Miner.PeersJson
+	if _, err := GetJSON("http://localhost:3037/peers", &stats); err != nil {
+		t.Fatalf("error when getting peers: %v", err)
+	}
+	if len(stats.Known) > Miner.MaxKnownPeers {
+		t.Fatalf("expected at most %d known peers, got %d", Miner.MaxKnownPeers, len(stats.Known))
+	}
+
+	// a new miner that the tracker lists still authenticates
+	newKey := blockchain.GenerateKey(blockchain.Ed25519)
+	if !WaitForPeer(8100, 3037, 3154, newKey) {
+		t.Fatal("a new miner that the tracker lists is not admitted to a flooded address book")
+	}
+	exchangeJSON, _ := json.Marshal(Miner.KnownPeersJson{Peers: []Miner.KnownPeerJson{}})
+	resp, err := peer.Post("http://localhost:3037/peers", exchangeJSON, PeerAddress(3154), newKey)
+	if err != nil {
+		t.Fatalf("error when exchanging peers: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("a new miner that the tracker lists fails to authenticate to a flooded miner, got status %d", resp.StatusCode)
+	}
+}
+
+// TestHeaderLimits - Tests that a miner fetches a bounded number of headers from a peer that announces a block, however
+// high the peer claims it is, and punishes a peer that sends more headers at a time than requested.
+func TestHeaderLimits(t *testing.T) {
+	tracker := Tracker.NewTracker(8102)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3039, 8102)
+	miner.Start()
+	defer miner.Shutdown()
+	if !WaitForMiner(8102, PeerAddress(3039)) {
+		t.Fatal("expected the miner to register to the tracker")
+	}
+	block := NextBlock([]blockchain.Block{chainParams.Genesis}, nil)
+
+	// fakePeer serves n headers from every /headers request on port, continuing the previous ones, and counts the
+	// requests
+	fakePeer := func(port int, n int, requests *atomic.Int32) *http.Server {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+			count := int(requests.Add(1))
+			response := Miner.HeadersJson{Start: 1 + (count-1)*n}
+			for i := 0; i < n; i++ {
+				response.Headers = append(response.Headers, block.Header.EncodeBase64())
+			}
+			_ = json.NewEncoder(w).Encode(response)
+		})
+		server := &http.Server{Addr: PeerAddress(port), Handler: mux}
+		go func() {
+			_ = server.ListenAndServe()
+		}()
+		return server
+	}
+	// announce has the peer on port announce block at height
+	announce := func(port int, key blockchain.Signer, height int) int {
+		announceJSON, _ := json.Marshal(Miner.AnnounceJson{
+			Port:    port,
+			Address: PeerAddress(port),
+			Height:  height,
+			Header:  block.Header.EncodeBase64(),
+		})
+		for i := 0; i < 50; i++ {
+			resp, err := peer.Post("http://localhost:3039/announce", announceJSON, PeerAddress(port), key)
+			if err != nil {
+				t.Fatalf("error when announcing: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				return resp.StatusCode
+			}
+			// the miner has not fetched the node key of the peer yet
+			time.Sleep(100 * time.Millisecond)
+		}
+		return http.StatusUnauthorized
+	}
+
+	// a peer that claims to be far ahead
+	var endless atomic.Int32
+	server := fakePeer(3155, Miner.MaxHeadersPerRequest, &endless)
+	defer server.Close()
+	key := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8102, 3155, key); err != nil || code != http.StatusOK {
+		t.Fatalf("error when registering a peer: %d %v", code, err)
+	}
+	if !WaitForPeer(8102, 3039, 3155, key) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	if code := announce(3155, key, 1<<30); code != http.StatusBadRequest {
+		t.Fatalf("expected the made-up headers to be rejected, got %d", code)
+	}
+	if requests := endless.Load(); requests != Miner.MaxHeaderBatches {
+		t.Fatalf("expected the miner to request %d batches of headers, got %d", Miner.MaxHeaderBatches, requests)
+	}
+
+	// a peer that sends too many headers at a time
+	var oversized atomic.Int32
+	server = fakePeer(3156, Miner.MaxHeadersPerRequest+1, &oversized)
+	defer server.Close()
+	key = blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8102, 3156, key); err != nil || code != http.StatusOK {
+		t.Fatalf("error when registering a peer: %d %v", code, err)
+	}
+	if !WaitForPeer(8102, 3039, 3156, key) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	if code := announce(3156, key, 1<<30); code != http.StatusBadRequest {
+		t.Fatalf("expected too many headers to be rejected, got %d", code)
+	}
+	var stats Miner.PeersJson
+	if _, err := GetJSON("http://localhost:3039/peers", &stats); err != nil {
+		t.Fatalf("error when getting peers: %v", err)
+	}
+	punished := slices.ContainsFunc(stats.Peers, func(p Miner.PeerJson) bool {
+		return p.Address == PeerAddress(3156) && p.Offenses["oversized-payload"] == 1
+	})
+	if !punished {
+		t.Fatalf("expected the peer to be punished for an oversized payload, got %+v", stats.Peers)
+	}
+}
+
+// TestForgedChainWork - Tests that a miner counts only the work of blocks that it validates, so that a broadcast
+// blockchain cannot claim more work with forged headers before the point where it forks from the miner's blockchain.
+func TestForgedChainWork(t *testing.T) {
+	tracker := Tracker.NewTracker(8103)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3041, 8103)
+	miner.Start()
+	defer miner.Shutdown()
+	if !WaitForMiner(8103, PeerAddress(3041)) {
+		t.Fatal("expected the miner to register to the tracker")
+	}
+	// wait for a few blocks
+	var chain []blockchain.Block
+	for i := 0; len(chain) < 4; i++ {
+		if i == 300 {
+			t.Fatalf("blocks are not mined in time")
+		}
+		time.Sleep(100 * time.Millisecond)
+		chain = ReadBlockchain(3041)
+	}
+
+	// a cheap block on top of the genesis block, after a forged header that claims the highest difficulty
+	forged := chainParams.Genesis
+	forged.Header.Bits = blockchain.MaxBits
+	forgedChain := []blockchain.Block{forged, NextBlock([]blockchain.Block{chainParams.Genesis}, nil)}
+	if blockchain.CompareChains(forgedChain, chain) <= 0 {
+		t.Fatal("expected the forged blockchain to claim more work")
+	}
+	key := blockchain.GenerateKey(blockchain.Ed25519)
+	if !WaitForPeer(8103, 3041, 3169, key) {
+		t.Fatal("expected the miner to learn the node key of the peer")
+	}
+	encoded := make([]blockchain.BlockBase64, 0)
+	for _, block := range forgedChain {
+		encoded = append(encoded, block.EncodeBase64())
+	}
+	broadcastJSON, _ := json.Marshal(Miner.BlockChainJson{Blockchain: encoded})
+	resp, err := peer.Post("http://localhost:3041/broadcast", broadcastJSON, PeerAddress(3169), key)
+	if err != nil {
+		t.Fatalf("error when broadcasting: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the forged blockchain to be ignored, got status %d", resp.StatusCode)
+	}
+	if after := ReadBlockchain(3041); len(after) < len(chain) {
+		t.Fatalf("miner switched from a blockchain of %d blocks to one of %d blocks", len(chain), len(after))
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"blockchain/blockchain"
+	"blockchain/store"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBlockStore checks that the block log and the pool survive reopening the store.
+// Blocks can be appended and truncated back to a fork point. A torn record at the end of the log, as left by a crash in
+// the middle of a write, is discarded together with everything after it, and the log stays usable.
+func TestBlockStore(t *testing.T) {
+	dir := t.TempDir()
+	// sameBlocks checks that two lists of blocks have the same headers and posts
+	sameBlocks := func(a, b []blockchain.Block) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !bytes.Equal(blockchain.Hash(a[i].Header), blockchain.Hash(b[i].Header)) ||
+				!bytes.Equal(blockchain.MerkleRoot(a[i].Posts), blockchain.MerkleRoot(b[i].Posts)) {
+				return false
+			}
+		}
+		return true
+	}
+	// reopen closes s and opens the store in dir again
+	reopen := func(s *store.Store) (*store.Store, []blockchain.Block) {
+		if err := s.Close(); err != nil {
+			t.Fatalf("failed to close store: %v", err)
+		}
+		s, blocks, err := store.Open(dir)
+		if err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		return s, blocks
+	}
+
+	s, blocks, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("a new store has %d blocks", len(blocks))
+	}
+	chain := []blockchain.Block{chainParams.Genesis}
+	chain = append(chain, NextBlock(chain, []blockchain.Post{NewSignedPost("Hello from 1")}))
+	chain = append(chain, NextBlock(chain, []blockchain.Post{NewSignedPost("Hello from 2")}))
+	if err := s.Append(chain...); err != nil {
+		t.Fatalf("failed to append blocks: %v", err)
+	}
+	s, blocks = reopen(s)
+	if !sameBlocks(blocks, chain) {
+		t.Fatal("stored blocks are not read back correctly")
+	}
+	if err := blockchain.Chain(blocks).Validate(chainParams); err != nil {
+		t.Fatalf("stored blockchain is not valid: %v", err)
+	}
+
+	// switch to a fork after the first block
+	fork := append(chain[:2:2], NextBlock(chain[:2], []blockchain.Post{NewSignedPost("Hello from 3")}))
+	if err := s.Truncate(2); err != nil {
+		t.Fatalf("failed to truncate blocks: %v", err)
+	}
+	if err := s.Append(fork[2:]...); err != nil {
+		t.Fatalf("failed to append blocks: %v", err)
+	}
+	s, blocks = reopen(s)
+	if !sameBlocks(blocks, fork) || s.Height() != len(fork) {
+		t.Fatal("stored fork is not read back correctly")
+	}
+
+	// a torn record at the end of the log is discarded
+	info, err := os.Stat(filepath.Join(dir, store.BlocksFile))
+	if err != nil {
+		t.Fatalf("failed to stat block log: %v", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, store.BlocksFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open block log: %v", err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{', '"'})
+	file.Close()
+	s, blocks = reopen(s)
+	if !sameBlocks(blocks, fork) {
+		t.Fatal("a torn record corrupts the stored blocks")
+	}
+	if info2, _ := os.Stat(filepath.Join(dir, store.BlocksFile)); info2.Size() != info.Size() {
+		t.Fatal("a torn record is not truncated")
+	}
+	// a record with a bad checksum is discarded with everything after it
+	data, _ := os.ReadFile(filepath.Join(dir, store.BlocksFile))
+	data[len(data)-2] ^= 1
+	os.WriteFile(filepath.Join(dir, store.BlocksFile), data, 0o644)
+	s, blocks = reopen(s)
+	if !sameBlocks(blocks, fork[:2]) {
+		t.Fatalf("expected %d blocks after a torn record, got %d", 2, len(blocks))
+	}
+	// the log is still usable
+	if err := s.Append(fork[2]); err != nil {
+		t.Fatalf("failed to append blocks: %v", err)
+	}
+	s, blocks = reopen(s)
+	if !sameBlocks(blocks, fork) {
+		t.Fatal("blocks appended after a torn record are not read back correctly")
+	}
+
+	// the pool
+	posts, err := s.LoadPool()
+	if err != nil || len(posts) != 0 {
+		t.Fatalf("a new store has a pool of %d posts: %v", len(posts), err)
+	}
+	pool := []blockchain.Post{NewSignedPost("Pending 1"), NewSignedPost("Pending 2")}
+	if err := s.SavePool(pool); err != nil {
+		t.Fatalf("failed to save pool: %v", err)
+	}
+	s, _ = reopen(s)
+	posts, err = s.LoadPool()
+	if err != nil || len(posts) != len(pool) {
+		t.Fatalf("pool is not read back correctly: %v", err)
+	}
+	for i := range pool {
+		if !bytes.Equal(posts[i].ID(), pool[i].ID()) {
+			t.Fatal("pool is not read back correctly")
+		}
+	}
+	s.Close()
+}
@@ -3,14 +3,12 @@ package tests
 import (
 	"blockchain/blockchain"
 	Miner "blockchain/miner"
+	"blockchain/peer"
 	Tracker "blockchain/tracker"
 	User "blockchain/user"
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"net/http"
 	"reflect"
 	"testing"
 	"time"
@@ -38,7 +36,7 @@ func TestCompleteInteractions(t *testing.T) {
 
 	// each user posts something
 	for i := 0; i < 6; i++ {
-		err := users[i].WritePost(fmt.Sprintf("Hello world from %d", i))
+		_, err := users[i].WritePost(fmt.Sprintf("Hello world from %d", i))
 		if err != nil {
 			t.Fatalf("error when posting: %v", err)
 		}
@@ -175,13 +173,21 @@ func TestMergeBlockChainHeads(t *testing.T) {
 }
 
 // TestComputingPowerAttack - Simulate a successful computing power attack to a blockchain.
-// First 6 miners are in the system.
-// After 5 seconds, a malicious miner with 4 goroutines start attacking. This should not be successful.
+// First 6 miners with 2 mining workers each are in the system.
+// After 5 seconds, a malicious miner with 4 workers starts attacking. This should not be successful.
 // After 10 seconds, all but 1 miner are shut down. Now the malicious miner should be able to out-compute well-behaved
 // miners.
 // After 50 seconds, the blockchain should have been attacked successfully.
+// All workers mine with SearchNonce and share the same CPUs, so the number of workers stands for hashrate, even on a
+// single CPU: 12 against 4 before the shutdown, and 2 against 4 after it.
 func TestComputingPowerAttack(t *testing.T) {
-	tracker := Tracker.NewTracker(8080)
+	// on a machine that is busy mining, a heartbeat can take longer to reach the tracker than the default entry timeout
+	trackerConfig := Tracker.DefaultConfig()
+	trackerConfig.EntryTimeout = 5 * time.Second
+	tracker, err := Tracker.NewTrackerWithConfig(trackerConfig)
+	if err != nil {
+		t.Fatalf("error when creating tracker: %v", err)
+	}
 	tracker.Start()
 	time.Sleep(1000 * time.Millisecond)
 
@@ -189,7 +195,13 @@ func TestComputingPowerAttack(t *testing.T) {
 	// set up 6 well-behaved miners
 	miners := make([]*Miner.Miner, 0)
 	for i := 0; i < 6; i++ {
-		miner := Miner.NewMiner(3000+i, 8080)
+		config := Miner.DefaultConfig()
+		config.Port = 3000 + i
+		config.Workers = 2
+		miner, err := Miner.NewMinerWithConfig(config)
+		if err != nil {
+			t.Fatalf("error when creating miner: %v", err)
+		}
 		miner.Start()
 		miners = append(miners, miner)
 	}
@@ -199,14 +211,33 @@ func TestComputingPowerAttack(t *testing.T) {
 	// malicious miner tries to create a branch on top of this blockchain
 	quit := make(chan bool)
 	go func() {
-		attackChain := make([]blockchain.Block, 0)
+		// the malicious miner is a registered peer, whose broadcasts are signed
+		nodeKey := blockchain.GenerateKey(blockchain.Ed25519)
+		attackChain := []blockchain.Block{chainParams.Genesis}
+		// broadcast the latest attack chain in the background, so that the attack keeps mining meanwhile
+		latest := make(chan []blockchain.BlockBase64, 1)
+		defer close(latest)
+		go func() {
+			for encodedChain := range latest {
+				_, _ = RegisterPeer(8080, 3999, nodeKey)
+				for i := 0; i < 6; i++ {
+					request := Miner.BlockChainJson{Blockchain: encodedChain}
+					reqJson, _ := json.Marshal(request)
+					resp, _ := peer.Post(fmt.Sprintf("http://localhost:%d/broadcast", 3000+i), reqJson, PeerAddress(3999), nodeKey)
+					if resp != nil && resp.Body != nil {
+						resp.Body.Close()
+					}
+				}
+			}
+		}()
 		for {
-			// set up an attack block
-			privateKey := blockchain.GenerateKey()
+			// set up an attack block, with a cheap key so that key generation does not slow the attack down
+			privateKey := blockchain.GenerateKey(blockchain.Ed25519)
 			attackPost := blockchain.Post{
-				User:      &privateKey.PublicKey,
+				User:      privateKey.Public(),
 				Signature: nil,
 				Body: blockchain.PostBody{
+					ChainID:   blockchain.DefaultChainID,
 					Content:   "Spam",
 					Timestamp: time.Now().UnixNano(),
 				},
@@ -216,19 +247,15 @@ func TestComputingPowerAttack(t *testing.T) {
 			posts = append(posts, attackPost)
 			block := blockchain.Block{
 				Header: blockchain.BlockHeader{
-					PrevHash:  make([]byte, 32),
-					Summary:   blockchain.Hash(posts),
+					PrevHash:  blockchain.Hash(attackChain[len(attackChain)-1].Header),
+					Summary:   blockchain.MerkleRoot(posts),
 					Timestamp: time.Now().UnixNano(),
+					Bits:      chainParams.NextBits(attackChain),
 				},
 				Posts: posts,
 			}
-			if len(attackChain) > 0 {
-				hash := blockchain.Hash(attackChain[len(attackChain)-1].Header)
-				copy(block.Header.PrevHash, hash)
-			}
-			success := false
-			// mine this attack block
-			for !success {
+			// mine this attack block with 4 workers, as fast per worker as the well-behaved miners
+			for mined := false; !mined; {
 				select {
 				case <-quit:
 					quit <- true
@@ -236,47 +263,11 @@ func TestComputingPowerAttack(t *testing.T) {
 				default:
 					break
 				}
-				// use 4 goroutines for computing
-				chanNonce := make(chan uint32)
-				nonces := make([]uint32, 0)
-				for i := 0; i < 4; i++ {
-					go func() {
-						// create a local copy
-						encoded := block.EncodeBase64()
-						block, _ := encoded.DecodeBase64()
-					MineIter:
-						for i := 0; i < 10000; i++ {
-							block.Header.Nonce = rand.Uint32()
-							hash := blockchain.Hash(block.Header)
-							zeroBytes := blockchain.TARGET / 8
-							zeroBits := blockchain.TARGET % 8
-							// the first zeroBytes bytes of hash must be zero
-							for i := 0; i < zeroBytes; i++ {
-								if hash[i] != 0 {
-									continue MineIter
-								}
-							}
-							// and then zeroBits bits of hash must be zero
-							if zeroBits > 0 {
-								nextByte := hash[zeroBytes]
-								nextByte = nextByte >> (8 - zeroBits)
-								if nextByte != 0 {
-									continue MineIter
-								}
-							}
-							chanNonce <- block.Header.Nonce
-							return
-						}
-						chanNonce <- 0
-					}()
-				}
-				for i := 0; i < 4; i++ {
-					result := <-chanNonce
-					nonces = append(nonces, result)
-					if result != 0 {
-						block.Header.Nonce = result
-						success = true
-					}
+				// a new timestamp for every round, like mine(), so that no nonce is tried twice
+				block.Header.Timestamp = time.Now().UnixNano()
+				var header blockchain.BlockHeader
+				if header, mined = Miner.SearchNonce(block.Header, 4, 10000, nil); mined {
+					block.Header = header
 				}
 			}
 			// success
@@ -286,17 +277,12 @@ func TestComputingPowerAttack(t *testing.T) {
 				encodedChain = append(encodedChain, b.EncodeBase64())
 			}
 			log.Printf("Attack chain has length of %d\n", len(attackChain))
-			// broadcast
-			for i := 0; i < 6; i++ {
-				request := Miner.BlockChainJson{Blockchain: encodedChain}
-				reqJson, _ := json.Marshal(request)
-				resp, _ := http.Post(
-					fmt.Sprintf("http://localhost:%d/broadcast", 3000+i),
-					"application/json", bytes.NewReader(reqJson))
-				if resp != nil && resp.Body != nil {
-					resp.Body.Close()
-				}
+			// replace the chain that is not broadcast yet, if any
+			select {
+			case <-latest:
+			default:
 			}
+			latest <- encodedChain
 		}
 	}()
 	t.Log("Started malicious miners")
@@ -1,11 +1,16 @@
 package tests
 
 import (
+	"blockchain/blockchain"
 	Miner "blockchain/miner"
+	"blockchain/peer"
 	Tracker "blockchain/tracker"
+	User "blockchain/user"
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"slices"
 	"testing"
 	"time"
 )
@@ -80,3 +85,221 @@ func TestMinerDiscovery(t *testing.T) {
 	}
 	tracker.Shutdown()
 }
+
+// TestTrackerPartition checks that a partitioned tracker only tells a registering miner about the miners in its own
+// group, while users still see all miners, and that healing the partition brings all miners back together.
+func TestTrackerPartition(t *testing.T) {
+	config := Tracker.DefaultConfig()
+	config.Port = 8091
+	config.EntryTimeout = 10 * time.Second
+	tracker, err := Tracker.NewTrackerWithConfig(config)
+	if err != nil {
+		t.Fatalf("error when creating tracker: %v", err)
+	}
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	// register registers a mock miner, and returns the peers it is told about
+	register := func(port int) []int {
+		reqBytes, _ := json.Marshal(Tracker.PortJson{Port: port})
+		resp, err := http.Post("http://localhost:8091/register", "application/json", bytes.NewReader(reqBytes))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to register to tracker")
+		}
+		defer resp.Body.Close()
+		var response Tracker.PortsJson
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		return response.Ports
+	}
+	for port := 3100; port < 3104; port++ {
+		register(port)
+	}
+	tracker.Partition(func(address string) int { return peer.PortOf(address) % 2 })
+	peers := register(3100)
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers in the partition, got %v", peers)
+	}
+	for _, port := range peers {
+		if port%2 != 0 {
+			t.Fatalf("miner 3100 is told about miner %d across the partition", port)
+		}
+	}
+	var response Tracker.PortsJson
+	if code, err := GetJSON("http://localhost:8091/get_miners", &response); err != nil || code != http.StatusOK ||
+		len(response.Ports) != 4 {
+		t.Fatalf("expected users to see all 4 miners, got %v", response.Ports)
+	}
+	tracker.Partition(nil)
+	if peers := register(3101); len(peers) != 4 {
+		t.Fatalf("expected 4 peers after healing, got %v", peers)
+	}
+}
+
+// TestTrackerAddresses checks that the tracker lists miners by the addresses they advertise, that a miner that
+// registers with a port alone is listed on the host that its request comes from, and that a miner with a node key takes
+// over its address from a registration without one.
+func TestTrackerAddresses(t *testing.T) {
+	config := Tracker.DefaultConfig()
+	config.Port = 8095
+	config.EntryTimeout = 10 * time.Second
+	tracker, err := Tracker.NewTrackerWithConfig(config)
+	if err != nil {
+		t.Fatalf("error when creating tracker: %v", err)
+	}
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	register := func(request Tracker.PortJson) (int, Tracker.PortsJson) {
+		reqBytes, _ := json.Marshal(request)
+		resp, err := http.Post("http://localhost:8095/register", "application/json", bytes.NewReader(reqBytes))
+		if err != nil {
+			t.Fatalf("failed to connect to tracker")
+		}
+		defer resp.Body.Close()
+		var response Tracker.PortsJson
+		_ = json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, response
+	}
+	if code, _ := register(Tracker.PortJson{Address: "miner.example"}); code != http.StatusBadRequest {
+		t.Fatalf("expected an address without a port to be refused, got %d", code)
+	}
+	register(Tracker.PortJson{Port: 3140})
+	register(Tracker.PortJson{Port: 3141, Address: "miner.example:3141"})
+	code, response := register(Tracker.PortJson{Address: "https://miner.example/api"})
+	if code != http.StatusOK {
+		t.Fatalf("failed to register a miner by URL: %d", code)
+	}
+	expected := map[string]int{"127.0.0.1:3140": 3140, "miner.example:3141": 3141, "https://miner.example/api": 0}
+	if len(response.Addresses) != len(expected) || len(response.Ports) != len(expected) {
+		t.Fatalf("wrong miners: %+v", response)
+	}
+	for i, address := range response.Addresses {
+		if port, ok := expected[address]; !ok || response.Ports[i] != port {
+			t.Fatalf("unexpected miner %s on port %d", address, response.Ports[i])
+		}
+	}
+
+	// a registration without a node key, directly or copied from another tracker, does not keep the miner with the
+	// key out of its address
+	replicate := func(request Tracker.PortJson) int {
+		reqBytes, _ := json.Marshal(request)
+		resp, err := http.Post("http://localhost:8095/replicate", "application/json", bytes.NewReader(reqBytes))
+		if err != nil {
+			t.Fatalf("failed to connect to tracker")
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code, _ := register(Tracker.PortJson{Port: 3173, Address: PeerAddress(3173)}); code != http.StatusOK {
+		t.Fatalf("failed to register a miner without a node key: %d", code)
+	}
+	if code := replicate(Tracker.PortJson{Port: 3174, Address: PeerAddress(3174)}); code != http.StatusOK {
+		t.Fatalf("failed to copy a registration without a node key: %d", code)
+	}
+	for _, port := range []int{3173, 3174} {
+		key := blockchain.GenerateKey(blockchain.Ed25519)
+		if code, err := RegisterPeer(8095, port, key); err != nil || code != http.StatusOK {
+			t.Fatalf("expected the miner with the node key to take over its address, got %d %v", code, err)
+		}
+		if code, _ := register(Tracker.PortJson{Port: port, Address: PeerAddress(port)}); code != http.StatusConflict {
+			t.Fatalf("expected a registration without a node key to be refused for an address with one, got %d", code)
+		}
+		var miners Tracker.PortsJson
+		if _, err := GetJSON("http://localhost:8095/get_miners", &miners); err != nil {
+			t.Fatalf("error when getting miners: %v", err)
+		}
+		if miners.Keys[PeerAddress(port)] != peer.EncodeKey(key.Public()) {
+			t.Fatalf("tracker does not record the node key of the miner: %v", miners.Keys)
+		}
+	}
+}
+
+// TestMultipleTrackers checks that trackers copy registrations to their peer trackers only with the miner's signature,
+// that a miner registers to every tracker it knows even if one of them is down, and that a user merges the miners of
+// all trackers that answer.
+func TestMultipleTrackers(t *testing.T) {
+	for _, ports := range [][2]int{{8097, 8098}, {8098, 8097}} {
+		config := Tracker.DefaultConfig()
+		config.Port = ports[0]
+		config.EntryTimeout = 10 * time.Second
+		config.Peers = []string{PeerAddress(ports[1])}
+		tracker, err := Tracker.NewTrackerWithConfig(config)
+		if err != nil {
+			t.Fatalf("error when creating tracker: %v", err)
+		}
+		tracker.Start()
+		defer tracker.Shutdown()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	key := blockchain.GenerateKey(blockchain.Ed25519)
+	if code, err := RegisterPeer(8097, 3142, key); err != nil || code != http.StatusOK {
+		t.Fatalf("failed to register a fake peer: %d %v", code, err)
+	}
+	if !WaitForMiner(8098, PeerAddress(3142)) {
+		t.Fatal("expected the registration to be copied to the peer tracker")
+	}
+
+	// a copied registration must carry the signature of the miner
+	forged, _ := json.Marshal(Tracker.PortJson{
+		Address:   PeerAddress(3143),
+		PublicKey: peer.EncodeKey(blockchain.GenerateKey(blockchain.Ed25519).Public()),
+	})
+	resp, err := http.Post("http://localhost:8098/replicate", "application/json", bytes.NewReader(forged))
+	if err != nil {
+		t.Fatalf("failed to connect to tracker")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an unsigned copy of a registration to be refused, got %d", resp.StatusCode)
+	}
+
+	// the first tracker of the miner is down
+	miner := Miner.NewMiner(3036, 8099, 8097)
+	miner.Start()
+	defer miner.Shutdown()
+	if !WaitForMiner(8097, PeerAddress(3036)) || !WaitForMiner(8098, PeerAddress(3036)) {
+		t.Fatal("expected the miner to register to the tracker that is up, and the tracker to copy it")
+	}
+
+	miners, err := User.NewUser(8099, 8098).GetMiners()
+	if err != nil {
+		t.Fatalf("expected the user to fail over to the tracker that is up: %v", err)
+	}
+	if !slices.Contains(miners, PeerAddress(3142)) || !slices.Contains(miners, PeerAddress(3036)) {
+		t.Fatalf("expected both miners, got %v", miners)
+	}
+	if _, err := User.NewUser(8099).GetMiners(); err == nil {
+		t.Fatal("expected an error when no tracker is up")
+	}
+
+	// the first tracker of the user accepts requests but does not answer for far longer than the user waits
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer hanging.Close()
+	defer close(release)
+	user, err := User.NewUserWithTrackers([]string{hanging.URL, PeerAddress(8098)}, blockchain.DefaultChainParams(),
+		blockchain.GenerateKey(blockchain.Ed25519))
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	user.SetTimeout(2 * time.Second)
+	start := time.Now()
+	miners, err = user.GetMiners()
+	if err != nil {
+		t.Fatalf("expected the user to fail over from a tracker that hangs: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the user to give up on a tracker that hangs, took %v", elapsed)
+	}
+	if !slices.Contains(miners, PeerAddress(3036)) {
+		t.Fatalf("expected the miners of the tracker that answers, got %v", miners)
+	}
+}
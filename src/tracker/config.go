@@ -0,0 +1,52 @@
+package tracker
+
+import (
+	"blockchain/peer"
+	"blockchain/settings"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config - Settings of a Tracker, see DefaultConfig for the defaults.
+type Config struct {
+	Host         string        `yaml:"host"`          // host that the http server binds to, or empty for all interfaces
+	Port         int           `yaml:"port"`          // http port
+	EntryTimeout time.Duration `yaml:"entry-timeout"` // a miner entry expires after EntryTimeout without heartbeats
+	Peers        []string      `yaml:"peers"`         // addresses of other trackers that registrations are copied to
+}
+
+// DefaultConfig - the default settings of a Tracker on port 8080.
+func DefaultConfig() Config {
+	return Config{
+		Host:         "localhost",
+		Port:         8080,
+		EntryTimeout: 500 * time.Millisecond,
+	}
+}
+
+// LoadConfig - reads the settings in the YAML or JSON file at path. Settings missing from the file keep their
+// defaults.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if err := settings.Load(path, &config); err != nil {
+		return Config{}, err
+	}
+	return config, config.Validate()
+}
+
+// Validate - checks that every setting is in range.
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return errors.New("port must be from 1 to 65535")
+	}
+	if c.EntryTimeout <= 0 {
+		return errors.New("entry-timeout must be positive")
+	}
+	for _, address := range c.Peers {
+		if err := peer.CheckAddress(address); err != nil {
+			return fmt.Errorf("peers: %w", err)
+		}
+	}
+	return nil
+}
@@ -1,50 +1,159 @@
 package tracker
 
 import (
+	"blockchain/blockchain"
+	"blockchain/peer"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
 
-// EntryTimeout - A miner entry expires after EntryTimeout, if no heartbeats are received.
-const EntryTimeout = 500 * time.Millisecond
-
 type PortJson struct {
-	Port int `json:"port"`
+	Port      int    `json:"port"`                 // port of the miner, on the host that the request comes from
+	Address   string `json:"address,omitempty"`    // address that the miner advertises instead, see peer.URL
+	PublicKey string `json:"public-key,omitempty"` // node key of the miner, see peer.EncodeKey
 }
 
 type PortsJson struct {
-	Ports []int `json:"ports"`
+	Ports     []int             `json:"ports"`               // port of every miner, for clients that only know ports
+	Addresses []string          `json:"addresses,omitempty"` // address of every miner, see peer.URL
+	Keys      map[string]string `json:"keys,omitempty"`      // node keys of the miners that registered one by address
+}
+
+// MinerAddresses - the addresses of the miners in r. A tracker that lists their ports alone means miners on localhost.
+func (r *PortsJson) MinerAddresses() []string {
+	if len(r.Addresses) > 0 {
+		return r.Addresses
+	}
+	addresses := make([]string, 0, len(r.Ports))
+	for _, port := range r.Ports {
+		addresses = append(addresses, net.JoinHostPort("localhost", strconv.Itoa(port)))
+	}
+	return addresses
+}
+
+// ResolveAddress - the address of the miner that registers with r from remoteAddr (see http.Request.RemoteAddr): the
+// address it advertises, or else its port on the host that the request comes from, as registrations with a port alone
+// used to mean.
+func (r *PortJson) ResolveAddress(remoteAddr string) (string, error) {
+	if r.Address != "" {
+		return r.Address, peer.CheckAddress(r.Address)
+	}
+	if r.Port <= 0 || r.Port > 65535 {
+		return "", errors.New("registration has neither an address nor a valid port")
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(r.Port)), nil
 }
 
+// ReplicationTimeout - A tracker gives up copying a registration to a peer tracker after ReplicationTimeout.
+const ReplicationTimeout = 2 * time.Second
+
 // Tracker - A Tracker in the blockchain system.
 type Tracker struct {
-	miners map[int]*time.Timer // maps each miner's port to its expiration timer
-	lock   sync.Mutex          // protects miners for concurrent access
-	router *gin.Engine         // http router
-	server *http.Server        // http server
+	config Config                   // settings, see Config
+	miners map[string]*time.Timer   // maps each miner's address to its expiration timer
+	keys   map[string]string        // maps the address of each miner that registered a node key to the encoded key
+	group  func(address string) int // the group of each miner while the network is partitioned, see Partition
+	lock   sync.Mutex               // protects miners, keys and group for concurrent access
+	client *http.Client             // http client for copying registrations to the peer trackers
+	router *gin.Engine              // http router
+	server *http.Server             // http server
 }
 
-// NewTracker - creates a new Tracker, but does not start its http server yet.
+// NewTracker - creates a new Tracker on port with the default settings, but does not start its http server yet.
 func NewTracker(port int) *Tracker {
+	config := DefaultConfig()
+	config.Port = port
+	tracker, err := NewTrackerWithConfig(config)
+	if err != nil {
+		log.Fatalf("invalid tracker port %d: %s", port, err.Error())
+	}
+	return tracker
+}
+
+// NewTrackerWithConfig - creates a new Tracker with the given settings, but does not start its http server yet.
+// Returns an error if the settings are invalid.
+func NewTrackerWithConfig(config Config) (*Tracker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	tracker := &Tracker{
-		miners: make(map[int]*time.Timer),
+		config: config,
+		miners: make(map[string]*time.Timer),
+		keys:   make(map[string]string),
 		router: gin.New(),
+		client: &http.Client{Timeout: ReplicationTimeout},
 	}
 
 	// register APIs
 	tracker.router.POST("/register", func(ctx *gin.Context) {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
 		var request PortJson
-		if err := ctx.BindJSON(&request); err != nil {
+		if err := json.Unmarshal(body, &request); err != nil {
 			ctx.JSON(http.StatusBadRequest, nil)
 			return
 		}
-		statusCode, response := tracker.registerHandler(request)
+		address, err := request.ResolveAddress(ctx.Request.RemoteAddr)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if statusCode, err := verifyRegistration(ctx.Request, body, request, address); err != nil {
+			ctx.JSON(statusCode, map[string]string{"error": err.Error()})
+			return
+		}
+		statusCode, response := tracker.registerHandler(address, request.PublicKey)
+		if statusCode == http.StatusOK {
+			if request.Address == "" {
+				// the peer trackers cannot tell where the request comes from, and nothing is signed
+				request.Address = address
+				body, _ = json.Marshal(request)
+			}
+			tracker.replicate(address, body, ctx.Request.Header)
+		}
+		ctx.JSON(statusCode, response)
+	})
+	tracker.router.POST("/replicate", func(ctx *gin.Context) {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		var request PortJson
+		if err := json.Unmarshal(body, &request); err != nil {
+			ctx.JSON(http.StatusBadRequest, nil)
+			return
+		}
+		if err := peer.CheckAddress(request.Address); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		// the signature covers the miner's original request to /register
+		original := ctx.Request.Clone(ctx)
+		original.URL = &url.URL{Path: "/register"}
+		if statusCode, err := verifyRegistration(original, body, request, request.Address); err != nil {
+			ctx.JSON(statusCode, map[string]string{"error": err.Error()})
+			return
+		}
+		statusCode, response := tracker.registerHandler(request.Address, request.PublicKey)
 		ctx.JSON(statusCode, response)
 	})
 	tracker.router.GET("/get_miners", func(ctx *gin.Context) {
@@ -53,11 +162,11 @@ func NewTracker(port int) *Tracker {
 	})
 
 	tracker.server = &http.Server{
-		Addr:    fmt.Sprintf("localhost:%d", port),
+		Addr:    net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
 		Handler: tracker.router,
 	}
 
-	return tracker
+	return tracker, nil
 }
 
 // Start - starts the Tracker's http server.
@@ -84,27 +193,114 @@ func (t *Tracker) Shutdown() {
 	}
 }
 
-// registerHandler - handles request to /register API.
-func (t *Tracker) registerHandler(request PortJson) (int, any) {
-	port := request.Port
+// Partition - partitions the network for testing: from now on, a registering miner only learns about the miners in
+// the same group as itself, so groups stop talking to each other after their next heartbeats. Users still learn about
+// all miners. A nil group heals the network.
+func (t *Tracker) Partition(group func(address string) int) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	timer, ok := t.miners[port]
+	t.group = group
+}
+
+// registerHandler - handles request to /register API from the miner at address, with the encoded node key key or
+// none. While a miner's entry is alive, its address stays bound to the node key it registered with, so that no one
+// else can take over the address with another key, or without a key. A registration with a key takes over an address
+// that is registered without one, since anyone can register an address without a key, and would otherwise keep the
+// miner that holds the key out. The key of a signed request is already verified.
+func (t *Tracker) registerHandler(address string, key string) (int, any) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	timer, ok := t.miners[address]
 	if ok {
+		if registered := t.keys[address]; registered != key && (registered != "" || key == "") {
+			return http.StatusConflict, map[string]string{"error": "address is registered with another node key"}
+		}
 		// stop timer
 		timer.Stop()
 	}
 	// register a new timer
-	t.miners[port] = time.AfterFunc(EntryTimeout, func() {
+	if key != "" {
+		t.keys[address] = key
+	}
+	t.miners[address] = time.AfterFunc(t.config.EntryTimeout, func() {
 		t.lock.Lock()
 		defer t.lock.Unlock()
-		delete(t.miners, port)
+		delete(t.miners, address)
+		delete(t.keys, address)
 	})
-	var response PortsJson
-	for port := range t.miners {
-		response.Ports = append(response.Ports, port)
+	peers := make([]string, 0)
+	for peer := range t.miners {
+		if t.group == nil || t.group(peer) == t.group(address) {
+			peers = append(peers, peer)
+		}
+	}
+	return http.StatusOK, t.response(peers)
+}
+
+// response - the list of the miners at addresses, with their ports and node keys. The caller must hold the lock.
+func (t *Tracker) response(addresses []string) PortsJson {
+	response := PortsJson{Ports: make([]int, 0), Addresses: addresses, Keys: make(map[string]string)}
+	for _, address := range addresses {
+		response.Ports = append(response.Ports, peer.PortOf(address))
+		if key, ok := t.keys[address]; ok {
+			response.Keys[address] = key
+		}
+	}
+	return response
+}
+
+// verifyRegistration - checks that registration, which request to /register carries in body, proves that the miner at
+// address holds the node key it registers, if any. Returns the status code to reject the request with otherwise.
+func verifyRegistration(request *http.Request, body []byte, registration PortJson, address string) (int, error) {
+	if registration.PublicKey == "" {
+		return http.StatusOK, nil
+	}
+	if registration.Address == "" {
+		return http.StatusBadRequest, errors.New("node key is registered without an address")
+	}
+	key, err := peer.DecodeKey(registration.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("node key is invalid: " + err.Error())
+	}
+	signer, err := peer.Verify(request, body, func(string) blockchain.PublicKey { return key })
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	if signer != address {
+		return http.StatusUnauthorized, errors.New("request is signed for another address")
+	}
+	return http.StatusOK, nil
+}
+
+// replicate - copies the registration of the miner at address, which is body with the signature in header, to every
+// peer tracker in the background, see Config.Peers. The peer trackers check the miner's signature and register it like
+// the miner did, but do not copy it any further, so every tracker needs all others as peers to have the same view.
+func (t *Tracker) replicate(address string, body []byte, header http.Header) {
+	for _, tracker := range t.config.Peers {
+		request, err := http.NewRequest(http.MethodPost, peer.URL(tracker)+"/replicate", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("failed to copy registration to tracker %s: %s\n", tracker, err.Error())
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		for _, name := range []string{peer.AddressHeader, peer.TimestampHeader, peer.SignatureHeader} {
+			if value := header.Get(name); value != "" {
+				request.Header.Set(name, value)
+			}
+		}
+		go func(tracker string) {
+			resp, err := t.client.Do(request)
+			if err != nil {
+				log.Printf("failed to copy registration to tracker %s: %s\n", tracker, err.Error())
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("tracker %s rejected copied registration of %s: status code %d\n", tracker, address,
+					resp.StatusCode)
+			}
+		}(tracker)
 	}
-	return http.StatusOK, response
 }
 
 // getMinersHandler - handles request to /get_miners API.
@@ -115,10 +311,9 @@ func (t *Tracker) getMinersHandler() (int, any) {
 		// no miners currently
 		return http.StatusNotFound, nil
 	}
-	ports := make([]int, 0)
-	for port := range t.miners {
-		ports = append(ports, port)
+	addresses := make([]string, 0)
+	for address := range t.miners {
+		addresses = append(addresses, address)
 	}
-	response := PortsJson{Ports: ports}
-	return http.StatusOK, response
+	return http.StatusOK, t.response(addresses)
 }
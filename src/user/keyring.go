@@ -0,0 +1,421 @@
+package user
+
+import (
+	"blockchain/blockchain"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// KeyIterations - Number of PBKDF2 iterations that turn a passphrase into the key that encrypts a private key.
+const KeyIterations = 600000
+
+// EncryptedKeyType - Type of the PEM block of an encrypted private key, see EncryptPrivateKey.
+const EncryptedKeyType = "ENCRYPTED PRIVATE KEY"
+
+// PlainKeyType - Type of the PEM block of an unencrypted PKCS#8 private key, which can be imported to a keyring.
+const PlainKeyType = "PRIVATE KEY"
+
+// PublicKeyType - Type of the PEM block of a PKIX public key.
+const PublicKeyType = "PUBLIC KEY"
+
+// ErrWrongPassphrase - A private key cannot be decrypted with the given passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key")
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo - The PKCS#8 EncryptedPrivateKeyInfo structure (RFC 5958).
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params - Parameters of the PBES2 encryption scheme (RFC 8018).
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params - Parameters of the PBKDF2 key derivation function (RFC 8018).
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// EncryptPrivateKey encrypts a private key with a passphrase into a PEM block of type EncryptedKeyType.
+// The key is encoded with PKCS#8 (see blockchain.MarshalPrivateKey) and encrypted with PBES2, using PBKDF2 with
+// HMAC-SHA256 and AES-256-CBC, the same as `openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256` does.
+// Parameters:
+//
+//	privateKey (blockchain.Signer): The private key to encrypt.
+//	passphrase ([]byte): The passphrase to encrypt with, which must not be empty.
+//
+// Returns:
+//
+//	([]byte, error): The PEM encoded key and an error, if any occurred during the process.
+func EncryptPrivateKey(privateKey blockchain.Signer, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	der, err := blockchain.MarshalPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, KeyIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	// pad to whole blocks as PKCS#7 does
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: KeyIterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	schemeParams, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: schemeParams}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: EncryptedKeyType, Bytes: info}), nil
+}
+
+// DecryptPrivateKey decrypts the output of EncryptPrivateKey, or of openssl with the same settings.
+// An unencrypted PKCS#8 key, in a PEM block of type PlainKeyType, is also accepted and needs no passphrase.
+// Parameters:
+//
+//	data ([]byte): The PEM encoded key.
+//	passphrase ([]byte): The passphrase the key is encrypted with.
+//
+// Returns:
+//
+//	(blockchain.Signer, error): The private key and an error, ErrWrongPassphrase if the passphrase does not match.
+func DecryptPrivateKey(data []byte, passphrase []byte) (blockchain.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == PlainKeyType {
+		return blockchain.ParsePrivateKey(block.Bytes)
+	}
+	if block.Type != EncryptedKeyType {
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, fmt.Errorf("malformed encrypted key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %v, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var scheme pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &scheme); err != nil {
+		return nil, fmt.Errorf("malformed encrypted key: %w", err)
+	}
+	if !scheme.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !scheme.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errors.New("unsupported key encryption, only PBKDF2 with AES-256-CBC is supported")
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(scheme.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("malformed encrypted key: %w", err)
+	}
+	if !kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, errors.New("unsupported key derivation, only HMAC-SHA256 is supported")
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > 100*KeyIterations {
+		return nil, fmt.Errorf("unreasonable iteration count %d", kdf.IterationCount)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(scheme.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("malformed encrypted key: bad initialization vector")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted key: bad length")
+	}
+
+	cipherBlock, err := aes.NewCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	der := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(cipherBlock, iv).CryptBlocks(der, info.EncryptedData)
+	// a wrong passphrase almost always breaks the padding, and otherwise the encoding
+	padding := int(der[len(der)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(der[len(der)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, ErrWrongPassphrase
+	}
+	privateKey, err := blockchain.ParsePrivateKey(der[:len(der)-padding])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return privateKey, nil
+}
+
+// LoadUser initializes a new instance of a User with trackers at any addresses on the network of params, which signs
+// its posts with the private key in an encrypted PEM file, see SaveKey.
+// Parameters:
+//
+//	trackers ([]string): The addresses of the trackers, either host:port or http or https URLs, see peer.CheckAddress.
+//	params (*blockchain.ChainParams): The consensus parameters of the network.
+//	path (string): The PEM file of the private key.
+//	passphrase ([]byte): The passphrase the key is encrypted with.
+//
+// Returns:
+//
+//	(*User, error): Pointer to the newly created User struct and an error, ErrWrongPassphrase if the passphrase does
+//	not match.
+func LoadUser(trackers []string, params *blockchain.ChainParams, path string, passphrase []byte) (*User, error) {
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain params: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := DecryptPrivateKey(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load key from %s: %w", path, err)
+	}
+	return NewUserWithTrackers(trackers, params, privateKey)
+}
+
+// SaveKey encrypts the user's private key with a passphrase and writes it to a new PEM file, readable only by the
+// owner, so that LoadUser can restore the same user later. An existing file is never overwritten.
+// Parameters:
+//
+//	path (string): The PEM file to create.
+//	passphrase ([]byte): The passphrase to encrypt with, which must not be empty.
+//
+// Returns:
+//
+//	error: An error if the file exists or any other error occurred during the process.
+func (u *User) SaveKey(path string, passphrase []byte) error {
+	data, err := EncryptPrivateKey(u.privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(path, data, 0o600)
+}
+
+// PublicKey returns the public key that the user's posts are signed for.
+// Returns:
+//
+//	blockchain.PublicKey: The user's public key.
+func (u *User) PublicKey() blockchain.PublicKey {
+	return u.privateKey.Public()
+}
+
+// writeNewFile writes data to a file that must not exist yet, and flushes it to the disk.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// identityName - What a keyring identity may be called: letters, digits, dots, dashes and underscores, not starting
+// with a dot.
+var identityName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// checkName returns an error unless name is a valid identity name, so that no name reaches outside the keyring.
+func checkName(name string) error {
+	if !identityName.MatchString(name) {
+		return fmt.Errorf("invalid identity name %q", name)
+	}
+	return nil
+}
+
+// Keyring - A directory of named identities. Identity name has its encrypted private key in name.pem, see SaveKey,
+// and its public key in name.pub, a PKIX PEM file that needs no passphrase to read.
+type Keyring struct {
+	dir string
+}
+
+// OpenKeyring opens the keyring in dir, creating the directory if needed, readable only by the owner.
+// Parameters:
+//
+//	dir (string): The directory of the keyring.
+//
+// Returns:
+//
+//	(*Keyring, error): Pointer to the keyring and an error, if any occurred during the process.
+func OpenKeyring(dir string) (*Keyring, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Keyring{dir: dir}, nil
+}
+
+// Path returns the file of the encrypted private key of an identity, which LoadUser reads.
+// Parameters:
+//
+//	name (string): The name of the identity.
+//
+// Returns:
+//
+//	(string, error): The path of the identity's private key and an error, if the name is invalid.
+func (k *Keyring) Path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(k.dir, name+".pem"), nil
+}
+
+// Names lists the identities in the keyring, in alphabetical order.
+// Returns:
+//
+//	([]string, error): The names of all identities and an error, if any occurred during the process.
+func (k *Keyring) Names() ([]string, error) {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".pem")
+		if ok && !entry.IsDir() && identityName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Create generates a new key pair for a new identity, and stores it in the keyring.
+// Parameters:
+//
+//	name (string): The name of the identity, which must not exist yet.
+//	algorithm (blockchain.Algorithm): The signature scheme of the key.
+//	passphrase ([]byte): The passphrase to encrypt the private key with, which must not be empty.
+//
+// Returns:
+//
+//	(blockchain.PublicKey, error): The public key of the new identity and an error, if any occurred during the process.
+func (k *Keyring) Create(name string, algorithm blockchain.Algorithm, passphrase []byte) (blockchain.PublicKey, error) {
+	privateKey := blockchain.GenerateKey(algorithm)
+	if err := k.store(name, privateKey, passphrase); err != nil {
+		return nil, err
+	}
+	return privateKey.Public(), nil
+}
+
+// Import stores an existing private key as a new identity in the keyring.
+// Parameters:
+//
+//	name (string): The name of the identity, which must not exist yet.
+//	data ([]byte): The PEM encoded private key, either encrypted with passphrase or unencrypted PKCS#8.
+//	passphrase ([]byte): The passphrase to decrypt data with, and to encrypt the stored key with.
+//
+// Returns:
+//
+//	(blockchain.PublicKey, error): The public key of the new identity and an error, if any occurred during the process.
+func (k *Keyring) Import(name string, data []byte, passphrase []byte) (blockchain.PublicKey, error) {
+	privateKey, err := DecryptPrivateKey(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.store(name, privateKey, passphrase); err != nil {
+		return nil, err
+	}
+	return privateKey.Public(), nil
+}
+
+// PublicKey reads the public key of an identity, which needs no passphrase.
+// Parameters:
+//
+//	name (string): The name of the identity.
+//
+// Returns:
+//
+//	(blockchain.PublicKey, error): The public key of the identity and an error, if any occurred during the process.
+func (k *Keyring) PublicKey(name string) (blockchain.PublicKey, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(k.dir, name+".pub"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PublicKeyType {
+		return nil, fmt.Errorf("no public key found for %s", name)
+	}
+	return blockchain.ParsePublicKey(block.Bytes)
+}
+
+// store writes the private key and the public key of a new identity.
+func (k *Keyring) store(name string, privateKey blockchain.Signer, passphrase []byte) error {
+	path, err := k.Path(name)
+	if err != nil {
+		return err
+	}
+	der, err := blockchain.MarshalPublicKey(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	u := &User{privateKey: privateKey}
+	if err := u.SaveKey(path, passphrase); err != nil {
+		return err
+	}
+	publicPath := filepath.Join(k.dir, name+".pub")
+	// a stale public key of a deleted identity is replaced
+	os.Remove(publicPath)
+	return writeNewFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: PublicKeyType, Bytes: der}), 0o644)
+}
@@ -3,16 +3,20 @@ package user
 import (
 	"blockchain/blockchain"
 	"blockchain/miner"
+	"blockchain/peer"
 	"blockchain/tracker"
 	"bytes"
-	"crypto/rsa"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/emirpasic/gods/sets/treeset"
+	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -20,39 +24,154 @@ import (
 // RWCount - Number of miners to select for writing posts
 const RWCount = 3
 
+// RequestTimeout - Default time after which a request to a tracker or a miner gives up, see User.SetTimeout
+const RequestTimeout = 10 * time.Second
+
 // User represents a user in the blockchain system
 type User struct {
-	privateKey  *rsa.PrivateKey
-	trackerPort int
+	privateKey blockchain.Signer
+	params     *blockchain.ChainParams
+	trackers   []string     // addresses of the trackers, see peer.URL
+	client     *http.Client // http client for requests to the trackers and miners, see SetTimeout
+}
+
+// NewUser initializes a new instance of a User with trackers on specific ports of localhost on the main network.
+// The function generates a new Ed25519 private key for the user and returns a User struct with the initialized values.
+// Parameters:
+//
+//	trackerPorts (...int): The port numbers on which the tracker services are running.
+//
+// Returns:
+//
+//	*User: Pointer to the newly created User struct.
+func NewUser(trackerPorts ...int) *User {
+	privateKey := blockchain.GenerateKey(blockchain.Ed25519)
+	return newUser(localTrackers(trackerPorts), blockchain.DefaultChainParams(), privateKey)
+}
+
+// NewUserWithParams initializes a new instance of a User with specific tracker ports on the network of params.
+// The user signs its posts for the network's chain ID, and only accepts blockchains that are valid for the network.
+// Parameters:
+//
+//	params (*blockchain.ChainParams): The consensus parameters of the network.
+//	trackerPorts (...int): The port numbers on which the tracker services are running.
+//
+// Returns:
+//
+//	*User: Pointer to the newly created User struct.
+//	error: An error if params are invalid, see blockchain.ChainParams.Validate.
+func NewUserWithParams(params *blockchain.ChainParams, trackerPorts ...int) (*User, error) {
+	return NewUserWithKey(params, blockchain.GenerateKey(blockchain.Ed25519), trackerPorts...)
+}
+
+// NewUserWithKey initializes a new instance of a User with specific tracker ports on the network of params, which
+// signs its posts with an existing private key, so that the user keeps its identity across restarts.
+// Parameters:
+//
+//	params (*blockchain.ChainParams): The consensus parameters of the network.
+//	privateKey (blockchain.Signer): The private key of the user, see blockchain.ParsePrivateKey.
+//	trackerPorts (...int): The port numbers on which the tracker services are running.
+//
+// Returns:
+//
+//	*User: Pointer to the newly created User struct.
+//	error: An error if params are invalid, see blockchain.ChainParams.Validate.
+func NewUserWithKey(params *blockchain.ChainParams, privateKey blockchain.Signer, trackerPorts ...int) (*User, error) {
+	return NewUserWithTrackers(localTrackers(trackerPorts), params, privateKey)
 }
 
-// NewUser initializes a new instance of a User with a specific tracker port.
-// The function generates a new RSA private key for the user and returns a User struct with the initialized values.
+// localTrackers returns the addresses of the trackers on the given ports of localhost.
+func localTrackers(trackerPorts []int) []string {
+	trackers := make([]string, 0, len(trackerPorts))
+	for _, trackerPort := range trackerPorts {
+		trackers = append(trackers, net.JoinHostPort("localhost", strconv.Itoa(trackerPort)))
+	}
+	return trackers
+}
+
+// NewUserWithTrackers initializes a new instance of a User with trackers at any addresses on the network of params,
+// which signs its posts with an existing private key.
 // Parameters:
 //
-//	trackerPort (int): The port number on which the tracker service is running.
+//	trackers ([]string): The addresses of the trackers, either host:port or http or https URLs, see peer.CheckAddress.
+//	params (*blockchain.ChainParams): The consensus parameters of the network.
+//	privateKey (blockchain.Signer): The private key of the user, see blockchain.ParsePrivateKey.
 //
 // Returns:
 //
 //	*User: Pointer to the newly created User struct.
-func NewUser(trackerPort int) *User {
-	privateKey := blockchain.GenerateKey()
+//	error: An error if params are invalid, see blockchain.ChainParams.Validate.
+func NewUserWithTrackers(trackers []string, params *blockchain.ChainParams,
+	privateKey blockchain.Signer) (*User, error) {
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain params: %w", err)
+	}
+	return newUser(trackers, params, privateKey), nil
+}
+
+// newUser initializes a new instance of a User with trackers at any addresses on the network of params, which are
+// already known to be valid.
+func newUser(trackers []string, params *blockchain.ChainParams, privateKey blockchain.Signer) *User {
 	return &User{
-		privateKey:  privateKey,
-		trackerPort: trackerPort,
+		privateKey: privateKey,
+		params:     params,
+		trackers:   trackers,
+		client:     &http.Client{Timeout: RequestTimeout},
 	}
 }
 
-// GetRandomMiners retrieves a random subset of miners from the tracker service.
+// SetTimeout sets how long a request to a tracker or a miner may take before it gives up, so that a tracker or a
+// miner that never answers cannot hang the user. The default is RequestTimeout.
+// Parameters:
+//
+//	timeout (time.Duration): The time after which a request gives up.
+func (u *User) SetTimeout(timeout time.Duration) {
+	u.client.Timeout = timeout
+}
+
+// GetMiners retrieves all active miners from the tracker services.
+// It asks every tracker in turn and merges the miners they list, so that it only fails if no tracker answers.
+// Returns:
+//
+//	([]string, error): A slice of the addresses of all active miners and an error, if any occurred during the process.
+func (u *User) GetMiners() ([]string, error) {
+	miners := make([]string, 0)
+	seen := make(map[string]bool)
+	errs := make([]error, 0)
+	for _, address := range u.trackers {
+		addresses, err := u.getMinersFrom(address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, miner := range addresses {
+			if !seen[miner] {
+				seen[miner] = true
+				miners = append(miners, miner)
+			}
+		}
+	}
+	if len(errs) == len(u.trackers) {
+		if len(errs) == 0 {
+			return nil, errors.New("no tracker is configured")
+		}
+		return nil, errors.Join(errs...)
+	}
+	return miners, nil
+}
+
+// getMinersFrom retrieves all active miners from one tracker.
 // It sends a GET request to the tracker's "/get_miners" endpoint and decodes the list of active miners.
-// If the number of available miners is less than or equal to RWCount, it returns all miners. Otherwise, it shuffles
-// the list and selects a random subset of RWCount miners.
+// Parameters:
+//
+//	address (string): The address of the tracker.
+//
 // Returns:
 //
-//	([]int, error): A slice of selected miner ports and an error, if any occurred during the process.
-func (u *User) GetRandomMiners() ([]int, error) {
+//	([]string, error): A slice of the addresses of all active miners and an error, if any occurred during the process.
+func (u *User) getMinersFrom(address string) ([]string, error) {
 	// Send a GET request to the tracker's "/get_miners" endpoint
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/get_miners", u.trackerPort))
+	resp, err := u.client.Get(peer.URL(address) + "/get_miners")
 	if err != nil {
 		return nil, err
 	}
@@ -63,33 +182,74 @@ func (u *User) GetRandomMiners() ([]int, error) {
 		return nil, errors.New("failed to retrieve miners from the tracker")
 	}
 
-	// Decode the response body to get the list of miner ports
+	// Decode the response body to get the list of miner addresses
 	var response tracker.PortsJson
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 		return nil, errors.New("tracker sends invalid response")
 	}
-	ports := response.Ports
+	return response.MinerAddresses(), nil
+}
+
+// GetRandomMiners retrieves a random subset of miners from the tracker service.
+// It retrieves the list of active miners with GetMiners.
+// If the number of available miners is less than or equal to RWCount, it returns all miners. Otherwise, it shuffles
+// the list and selects a random subset of RWCount miners.
+// Returns:
+//
+//	([]string, error): A slice of selected miner addresses and an error, if any occurred during the process.
+func (u *User) GetRandomMiners() ([]string, error) {
+	addresses, err := u.GetMiners()
+	if err != nil {
+		return nil, err
+	}
 
 	// Select a random subset of miners
-	if len(ports) <= RWCount {
+	if len(addresses) <= RWCount {
 		// If the number of miners is less than or equal to RWCount, use all miners
-		return ports, nil
+		return addresses, nil
 	}
 
-	// Shuffle the miner ports randomly
-	rand.Shuffle(len(ports), func(i, j int) {
-		ports[i], ports[j] = ports[j], ports[i]
+	// Shuffle the miner addresses randomly
+	rand.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
 	})
 
 	// Select the first RWCount miners from the shuffled list
-	return ports[:RWCount], nil
+	return addresses[:RWCount], nil
+}
+
+// GetTip retrieves the last block on the blockchain of one miner, from its "/tip" endpoint.
+// The block is not validated, so it only tells how far the miner is.
+// Parameters:
+//
+//	address (string): The address of the miner, as GetMiners returns it.
+//
+// Returns:
+//
+//	(miner.BlockJson, error): The tip's hash, height and block, and an error, if any occurred during the process.
+func (u *User) GetTip(address string) (miner.BlockJson, error) {
+	resp, err := u.client.Get(peer.URL(address) + "/tip")
+	if err != nil {
+		return miner.BlockJson{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return miner.BlockJson{}, fmt.Errorf("miner rejected tip request: status code %d", resp.StatusCode)
+	}
+	var response miner.BlockJson
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return miner.BlockJson{}, errors.New("miner sends invalid response")
+	}
+	return response, nil
 }
 
 // ReadPosts retrieves posts from a random subset of miners and consolidates them into a single, validated list.
 // The function first retrieves a list of active miners and then concurrently fetches and decodes their stored blockchains.
-// It verifies each blockchain's integrity and consistency, ensuring each block is valid and properly linked.
+// It verifies each blockchain's integrity and consistency, ensuring each block is valid and properly linked, and picks
+// the valid blockchain with the most accumulated work, breaking ties the same way as miners do.
 // Finally, it extracts and returns a de-duplicated list of posts sorted by their timestamp and user public key.
+// If no blockchain is valid, the returned error wraps the reason each blockchain was rejected.
 // Returns:
 //
 //	([]blockchain.Post, error): A slice of blockchain posts that have been validated and sorted, and an error, if any occurred.
@@ -101,10 +261,10 @@ func (u *User) ReadPosts() ([]blockchain.Post, error) {
 
 	// send concurrent requests to get each miner's blockchain
 	respChan := make(chan []blockchain.Block)
-	for _, port := range miners {
-		port := port
-		go func(port int) {
-			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/read", port))
+	for _, address := range miners {
+		address := address
+		go func(address string) {
+			resp, err := u.client.Get(peer.URL(address) + "/read")
 			if err != nil {
 				respChan <- nil
 				return
@@ -128,61 +288,37 @@ func (u *User) ReadPosts() ([]blockchain.Post, error) {
 				chain = append(chain, decoded)
 			}
 			respChan <- chain
-		}(port)
+		}(address)
 	}
 	chains := make([][]blockchain.Block, 0)
 	for i := 0; i < len(miners); i++ {
 		chains = append(chains, <-respChan)
 	}
-	// sort the chains from longest to shortest
+	// sort the chains from the most preferred to the least preferred
 	sort.Slice(chains, func(i, j int) bool {
-		return len(chains[i]) > len(chains[j])
+		return blockchain.CompareChains(chains[i], chains[j]) > 0
 	})
 
 	// find the first valid chain
 	cmp := func(a, b any) int {
 		post1 := a.(blockchain.Post)
 		post2 := b.(blockchain.Post)
-		if post1.Body.Timestamp != post2.Body.Timestamp {
-			if post1.Body.Timestamp < post2.Body.Timestamp {
-				return -1
-			} else {
-				return 1
-			}
-		}
-		key1 := blockchain.PublicKeyToBytes(post1.User)
-		key2 := blockchain.PublicKeyToBytes(post2.User)
-		return bytes.Compare(key1, key2)
+		return blockchain.ComparePosts(&post1, &post2)
 	}
 	var posts *treeset.Set
-VerifyChains:
+	reasons := make([]error, 0)
 	for _, chain := range chains {
 		if len(chain) == 0 {
-			continue VerifyChains
-		}
-		// each block must be valid
-		for _, block := range chain {
-			if !block.Verify() {
-				continue VerifyChains
-			}
+			continue
 		}
-		// their hash value must form a chain
-		if !bytes.Equal(chain[0].Header.PrevHash, make([]byte, 32)) {
-			continue VerifyChains
+		if err := blockchain.Chain(chain).Validate(u.params); err != nil {
+			log.Printf("rejected a blockchain: %s\n", err.Error())
+			reasons = append(reasons, err)
+			continue
 		}
-		for i := 1; i < len(chain); i++ {
-			if !bytes.Equal(chain[i].Header.PrevHash, blockchain.Hash(chain[i-1].Header)) {
-				continue VerifyChains
-			}
-		}
-		// no duplicated posts
 		posts = treeset.NewWith(cmp)
 		for _, block := range chain {
 			for _, post := range block.Posts {
-				if posts.Contains(post) {
-					posts = nil
-					continue VerifyChains
-				}
 				posts.Add(post)
 			}
 		}
@@ -190,7 +326,10 @@ VerifyChains:
 		break
 	}
 	if posts == nil {
-		return nil, errors.New("failed to receive a valid blockchain")
+		if len(reasons) == 0 {
+			return nil, errors.New("failed to receive a valid blockchain")
+		}
+		return nil, fmt.Errorf("failed to receive a valid blockchain: %w", errors.Join(reasons...))
 	}
 	postsList := make([]blockchain.Post, 0)
 	iter := posts.Iterator()
@@ -210,12 +349,14 @@ VerifyChains:
 //
 // Returns:
 //
+//	string: The hex-encoded ID of the post (see blockchain.Post.ID), which can be looked up on a miner's /post API.
 //	error: An error if any occurred during the process of writing the post.
-func (u *User) WritePost(content string) error {
+func (u *User) WritePost(content string) (string, error) {
 	// Create a new post with the given content and the user's public key
 	post := blockchain.Post{
-		User: &u.privateKey.PublicKey,
+		User: u.privateKey.Public(),
 		Body: blockchain.PostBody{
+			ChainID:   u.params.ChainID,
 			Content:   content,
 			Timestamp: time.Now().UnixNano(),
 		},
@@ -223,6 +364,9 @@ func (u *User) WritePost(content string) error {
 
 	// Sign the post using the user's private key
 	post.Signature = blockchain.Sign(u.privateKey, post.Body)
+	if err := post.Validate(u.params); err != nil {
+		return "", err
+	}
 
 	// Encode the post to base64
 	postBase64 := post.EncodeBase64()
@@ -230,7 +374,7 @@ func (u *User) WritePost(content string) error {
 	// Determine the number of miners to use
 	miners, err := u.GetRandomMiners()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Create a wait group to wait for concurrent requests to finish
@@ -238,15 +382,15 @@ func (u *User) WritePost(content string) error {
 	errChan := make(chan error, len(miners)) // Channel to collect errors
 
 	// Send POST requests to the selected miners concurrently
-	for _, port := range miners {
-		port := port
+	for _, address := range miners {
+		address := address
 		wg.Add(1)
-		go func(port int) {
+		go func(address string) {
 			defer wg.Done()
 
 			// Send a POST request to the miner's "/write" endpoint with the post data
 			postJSON, _ := json.Marshal(postBase64)
-			resp, err := http.Post(fmt.Sprintf("http://localhost:%d/write", port), "application/json", bytes.NewReader(postJSON))
+			resp, err := u.client.Post(peer.URL(address)+"/write", "application/json", bytes.NewReader(postJSON))
 			if err != nil {
 				errChan <- err
 				return
@@ -255,7 +399,7 @@ func (u *User) WritePost(content string) error {
 				errChan <- fmt.Errorf("miner rejected post: status code %d", resp.StatusCode)
 			}
 			resp.Body.Close()
-		}(port)
+		}(address)
 	}
 
 	// Wait for all concurrent requests to finish
@@ -265,9 +409,9 @@ func (u *User) WritePost(content string) error {
 	// Check for errors from the error channel
 	for e := range errChan {
 		if e != nil {
-			return e // Return the first error encountered
+			return "", e // Return the first error encountered
 		}
 	}
 
-	return nil
+	return hex.EncodeToString(post.ID()), nil
 }